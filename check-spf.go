@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/TrueFix/getmail/email"
+)
+
+// errSPFFail is returned by runCheckSPF when the IP is not allowed to send for
+// the domain. The result has already been printed, so main only sets the exit
+// status.
+var errSPFFail = errors.New("check-spf: not allowed")
+
+// runCheckSPF resolves the SPF record of a domain and checks an IP against it.
+// It returns errSPFFail when the IP is not allowed.
+func runCheckSPF(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("check-spf: expected <domain> <ip>")
+	}
+	domain := args[0]
+	ip := net.ParseIP(args[1])
+	if ip == nil {
+		return fmt.Errorf("check-spf: invalid IP address %q", args[1])
+	}
+
+	ok, err := email.NewSPFRecord(domain).CheckSPF(domain, ip)
+	if err != nil {
+		return fmt.Errorf("check-spf: %w", err)
+	}
+
+	if !ok {
+		fmt.Printf("fail: %s is not allowed to send for %s\n", ip, domain)
+		return errSPFFail
+	}
+	fmt.Printf("pass: %s is allowed to send for %s\n", ip, domain)
+	return nil
+}
@@ -0,0 +1,561 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/TrueFix/getmail/service"
+)
+
+// Config holds everything needed to run the getmail SMTP server.
+type Config struct {
+	Server         Server      `json:"server"`
+	Listeners      []Listener  `json:"listeners"`
+	TLS            TLS         `json:"tls"`
+	Auth           Auth        `json:"auth"`
+	Recipients     Recipients  `json:"recipients"`
+	Limits         Limits      `json:"limits"`
+	Greylist       Greylist    `json:"greylist"`
+	DNSBL          DNSBL       `json:"dnsbl"`
+	Spool          Spool       `json:"spool"`
+	DeadLetters    DeadLetters `json:"dead_letters"`
+	Webhook        Webhook     `json:"webhook"`
+	Maildir        Maildir     `json:"maildir"`
+	TrustedDomains []string    `json:"trusted_domains"`
+	Handler        string      `json:"handler"`
+}
+
+// Server holds the settings shared by all listeners. Addr is only used when
+// no listeners are configured.
+type Server struct {
+	Addr            string   `json:"addr"`
+	Domain          string   `json:"domain"`
+	ReadTimeout     Duration `json:"read_timeout"`
+	WriteTimeout    Duration `json:"write_timeout"`
+	MaxMessageBytes int64    `json:"max_message_bytes"`
+	MaxRecipients   int      `json:"max_recipients"`
+
+	// ShutdownTimeout bounds how long a shutdown waits for open sessions
+	// and running handlers before closing them.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// HandlerTimeout bounds how long the reply to DATA waits for the
+	// handler before the client is told to retry. A handler that runs past
+	// it may still deliver the message, so delivery is at least once.
+	HandlerTimeout Duration `json:"handler_timeout"`
+
+	// ReturnPath adds a Return-Path header with the envelope sender to the
+	// stored message, as a final delivery agent does.
+	ReturnPath bool `json:"return_path"`
+}
+
+// TLS holds the certificates used for STARTTLS and implicit TLS. CertDir
+// holds <name>.crt/<name>.key pairs chosen by SNI; CertFile/KeyFile is a
+// single pair that may be combined with it.
+type TLS struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CertDir  string `json:"cert_dir"`
+
+	// ReloadInterval is how often the files are checked for changes;
+	// zero disables polling (SIGHUP still reloads).
+	ReloadInterval Duration `json:"reload_interval"`
+
+	// RequestClientCert asks clients for a certificate so it can be recorded
+	// on the email. The certificate is not verified.
+	RequestClientCert bool `json:"request_client_cert"`
+}
+
+// Auth configures SMTP AUTH. AUTH is only offered when a credentials file
+// is set.
+type Auth struct {
+	HtpasswdFile string `json:"htpasswd_file"` // username:hash lines, bcrypt or argon2id
+}
+
+// Recipients restricts RCPT to known mailboxes. Every address in the
+// trusted domains is accepted when no file is set.
+type Recipients struct {
+	File string `json:"file"` // one mailbox@domain, *@domain or *@*.domain pattern per line
+}
+
+// Limits throttles abusive clients. A zero limit is not enforced.
+type Limits struct {
+	ConnectionsPerIP  int `json:"connections_per_ip"`  // concurrent connections per client network
+	MessagesPerMinute int `json:"messages_per_minute"` // messages per client network
+	RecipientsPerHour int `json:"recipients_per_hour"` // recipients per sender (login or MAIL FROM)
+
+	// Clients are counted per network of this size (default /32 and /64).
+	IPv4Prefix int `json:"ipv4_prefix"`
+	IPv6Prefix int `json:"ipv6_prefix"`
+
+	Exempt []string `json:"exempt"` // CIDRs or IPs that are never limited
+}
+
+// Enabled reports whether any limit is set.
+func (l Limits) Enabled() bool {
+	return l.ConnectionsPerIP > 0 || l.MessagesPerMinute > 0 || l.RecipientsPerHour > 0
+}
+
+// Greylist configures greylisting of unknown (client, sender, recipient)
+// triplets. Authenticated clients are never greylisted.
+type Greylist struct {
+	Enabled     bool     `json:"enabled"`
+	File        string   `json:"file"`         // state kept across restarts, memory only when empty
+	Delay       Duration `json:"delay"`        // minimum wait before a retry is accepted
+	RetryWindow Duration `json:"retry_window"` // how long an unconfirmed triplet is kept
+	Whitelist   Duration `json:"whitelist"`    // how long a confirmed client skips greylisting
+	Exempt      []string `json:"exempt"`       // CIDRs or IPs that are never greylisted
+
+	// Clients are grouped per network of this size (default /24 and /64).
+	IPv4Prefix int `json:"ipv4_prefix"`
+	IPv6Prefix int `json:"ipv6_prefix"`
+}
+
+// DNSBL configures DNS blocklist lookups of the client address. Lookups
+// are off while Lists is empty.
+type DNSBL struct {
+	Lists     []DNSBLList `json:"lists"`
+	Threshold int         `json:"threshold"` // score at which Action applies
+	Action    string      `json:"action"`    // "reject", "tag" or "log"
+	Resolver  string      `json:"resolver"`  // host:port of the DNS server, system resolver when empty
+	Timeout   Duration    `json:"timeout"`   // per lookup
+	Exempt    []string    `json:"exempt"`    // CIDRs or IPs that are never looked up
+}
+
+// DNSBLList is a blocklist zone and the weight a listing adds to the score.
+type DNSBLList struct {
+	Zone   string `json:"zone"`
+	Weight int    `json:"weight"` // 1 when zero
+}
+
+// Spool queues accepted emails on disk and delivers them to the handler in
+// the background, retrying failed deliveries. Without a directory the
+// handler runs while the client waits for the reply to DATA.
+type Spool struct {
+	Dir        string   `json:"dir"`
+	Workers    int      `json:"workers"`     // concurrent deliveries
+	Backoff    Duration `json:"backoff"`     // delay before the first retry, doubled for every further one
+	MaxBackoff Duration `json:"max_backoff"` // longest delay between retries
+	MaxAge     Duration `json:"max_age"`     // how long delivery is retried before the email is given up
+}
+
+// DeadLetters keeps the messages that could not be processed so they can
+// be inspected and re-driven with "getmail dead-letters". Failed messages
+// are only logged when Dir is empty.
+type DeadLetters struct {
+	Dir string `json:"dir"`
+}
+
+// Webhook configures the "webhook" handler, which POSTs every email as
+// JSON to each URL.
+type Webhook struct {
+	URLs        []string `json:"urls"`
+	Secret      string   `json:"secret"`      // HMAC-SHA256 key for X-Getmail-Signature, unsigned when empty
+	Attachments string   `json:"attachments"` // "inline" (base64 in the JSON) or "multipart"
+	Timeout     Duration `json:"timeout"`     // per request
+	Retries     int      `json:"retries"`     // per URL after a 5xx status, 429 or timeout
+	Backoff     Duration `json:"backoff"`     // before the first retry, doubled for every further one
+	MaxBackoff  Duration `json:"max_backoff"` // longest delay between retries
+}
+
+// WebhookAttachments lists the values accepted by webhook.attachments.
+var WebhookAttachments = []string{"inline", "multipart"}
+
+// Maildir configures the "maildir" handler, which delivers every email
+// into Maildir folders under Root.
+type Maildir struct {
+	Root   string `json:"root"`
+	Layout string `json:"layout"` // "recipient" (<root>/<domain>/<user>) or "domain" (<root>/<domain>)
+}
+
+// MaildirLayouts lists the values accepted by maildir.layout.
+var MaildirLayouts = []string{"recipient", "domain"}
+
+// DNSBLActions lists the values accepted by dnsbl.action.
+var DNSBLActions = []string{"reject", "tag", "log"}
+
+// Handlers lists the handler names accepted by the "handler" key.
+var Handlers = []string{"log", "webhook", "maildir"}
+
+// Default returns the configuration used when no file is given.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:            "0.0.0.0:25",
+			Domain:          "localhost",
+			ReadTimeout:     Duration{Duration: 10 * time.Second},
+			WriteTimeout:    Duration{Duration: 10 * time.Second},
+			MaxMessageBytes: 1024 * 1024,
+			MaxRecipients:   50,
+			ShutdownTimeout: Duration{Duration: 30 * time.Second},
+			HandlerTimeout:  Duration{Duration: time.Minute},
+		},
+		DNSBL: DNSBL{
+			Threshold: 1,
+			Action:    "reject",
+			Timeout:   Duration{Duration: 2 * time.Second},
+		},
+		Greylist: Greylist{
+			Delay:       Duration{Duration: 5 * time.Minute},
+			RetryWindow: Duration{Duration: 48 * time.Hour},
+			Whitelist:   Duration{Duration: 35 * 24 * time.Hour},
+		},
+		Spool: Spool{
+			Workers:    email.DefaultSpoolWorkers,
+			Backoff:    Duration{Duration: email.DefaultSpoolBackoff},
+			MaxBackoff: Duration{Duration: email.DefaultSpoolMaxBackoff},
+			MaxAge:     Duration{Duration: email.DefaultSpoolMaxAge},
+		},
+		Webhook: Webhook{
+			Attachments: "inline",
+			Timeout:     Duration{Duration: 10 * time.Second},
+			Retries:     2,
+			Backoff:     Duration{Duration: time.Second},
+			MaxBackoff:  Duration{Duration: 30 * time.Second},
+		},
+		Maildir: Maildir{
+			Layout: "recipient",
+		},
+		TLS: TLS{
+			ReloadInterval: Duration{Duration: 30 * time.Second},
+		},
+		TrustedDomains: []string{},
+		Handler:        "log",
+	}
+}
+
+// Load reads the configuration file at path on top of the defaults, applies
+// GETMAIL_* environment overrides and validates the result. An empty path
+// skips the file and only applies the environment.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		if err := decode(data, cfg); err != nil {
+			return nil, fmt.Errorf("config: %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	// Fall back to the certificate written by "getmail gen-cert".
+	if cfg.TLS.CertFile == "" && cfg.TLS.KeyFile == "" && cfg.TLS.CertDir == "" {
+		cfg.TLS.CertFile = "config/localhost.crt"
+		cfg.TLS.KeyFile = "config/localhost.key"
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return cfg, nil
+}
+
+// decode strictly unmarshals data into cfg, rejecting unknown keys.
+func decode(data []byte, cfg *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return &FieldError{Key: typeErr.Field, Msg: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}
+		}
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after top-level object")
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports the first invalid key.
+func (c *Config) Validate() error {
+	if len(c.Listeners) == 0 && c.Server.Addr == "" {
+		return &FieldError{Key: "server.addr", Msg: "must not be empty"}
+	}
+	if err := c.Server.ReadTimeout.check("server.read_timeout"); err != nil {
+		return err
+	}
+	if err := c.Server.WriteTimeout.check("server.write_timeout"); err != nil {
+		return err
+	}
+	if err := c.Server.ShutdownTimeout.check("server.shutdown_timeout"); err != nil {
+		return err
+	}
+	if err := c.Server.HandlerTimeout.check("server.handler_timeout"); err != nil {
+		return err
+	}
+	if c.Server.MaxMessageBytes < 0 {
+		return &FieldError{Key: "server.max_message_bytes", Msg: "must not be negative"}
+	}
+	if c.Server.MaxRecipients < 0 {
+		return &FieldError{Key: "server.max_recipients", Msg: "must not be negative"}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return &FieldError{Key: "tls", Msg: "cert_file and key_file must be set together"}
+	}
+	if err := c.TLS.ReloadInterval.check("tls.reload_interval"); err != nil {
+		return err
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+	if err := c.Greylist.validate(); err != nil {
+		return err
+	}
+	if err := c.DNSBL.validate(); err != nil {
+		return err
+	}
+	if err := c.Spool.validate(); err != nil {
+		return err
+	}
+	for i, d := range c.TrustedDomains {
+		if err := checkDomain(fmt.Sprintf("trusted_domains[%d]", i), d); err != nil {
+			return err
+		}
+	}
+	if err := c.validateListeners(); err != nil {
+		return err
+	}
+	if !slices.Contains(Handlers, c.Handler) {
+		return &FieldError{Key: "handler", Msg: fmt.Sprintf("unknown handler %q (expected one of %s)", c.Handler, strings.Join(Handlers, ", "))}
+	}
+	if c.Handler == "webhook" && len(c.Webhook.URLs) == 0 {
+		return &FieldError{Key: "webhook.urls", Msg: "must not be empty for the webhook handler"}
+	}
+	if err := c.Webhook.validate(); err != nil {
+		return err
+	}
+	if err := c.validateWebhookTime(); err != nil {
+		return err
+	}
+	if c.Handler == "maildir" && c.Maildir.Root == "" {
+		return &FieldError{Key: "maildir.root", Msg: "must not be empty for the maildir handler"}
+	}
+	if err := c.Maildir.validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l Limits) validate() error {
+	if l.ConnectionsPerIP < 0 {
+		return &FieldError{Key: "limits.connections_per_ip", Msg: "must not be negative"}
+	}
+	if l.MessagesPerMinute < 0 {
+		return &FieldError{Key: "limits.messages_per_minute", Msg: "must not be negative"}
+	}
+	if l.RecipientsPerHour < 0 {
+		return &FieldError{Key: "limits.recipients_per_hour", Msg: "must not be negative"}
+	}
+	if l.IPv4Prefix < 0 || l.IPv4Prefix > 32 {
+		return &FieldError{Key: "limits.ipv4_prefix", Msg: "must be between 0 and 32"}
+	}
+	if l.IPv6Prefix < 0 || l.IPv6Prefix > 128 {
+		return &FieldError{Key: "limits.ipv6_prefix", Msg: "must be between 0 and 128"}
+	}
+	for i, e := range l.Exempt {
+		if _, err := ParseNetworks([]string{e}); err != nil {
+			return &FieldError{Key: fmt.Sprintf("limits.exempt[%d]", i), Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (g Greylist) validate() error {
+	if err := g.Delay.check("greylist.delay"); err != nil {
+		return err
+	}
+	if err := g.RetryWindow.check("greylist.retry_window"); err != nil {
+		return err
+	}
+	if err := g.Whitelist.check("greylist.whitelist"); err != nil {
+		return err
+	}
+	if g.IPv4Prefix < 0 || g.IPv4Prefix > 32 {
+		return &FieldError{Key: "greylist.ipv4_prefix", Msg: "must be between 0 and 32"}
+	}
+	if g.IPv6Prefix < 0 || g.IPv6Prefix > 128 {
+		return &FieldError{Key: "greylist.ipv6_prefix", Msg: "must be between 0 and 128"}
+	}
+	for i, e := range g.Exempt {
+		if _, err := ParseNetworks([]string{e}); err != nil {
+			return &FieldError{Key: fmt.Sprintf("greylist.exempt[%d]", i), Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (d DNSBL) validate() error {
+	for i, l := range d.Lists {
+		if err := checkDomain(fmt.Sprintf("dnsbl.lists[%d].zone", i), l.Zone); err != nil {
+			return err
+		}
+		if l.Weight < 0 {
+			return &FieldError{Key: fmt.Sprintf("dnsbl.lists[%d].weight", i), Msg: "must not be negative"}
+		}
+	}
+	if d.Threshold < 1 {
+		return &FieldError{Key: "dnsbl.threshold", Msg: "must be at least 1"}
+	}
+	if !slices.Contains(DNSBLActions, d.Action) {
+		return &FieldError{Key: "dnsbl.action", Msg: fmt.Sprintf("unknown action %q (expected one of %s)", d.Action, strings.Join(DNSBLActions, ", "))}
+	}
+	if d.Resolver != "" {
+		if _, _, err := net.SplitHostPort(d.Resolver); err != nil {
+			return &FieldError{Key: "dnsbl.resolver", Msg: fmt.Sprintf("invalid address %q (expected host:port)", d.Resolver)}
+		}
+	}
+	if err := d.Timeout.check("dnsbl.timeout"); err != nil {
+		return err
+	}
+	for i, e := range d.Exempt {
+		if _, err := ParseNetworks([]string{e}); err != nil {
+			return &FieldError{Key: fmt.Sprintf("dnsbl.exempt[%d]", i), Msg: err.Error()}
+		}
+	}
+	return nil
+}
+
+func (s Spool) validate() error {
+	if s.Dir != "" && s.Workers < 1 {
+		return &FieldError{Key: "spool.workers", Msg: "must be at least 1"}
+	}
+	if err := s.Backoff.check("spool.backoff"); err != nil {
+		return err
+	}
+	if err := s.MaxBackoff.check("spool.max_backoff"); err != nil {
+		return err
+	}
+	if err := s.MaxAge.check("spool.max_age"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m Maildir) validate() error {
+	if !slices.Contains(MaildirLayouts, m.Layout) {
+		return &FieldError{Key: "maildir.layout", Msg: fmt.Sprintf("unknown layout %q (expected one of %s)", m.Layout, strings.Join(MaildirLayouts, ", "))}
+	}
+	return nil
+}
+
+func (w Webhook) validate() error {
+	for i, u := range w.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return &FieldError{Key: fmt.Sprintf("webhook.urls[%d]", i), Msg: fmt.Sprintf("invalid URL %q (expected http or https)", u)}
+		}
+	}
+	if !slices.Contains(WebhookAttachments, w.Attachments) {
+		return &FieldError{Key: "webhook.attachments", Msg: fmt.Sprintf("unknown mode %q (expected one of %s)", w.Attachments, strings.Join(WebhookAttachments, ", "))}
+	}
+	if err := w.Timeout.check("webhook.timeout"); err != nil {
+		return err
+	}
+	if w.Retries < 0 {
+		return &FieldError{Key: "webhook.retries", Msg: "must not be negative"}
+	}
+	if err := w.Backoff.check("webhook.backoff"); err != nil {
+		return err
+	}
+	if err := w.MaxBackoff.check("webhook.max_backoff"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateWebhookTime checks that the webhook handler, retries included,
+// answers within server.handler_timeout when it runs while the client
+// waits. Past it the client is told to retry while the handler may still
+// deliver the email. With a spool, the spool retries a cut-off attempt.
+func (c *Config) validateWebhookTime() error {
+	limit := c.Server.HandlerTimeout.Duration
+	if c.Handler != "webhook" || c.Spool.Dir != "" || limit == 0 {
+		return nil
+	}
+	w := service.Webhook{
+		URLs:       c.Webhook.URLs,
+		Timeout:    c.Webhook.Timeout.Duration,
+		Retries:    c.Webhook.Retries,
+		Backoff:    c.Webhook.Backoff.Duration,
+		MaxBackoff: c.Webhook.MaxBackoff.Duration,
+	}
+	worst, bounded := w.MaxDuration()
+	if !bounded {
+		return &FieldError{Key: "webhook.timeout", Msg: "must be set to bound the webhook by server.handler_timeout, or set spool.dir"}
+	}
+	if worst > limit {
+		return &FieldError{Key: "webhook.retries", Msg: fmt.Sprintf("%d URL(s) with %d retries may take %s, longer than server.handler_timeout (%s); lower webhook.timeout or webhook.retries, or set spool.dir",
+			len(w.URLs), w.Retries, worst, limit)}
+	}
+	return nil
+}
+
+func checkDomain(key, d string) error {
+	if strings.TrimSpace(d) == "" || strings.Contains(d, "@") {
+		return &FieldError{Key: key, Msg: fmt.Sprintf("invalid domain %q", d)}
+	}
+	return nil
+}
+
+// FieldError reports an invalid configuration key.
+type FieldError struct {
+	Key string
+	Msg string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Msg)
+}
+
+// Duration is a time.Duration written as a Go duration string ("10s", "1m30s").
+type Duration struct {
+	time.Duration
+	invalid string // raw value that failed to parse, reported by Validate
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		d.invalid = string(b)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		d.invalid = s
+		return nil
+	}
+	d.Duration, d.invalid = v, ""
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d Duration) check(key string) error {
+	if d.invalid != "" {
+		return &FieldError{Key: key, Msg: fmt.Sprintf("invalid duration %q", d.invalid)}
+	}
+	if d.Duration < 0 {
+		return &FieldError{Key: key, Msg: "must not be negative"}
+	}
+	return nil
+}
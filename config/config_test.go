@@ -0,0 +1,249 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		key  string // empty when the configuration is valid
+	}{
+		{"defaults", `{}`, ""},
+		{"no address", `{"server":{"addr":""}}`, "server.addr"},
+		{"listeners without address", `{"server":{"addr":""},"listeners":[{"addr":":25"}]}`, ""},
+		{"bad read timeout", `{"server":{"read_timeout":"soon"}}`, "server.read_timeout"},
+		{"negative write timeout", `{"server":{"write_timeout":"-1s"}}`, "server.write_timeout"},
+		{"numeric shutdown timeout", `{"server":{"shutdown_timeout":30}}`, "server.shutdown_timeout"},
+		{"bad handler timeout", `{"server":{"handler_timeout":"1 minute"}}`, "server.handler_timeout"},
+		{"negative message size", `{"server":{"max_message_bytes":-1}}`, "server.max_message_bytes"},
+		{"negative recipients", `{"server":{"max_recipients":-1}}`, "server.max_recipients"},
+		{"cert without key", `{"tls":{"cert_file":"a.crt"}}`, "tls"},
+		{"bad reload interval", `{"tls":{"reload_interval":"x"}}`, "tls.reload_interval"},
+		{"negative connections", `{"limits":{"connections_per_ip":-1}}`, "limits.connections_per_ip"},
+		{"negative messages", `{"limits":{"messages_per_minute":-1}}`, "limits.messages_per_minute"},
+		{"negative rcpt rate", `{"limits":{"recipients_per_hour":-1}}`, "limits.recipients_per_hour"},
+		{"ipv4 prefix", `{"limits":{"ipv4_prefix":33}}`, "limits.ipv4_prefix"},
+		{"ipv6 prefix", `{"limits":{"ipv6_prefix":129}}`, "limits.ipv6_prefix"},
+		{"limits exempt", `{"limits":{"exempt":["10.0.0.0/8","nope"]}}`, "limits.exempt[1]"},
+		{"greylist delay", `{"greylist":{"delay":"x"}}`, "greylist.delay"},
+		{"greylist retry window", `{"greylist":{"retry_window":"-1h"}}`, "greylist.retry_window"},
+		{"greylist whitelist", `{"greylist":{"whitelist":"x"}}`, "greylist.whitelist"},
+		{"greylist exempt", `{"greylist":{"exempt":["nope"]}}`, "greylist.exempt[0]"},
+		{"greylist ipv4 prefix", `{"greylist":{"ipv4_prefix":-1}}`, "greylist.ipv4_prefix"},
+		{"greylist ipv6 prefix", `{"greylist":{"ipv6_prefix":129}}`, "greylist.ipv6_prefix"},
+		{"dnsbl zone", `{"dnsbl":{"lists":[{"zone":""}]}}`, "dnsbl.lists[0].zone"},
+		{"dnsbl weight", `{"dnsbl":{"lists":[{"zone":"bl.example","weight":-1}]}}`, "dnsbl.lists[0].weight"},
+		{"dnsbl threshold", `{"dnsbl":{"threshold":0}}`, "dnsbl.threshold"},
+		{"dnsbl action", `{"dnsbl":{"action":"drop"}}`, "dnsbl.action"},
+		{"dnsbl resolver", `{"dnsbl":{"resolver":"127.0.0.1"}}`, "dnsbl.resolver"},
+		{"dnsbl timeout", `{"dnsbl":{"timeout":"x"}}`, "dnsbl.timeout"},
+		{"dnsbl exempt", `{"dnsbl":{"exempt":["nope"]}}`, "dnsbl.exempt[0]"},
+		{"spool workers", `{"spool":{"dir":"/var/spool/getmail","workers":0}}`, "spool.workers"},
+		{"spool workers unused", `{"spool":{"workers":0}}`, ""},
+		{"spool backoff", `{"spool":{"backoff":"x"}}`, "spool.backoff"},
+		{"spool max backoff", `{"spool":{"max_backoff":"-1s"}}`, "spool.max_backoff"},
+		{"spool max age", `{"spool":{"max_age":"x"}}`, "spool.max_age"},
+		{"trusted domain", `{"trusted_domains":["example.com","user@example.com"]}`, "trusted_domains[1]"},
+		{"handler", `{"handler":"smtp"}`, "handler"},
+		{"webhook without urls", `{"handler":"webhook"}`, "webhook.urls"},
+		{"webhook url", `{"webhook":{"urls":["ftp://example.com"]}}`, "webhook.urls[0]"},
+		{"webhook attachments", `{"webhook":{"attachments":"none"}}`, "webhook.attachments"},
+		{"webhook timeout", `{"webhook":{"timeout":"x"}}`, "webhook.timeout"},
+		{"webhook retries", `{"webhook":{"retries":-1}}`, "webhook.retries"},
+		{"webhook backoff", `{"webhook":{"backoff":"x"}}`, "webhook.backoff"},
+		{"webhook max backoff", `{"webhook":{"max_backoff":"x"}}`, "webhook.max_backoff"},
+		{"webhook within handler timeout", `{"handler":"webhook","webhook":{"urls":["https://a.example/hook"]}}`, ""},
+		{"webhook past handler timeout", `{"handler":"webhook","webhook":{"urls":["https://a.example/hook","https://b.example/hook"]}}`, "webhook.retries"},
+		{"webhook without timeout", `{"handler":"webhook","webhook":{"urls":["https://a.example/hook"],"timeout":"0s"}}`, "webhook.timeout"},
+		{"webhook past handler timeout, spooled", `{"handler":"webhook","webhook":{"urls":["https://a.example/hook","https://b.example/hook"]},"spool":{"dir":"/var/spool/getmail"}}`, ""},
+		{"webhook, handler timeout off", `{"handler":"webhook","webhook":{"urls":["https://a.example/hook"],"timeout":"0s"},"server":{"handler_timeout":"0s"}}`, ""},
+		{"maildir without root", `{"handler":"maildir"}`, "maildir.root"},
+		{"maildir layout", `{"maildir":{"layout":"flat"}}`, "maildir.layout"},
+		{"listener address", `{"listeners":[{"addr":""}]}`, "listeners[0].addr"},
+		{"duplicate listener", `{"listeners":[{"addr":":25"},{"addr":":25"}]}`, "listeners[1].name"},
+		{"listener network", `{"listeners":[{"addr":":25","network":"udp"}]}`, "listeners[0].network"},
+		{"listener protocol", `{"listeners":[{"addr":":25","protocol":"http"}]}`, "listeners[0].protocol"},
+		{"listener tls mode", `{"listeners":[{"addr":":25","tls_mode":"always"}]}`, "listeners[0].tls_mode"},
+		{"implicit without cert", `{"listeners":[{"addr":":465","tls_mode":"implicit"}]}`, "listeners[0].tls_mode"},
+		{"require auth", `{"listeners":[{"addr":":587","require_auth":true}]}`, "listeners[0].require_auth"},
+		{"listener timeout", `{"listeners":[{"addr":":25","read_timeout":"x"}]}`, "listeners[0].read_timeout"},
+		{"listener recipients", `{"listeners":[{"addr":":25","max_recipients":-1}]}`, "listeners[0].max_recipients"},
+		{"proxy without peers", `{"listeners":[{"addr":":25","proxy_protocol":true}]}`, "listeners[0].trusted_proxies"},
+		{"trusted proxy", `{"listeners":[{"addr":":25","trusted_proxies":["nope"]}]}`, "listeners[0].trusted_proxies[0]"},
+		{"xclient peer", `{"listeners":[{"addr":":25","xclient_peers":["nope"]}]}`, "listeners[0].xclient_peers[0]"},
+		{"xclient implicit", `{"tls":{"cert_file":"a.crt","key_file":"a.key"},"listeners":[{"addr":":465","tls_mode":"implicit","xclient_peers":["10.0.0.1"]}]}`, "listeners[0].xclient_peers"},
+		{"listener domain", `{"listeners":[{"addr":":25","trusted_domains":[" "]}]}`, "listeners[0].trusted_domains[0]"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		if err := decode([]byte(tt.json), cfg); err != nil {
+			t.Fatalf("%s: decode: %v", tt.name, err)
+		}
+		err := cfg.Validate()
+		if tt.key == "" {
+			if err != nil {
+				t.Errorf("%s: Validate() = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Key != tt.key {
+			t.Errorf("%s: Validate() = %v, want an error for %s", tt.name, err, tt.key)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		json string
+		key  string // FieldError key, empty for other errors
+	}{
+		{`{"server":{"adr":":25"}}`, ""},
+		{`{"server":{"max_recipients":"50"}}`, "server.max_recipients"},
+		{`{} {}`, ""},
+	}
+	for _, tt := range tests {
+		err := decode([]byte(tt.json), Default())
+		if err == nil {
+			t.Errorf("decode(%s) succeeded", tt.json)
+			continue
+		}
+		var fieldErr *FieldError
+		if isField := errors.As(err, &fieldErr); isField != (tt.key != "") || (isField && fieldErr.Key != tt.key) {
+			t.Errorf("decode(%s) = %v, want key %q", tt.json, err, tt.key)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"GETMAIL_SERVER_ADDR":               " 127.0.0.1:2525 ",
+		"GETMAIL_SERVER_READ_TIMEOUT":       "5s",
+		"GETMAIL_SERVER_MAX_MESSAGE_BYTES":  "2048",
+		"GETMAIL_LIMITS_CONNECTIONS_PER_IP": "3",
+		"GETMAIL_GREYLIST_ENABLED":          "true",
+		"GETMAIL_SPOOL_WORKERS":             "8",
+		"GETMAIL_WEBHOOK_URLS":              "https://a.example/hook, ,https://b.example/hook",
+		"GETMAIL_TRUSTED_DOMAINS":           "example.com",
+		"GETMAIL_HANDLER":                   "webhook",
+	}
+	cfg := Default()
+	if err := applyEnv(cfg, lookupMap(env)); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key        string
+		have, want any
+	}{
+		{"server.addr", cfg.Server.Addr, "127.0.0.1:2525"},
+		{"server.read_timeout", cfg.Server.ReadTimeout.Duration, 5 * time.Second},
+		{"server.write_timeout", cfg.Server.WriteTimeout.Duration, 10 * time.Second},
+		{"server.max_message_bytes", cfg.Server.MaxMessageBytes, int64(2048)},
+		{"limits.connections_per_ip", cfg.Limits.ConnectionsPerIP, 3},
+		{"greylist.enabled", cfg.Greylist.Enabled, true},
+		{"spool.workers", cfg.Spool.Workers, 8},
+		{"webhook.urls", cfg.Webhook.URLs, []string{"https://a.example/hook", "https://b.example/hook"}},
+		{"trusted_domains", cfg.TrustedDomains, []string{"example.com"}},
+		{"handler", cfg.Handler, "webhook"},
+	} {
+		if !reflect.DeepEqual(c.have, c.want) {
+			t.Errorf("%s = %v, want %v", c.key, c.have, c.want)
+		}
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	for name, key := range map[string]string{
+		"GETMAIL_SERVER_READ_TIMEOUT":      "server.read_timeout",
+		"GETMAIL_SERVER_MAX_RECIPIENTS":    "server.max_recipients",
+		"GETMAIL_SERVER_MAX_MESSAGE_BYTES": "server.max_message_bytes",
+		"GETMAIL_GREYLIST_ENABLED":         "greylist.enabled",
+		"GETMAIL_SPOOL_WORKERS":            "spool.workers",
+	} {
+		err := applyEnv(Default(), lookupMap(map[string]string{name: "lots"}))
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Key != key {
+			t.Errorf("%s: applyEnv() = %v, want an error for %s", name, err, key)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		json string
+		want time.Duration
+		ok   bool
+	}{
+		{`"10s"`, 10 * time.Second, true},
+		{`"1m30s"`, 90 * time.Second, true},
+		{`"0s"`, 0, true},
+		{`"-1s"`, -time.Second, false},
+		{`"10"`, 0, false},
+		{`10`, 0, false},
+		{`null`, 0, true}, // left unset, as encoding/json does
+	}
+	for _, tt := range tests {
+		var d Duration
+		if err := json.Unmarshal([]byte(tt.json), &d); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", tt.json, err)
+		}
+		err := d.check("key")
+		if (err == nil) != tt.ok || d.Duration != tt.want {
+			t.Errorf("%s: %v, check() = %v", tt.json, d.Duration, err)
+		}
+	}
+
+	data, err := json.Marshal(Duration{Duration: 90 * time.Second})
+	if err != nil || string(data) != `"1m30s"` {
+		t.Errorf("Marshal = %s, %v", data, err)
+	}
+}
+
+// Listener keys left out inherit the server section; an explicit 0 turns
+// the limit off for that listener only.
+func TestResolvedListeners(t *testing.T) {
+	cfg := Default()
+	err := decode([]byte(`{
+		"server": {"max_message_bytes": 2048, "max_recipients": 5, "read_timeout": "5s"},
+		"listeners": [
+			{"name": "mx", "addr": ":25"},
+			{"name": "relay", "addr": ":2525", "max_message_bytes": 0, "max_recipients": 0, "read_timeout": "0s", "write_timeout": "1m"}
+		]
+	}`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	type limits struct {
+		maxMessageBytes int64
+		maxRecipients   int
+		readTimeout     time.Duration
+		writeTimeout    time.Duration
+	}
+	want := []limits{
+		{2048, 5, 5 * time.Second, 10 * time.Second},
+		{0, 0, 0, time.Minute},
+	}
+	for i, l := range cfg.ResolvedListeners() {
+		got := limits{*l.MaxMessageBytes, *l.MaxRecipients, l.ReadTimeout.Duration, l.WriteTimeout.Duration}
+		if got != want[i] {
+			t.Errorf("listener %s: %+v, want %+v", l.Name, got, want[i])
+		}
+	}
+}
+
+func lookupMap(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envOverride maps a GETMAIL_* environment variable onto a configuration key.
+type envOverride struct {
+	Name string
+	Key  string
+	Set  func(c *Config, v string) error
+}
+
+var envOverrides = []envOverride{
+	{"GETMAIL_SERVER_ADDR", "server.addr", func(c *Config, v string) error { c.Server.Addr = v; return nil }},
+	{"GETMAIL_SERVER_DOMAIN", "server.domain", func(c *Config, v string) error { c.Server.Domain = v; return nil }},
+	{"GETMAIL_SERVER_READ_TIMEOUT", "server.read_timeout", func(c *Config, v string) error { return setDuration(&c.Server.ReadTimeout, v) }},
+	{"GETMAIL_SERVER_WRITE_TIMEOUT", "server.write_timeout", func(c *Config, v string) error { return setDuration(&c.Server.WriteTimeout, v) }},
+	{"GETMAIL_SERVER_MAX_MESSAGE_BYTES", "server.max_message_bytes", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		c.Server.MaxMessageBytes = n
+		return err
+	}},
+	{"GETMAIL_SERVER_MAX_RECIPIENTS", "server.max_recipients", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		c.Server.MaxRecipients = n
+		return err
+	}},
+	{"GETMAIL_SERVER_SHUTDOWN_TIMEOUT", "server.shutdown_timeout", func(c *Config, v string) error { return setDuration(&c.Server.ShutdownTimeout, v) }},
+	{"GETMAIL_SERVER_HANDLER_TIMEOUT", "server.handler_timeout", func(c *Config, v string) error { return setDuration(&c.Server.HandlerTimeout, v) }},
+	{"GETMAIL_TLS_CERT_FILE", "tls.cert_file", func(c *Config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"GETMAIL_TLS_KEY_FILE", "tls.key_file", func(c *Config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"GETMAIL_TLS_CERT_DIR", "tls.cert_dir", func(c *Config, v string) error { c.TLS.CertDir = v; return nil }},
+	{"GETMAIL_TLS_RELOAD_INTERVAL", "tls.reload_interval", func(c *Config, v string) error { return setDuration(&c.TLS.ReloadInterval, v) }},
+	{"GETMAIL_AUTH_HTPASSWD_FILE", "auth.htpasswd_file", func(c *Config, v string) error { c.Auth.HtpasswdFile = v; return nil }},
+	{"GETMAIL_RECIPIENTS_FILE", "recipients.file", func(c *Config, v string) error { c.Recipients.File = v; return nil }},
+	{"GETMAIL_LIMITS_CONNECTIONS_PER_IP", "limits.connections_per_ip", func(c *Config, v string) error { return setInt(&c.Limits.ConnectionsPerIP, v) }},
+	{"GETMAIL_LIMITS_MESSAGES_PER_MINUTE", "limits.messages_per_minute", func(c *Config, v string) error { return setInt(&c.Limits.MessagesPerMinute, v) }},
+	{"GETMAIL_LIMITS_RECIPIENTS_PER_HOUR", "limits.recipients_per_hour", func(c *Config, v string) error { return setInt(&c.Limits.RecipientsPerHour, v) }},
+	{"GETMAIL_GREYLIST_ENABLED", "greylist.enabled", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Greylist.Enabled = b
+		return err
+	}},
+	{"GETMAIL_GREYLIST_FILE", "greylist.file", func(c *Config, v string) error { c.Greylist.File = v; return nil }},
+	{"GETMAIL_GREYLIST_DELAY", "greylist.delay", func(c *Config, v string) error { return setDuration(&c.Greylist.Delay, v) }},
+	{"GETMAIL_SPOOL_DIR", "spool.dir", func(c *Config, v string) error { c.Spool.Dir = v; return nil }},
+	{"GETMAIL_SPOOL_WORKERS", "spool.workers", func(c *Config, v string) error { return setInt(&c.Spool.Workers, v) }},
+	{"GETMAIL_DEAD_LETTERS_DIR", "dead_letters.dir", func(c *Config, v string) error { c.DeadLetters.Dir = v; return nil }},
+	{"GETMAIL_WEBHOOK_URLS", "webhook.urls", func(c *Config, v string) error { c.Webhook.URLs = splitList(v); return nil }},
+	{"GETMAIL_WEBHOOK_SECRET", "webhook.secret", func(c *Config, v string) error { c.Webhook.Secret = v; return nil }},
+	{"GETMAIL_MAILDIR_ROOT", "maildir.root", func(c *Config, v string) error { c.Maildir.Root = v; return nil }},
+	{"GETMAIL_TRUSTED_DOMAINS", "trusted_domains", func(c *Config, v string) error { c.TrustedDomains = splitList(v); return nil }},
+	{"GETMAIL_HANDLER", "handler", func(c *Config, v string) error { c.Handler = v; return nil }},
+}
+
+// applyEnv overrides configuration keys from the environment.
+func applyEnv(c *Config, lookup func(string) (string, bool)) error {
+	for _, o := range envOverrides {
+		v, ok := lookup(o.Name)
+		if !ok {
+			continue
+		}
+		if err := o.Set(c, strings.TrimSpace(v)); err != nil {
+			return &FieldError{Key: o.Key, Msg: fmt.Sprintf("invalid value %q from %s", v, o.Name)}
+		}
+	}
+	return nil
+}
+
+func setDuration(d *Duration, v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration{Duration: parsed}
+	return nil
+}
+
+func setInt(n *int, v string) error {
+	parsed, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*n = parsed
+	return nil
+}
+
+// splitList splits a comma separated environment value, dropping empty items.
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// TLS modes accepted by Listener.TLSMode.
+const (
+	TLSModeStartTLS = "starttls" // plain connection, STARTTLS offered when a certificate is loaded
+	TLSModeImplicit = "implicit" // TLS from the first byte (port 465)
+	TLSModeNone     = "none"     // never offer TLS
+)
+
+// Protocols accepted by Listener.Protocol.
+const (
+	ProtocolSMTP = "smtp"
+	ProtocolLMTP = "lmtp" // RFC 2033, per-recipient replies after DATA
+)
+
+// Listener describes one SMTP listener and the policy applied to its
+// sessions. Empty strings and nil pointers inherit the matching setting from
+// the server section, and a nil TrustedDomains inherits the top-level list.
+// An explicit 0 for a limit or timeout turns it off for this listener, as it
+// does in the server section.
+type Listener struct {
+	Name              string    `json:"name"`
+	Addr              string    `json:"addr"`     // host:port, or a socket path for the unix network
+	Network           string    `json:"network"`  // "tcp" (default) or "unix"
+	Protocol          string    `json:"protocol"` // "smtp" (default) or "lmtp"
+	TLSMode           string    `json:"tls_mode"`
+	RequireAuth       bool      `json:"require_auth"`
+	AllowInsecureAuth bool      `json:"allow_insecure_auth"` // offer AUTH without TLS
+	TrustedDomains    []string  `json:"trusted_domains"`
+	MaxMessageBytes   *int64    `json:"max_message_bytes"`
+	MaxRecipients     *int      `json:"max_recipients"`
+	ReadTimeout       *Duration `json:"read_timeout"`
+	WriteTimeout      *Duration `json:"write_timeout"`
+
+	// ProxyProtocol expects an HAProxy PROXY v1/v2 header from the peers in
+	// TrustedProxies (CIDRs or single IPs); other peers connect directly.
+	ProxyProtocol  bool     `json:"proxy_protocol"`
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// XClientPeers may use the Postfix XCLIENT and XFORWARD extensions to
+	// pass on the original client's address, HELO, reverse DNS name and
+	// login. They are not offered STARTTLS, which would hide those commands.
+	XClientPeers []string `json:"xclient_peers"`
+}
+
+// ResolvedListeners returns the configured listeners with inherited values
+// filled in, so none of their pointers are nil. Without a "listeners" section a single "smtp" listener is
+// built from the server section.
+func (c *Config) ResolvedListeners() []Listener {
+	listeners := c.Listeners
+	if len(listeners) == 0 {
+		listeners = []Listener{{Name: "smtp", Addr: c.Server.Addr}}
+	}
+
+	resolved := make([]Listener, len(listeners))
+	for i, l := range listeners {
+		if l.Name == "" {
+			l.Name = l.Addr
+		}
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Protocol == "" {
+			l.Protocol = ProtocolSMTP
+		}
+		if l.TLSMode == "" {
+			l.TLSMode = TLSModeStartTLS
+		}
+		if l.TrustedDomains == nil {
+			l.TrustedDomains = c.TrustedDomains
+		}
+		if l.MaxMessageBytes == nil {
+			l.MaxMessageBytes = &c.Server.MaxMessageBytes
+		}
+		if l.MaxRecipients == nil {
+			l.MaxRecipients = &c.Server.MaxRecipients
+		}
+		if l.ReadTimeout == nil {
+			l.ReadTimeout = &c.Server.ReadTimeout
+		}
+		if l.WriteTimeout == nil {
+			l.WriteTimeout = &c.Server.WriteTimeout
+		}
+		resolved[i] = l
+	}
+	return resolved
+}
+
+// validateListeners checks the "listeners" section.
+func (c *Config) validateListeners() error {
+	names := map[string]bool{}
+	for i, l := range c.Listeners {
+		key := fmt.Sprintf("listeners[%d]", i)
+		if l.Addr == "" {
+			return &FieldError{Key: key + ".addr", Msg: "must not be empty"}
+		}
+		name := l.Name
+		if name == "" {
+			name = l.Addr
+		}
+		if names[name] {
+			return &FieldError{Key: key + ".name", Msg: fmt.Sprintf("duplicate listener name %q", name)}
+		}
+		names[name] = true
+
+		if l.Network != "" && l.Network != "tcp" && l.Network != "unix" {
+			return &FieldError{Key: key + ".network", Msg: fmt.Sprintf("unknown network %q (expected tcp or unix)", l.Network)}
+		}
+		if l.Protocol != "" && l.Protocol != ProtocolSMTP && l.Protocol != ProtocolLMTP {
+			return &FieldError{Key: key + ".protocol", Msg: fmt.Sprintf("unknown protocol %q (expected smtp or lmtp)", l.Protocol)}
+		}
+		if l.TLSMode != "" && !slices.Contains([]string{TLSModeStartTLS, TLSModeImplicit, TLSModeNone}, l.TLSMode) {
+			return &FieldError{Key: key + ".tls_mode", Msg: fmt.Sprintf("unknown mode %q (expected starttls, implicit or none)", l.TLSMode)}
+		}
+		if l.TLSMode == TLSModeImplicit && c.TLS.CertFile == "" && c.TLS.CertDir == "" {
+			return &FieldError{Key: key + ".tls_mode", Msg: "implicit TLS requires tls.cert_file or tls.cert_dir"}
+		}
+		if l.RequireAuth && c.Auth.HtpasswdFile == "" {
+			return &FieldError{Key: key + ".require_auth", Msg: "requires auth.htpasswd_file"}
+		}
+		if l.MaxMessageBytes != nil && *l.MaxMessageBytes < 0 {
+			return &FieldError{Key: key + ".max_message_bytes", Msg: "must not be negative"}
+		}
+		if l.MaxRecipients != nil && *l.MaxRecipients < 0 {
+			return &FieldError{Key: key + ".max_recipients", Msg: "must not be negative"}
+		}
+		if l.ReadTimeout != nil {
+			if err := l.ReadTimeout.check(key + ".read_timeout"); err != nil {
+				return err
+			}
+		}
+		if l.WriteTimeout != nil {
+			if err := l.WriteTimeout.check(key + ".write_timeout"); err != nil {
+				return err
+			}
+		}
+		if l.ProxyProtocol && len(l.TrustedProxies) == 0 {
+			return &FieldError{Key: key + ".trusted_proxies", Msg: "required when proxy_protocol is enabled"}
+		}
+		for j, p := range l.TrustedProxies {
+			if _, err := ParseNetworks([]string{p}); err != nil {
+				return &FieldError{Key: fmt.Sprintf("%s.trusted_proxies[%d]", key, j), Msg: err.Error()}
+			}
+		}
+		for j, p := range l.XClientPeers {
+			if _, err := ParseNetworks([]string{p}); err != nil {
+				return &FieldError{Key: fmt.Sprintf("%s.xclient_peers[%d]", key, j), Msg: err.Error()}
+			}
+		}
+		if len(l.XClientPeers) > 0 && l.TLSMode == TLSModeImplicit {
+			return &FieldError{Key: key + ".xclient_peers", Msg: "not supported with implicit TLS"}
+		}
+		for j, d := range l.TrustedDomains {
+			if err := checkDomain(fmt.Sprintf("%s.trusted_domains[%d]", key, j), d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseNetworks parses a list of CIDRs; single IP addresses are accepted as
+// host networks.
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
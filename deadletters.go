@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/TrueFix/getmail/config"
+	"github.com/TrueFix/getmail/email"
+)
+
+// runDeadLetters lists, inspects, re-drives and removes the messages kept
+// in the dead-letter directory of the configuration.
+func runDeadLetters(args []string) error {
+	fs := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("GETMAIL_CONFIG"), "path to the JSON configuration file")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return fmt.Errorf("dead-letters: expected list, show, raw, redrive or remove")
+	}
+	action, ids := fs.Arg(0), fs.Args()[1:]
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.DeadLetters.Dir == "" {
+		return fmt.Errorf("dead-letters: dead_letters.dir is not configured")
+	}
+	store := &email.DeadLetters{Dir: cfg.DeadLetters.Dir}
+
+	if action == "list" {
+		return listDeadLetters(store)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("dead-letters: %s expects at least one id", action)
+	}
+
+	for _, id := range ids {
+		switch action {
+		case "show":
+			dl, err := store.Get(id)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(dl); err != nil {
+				return err
+			}
+
+		case "raw":
+			raw, err := store.Raw(id)
+			if err != nil {
+				return err
+			}
+			os.Stdout.Write(raw)
+
+		case "redrive":
+			dl, err := store.Get(id)
+			if err != nil {
+				return err
+			}
+			err = store.Redrive(context.Background(), id, newHandler(cfg))
+			if errors.Is(err, email.ErrUnparsable) {
+				return fmt.Errorf("%w (still not parsable, kept; see it with raw or drop it with remove)", err)
+			}
+			if err != nil {
+				return err
+			}
+			if dl.Unparsable {
+				fmt.Printf("%s: parsed and delivered (it failed to parse when received)\n", id)
+			} else {
+				fmt.Printf("%s: delivered\n", id)
+			}
+
+		case "remove":
+			if err := store.Remove(id); err != nil {
+				return err
+			}
+			fmt.Printf("%s: removed\n", id)
+
+		default:
+			return fmt.Errorf("dead-letters: unknown action %q", action)
+		}
+	}
+	return nil
+}
+
+func listDeadLetters(store *email.DeadLetters) error {
+	list, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFAILED AT\tFROM\tRCPTS\tSIZE\tERROR")
+	for _, dl := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", dl.ID, dl.FailedAt.Format("2006-01-02 15:04:05"), dl.From.Email, len(dl.RcptTo), dl.Size, dl.Error)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,106 @@
+package email
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// ErrInvalidCredentials is returned by a CredentialStore when the username is
+// unknown or the password does not match.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrAuthRequired refuses MAIL from a client that has not authenticated on a
+// listener that requires it (RFC 4954, section 6).
+var ErrAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// CredentialStore verifies the username and password sent with SMTP AUTH.
+type CredentialStore interface {
+	// Authenticate returns ErrInvalidCredentials when the username or
+	// password is wrong, and another error when they could not be checked.
+	// ctx is canceled when the session ends.
+	Authenticate(ctx context.Context, username, password string) error
+}
+
+// AuthMechanisms returns the SASL mechanisms offered to the client. AUTH is
+// not advertised when the backend has no credential store.
+func (s *Session) AuthMechanisms() []string {
+	if s.backend == nil || s.backend.Credentials == nil {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login}
+}
+
+// Auth returns the SASL server for the mechanism chosen by the client.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.backend == nil || s.backend.Credentials == nil {
+		return nil, smtp.ErrAuthUnsupported
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return smtp.ErrAuthFailed // Acting as another user is not supported
+			}
+			return s.authenticate(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: s.authenticate}, nil
+	default:
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+}
+
+func (s *Session) authenticate(username, password string) error {
+	if err := s.backend.Credentials.Authenticate(s.context(), username, password); err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			LogError("SMTP:Auth", err)
+		}
+		LogWarning("SMTP:Auth", "authentication failed for "+username)
+		return smtp.ErrAuthFailed
+	}
+
+	s.mu.Lock()
+	s.AuthUser = username
+	s.mu.Unlock()
+	return nil
+}
+
+// loginServer implements the obsolete but widely used LOGIN mechanism, which
+// go-sasl only provides as a client.
+type loginServer struct {
+	authenticate func(username, password string) error
+
+	step     int
+	username string
+}
+
+func (l *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch l.step {
+	case 0:
+		// Some clients send the username as the initial response.
+		if len(response) > 0 {
+			l.username = string(response)
+			l.step = 2
+			return []byte("Password:"), false, nil
+		}
+		l.step = 1
+		return []byte("Username:"), false, nil
+	case 1:
+		l.username = string(response)
+		l.step = 2
+		return []byte("Password:"), false, nil
+	case 2:
+		l.step = 3
+		return nil, true, l.authenticate(l.username, string(response))
+	default:
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+}
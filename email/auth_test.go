@@ -0,0 +1,54 @@
+package email
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+// credentialsFunc adapts a function to the CredentialStore interface.
+type credentialsFunc func(ctx context.Context, username, password string) error
+
+func (f credentialsFunc) Authenticate(ctx context.Context, username, password string) error {
+	return f(ctx, username, password)
+}
+
+func plainAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+}
+
+// The store gets the session's context, which ends with the session.
+func TestSessionAuthContext(t *testing.T) {
+	calls := make(chan context.Context, 2)
+	bkd := &Backend{Credentials: credentialsFunc(func(ctx context.Context, username, password string) error {
+		calls <- ctx
+		switch {
+		case username == "alice" && password == "secret":
+			return nil
+		case username == "broken":
+			return errors.New("directory unavailable")
+		}
+		return ErrInvalidCredentials
+	})}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("AUTH PLAIN "+plainAuth("alice", "wrong"), "535 ")
+	<-calls
+	c.Cmd("AUTH PLAIN "+plainAuth("broken", "secret"), "535 ")
+	<-calls
+	c.Cmd("AUTH PLAIN "+plainAuth("alice", "secret"), "235 ")
+	ctx := <-calls
+
+	if ctx.Err() != nil {
+		t.Fatalf("context done during the session: %v", ctx.Err())
+	}
+	c.Cmd("QUIT", "221 ")
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("context not canceled after QUIT")
+	}
+}
@@ -1,26 +1,130 @@
 package email
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
 
+// ErrShuttingDown is returned to clients once the backend is draining.
+var ErrShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service shutting down, try again later",
+}
+
 // Backend implements the SMTP backend.
 type Backend struct {
-	TrustedDomains  []string
+	TrustedDomains []string
+
+	// Handler decides on every received email before DATA is answered.
+	// When nil, OnEmailReceived is called and every email is accepted.
+	Handler         Handler
 	OnEmailReceived func(email *Email)
 	OnEmailFailed   func(from EmailUser, to []EmailUser, raw io.Reader, err error)
+
+	// OnFailed, when set, is called instead of OnEmailFailed with the email
+	// and its session data. An email that could not be parsed only has its
+	// raw message and session data.
+	OnFailed func(email *Email, err error)
+
+	// HandlerTimeout bounds how long DATA waits for the handler; a handler
+	// still running after it makes the client retry later. Zero waits until
+	// the session ends. The handler's ctx is canceled at the deadline, but a
+	// handler that ignores it keeps running and may still deliver the email
+	// the client is about to send again: delivery is at least once, and
+	// handlers should drop duplicates by their Message-ID header.
+	HandlerTimeout time.Duration
+
+	// ReturnPath adds a Return-Path header with the envelope sender above
+	// the Received header of every email.
+	ReturnPath bool
+
+	// OnMail and OnRcpt let the application accept, reject or defer each
+	// MAIL FROM and RCPT TO before any data is received; nil accepts.
+	OnMail MailHook
+	OnRcpt RcptHook
+
+	// Credentials verifies SMTP AUTH; AUTH is not offered when nil.
+	Credentials CredentialStore
+
+	// Recipients decides which mailboxes exist; every recipient in the
+	// trusted domains is accepted when nil.
+	Recipients RecipientRegistry
+
+	// Limiter throttles messages and recipients per client; the listeners
+	// of server.Server use it to limit connections as they accept them.
+	// Nothing is limited when nil.
+	Limiter *Limiter
+
+	// Greylist defers unknown client/sender/recipient triplets; nil
+	// disables greylisting.
+	Greylist *Greylist
+
+	// DNSBL looks up clients in DNS blocklists at MAIL; nil disables it.
+	DNSBL *DNSBL
+
+	mu       sync.Mutex
+	draining bool
+	sessions map[*Session]struct{}
+	handlers map[string]struct{} // IDs of emails whose handler is running
+	changed  chan struct{}       // closed and replaced whenever the sets above shrink
+}
+
+// Policy holds the rules a listener applies to its sessions.
+type Policy struct {
+	Listener       string   // Name of the listener, for logging
+	RequireAuth    bool     // Reject MAIL until the client has authenticated; needs Backend.Credentials
+	TrustedDomains []string // Accepted recipient domains, all when empty
 }
 
-// NewSession initializes a new SMTP session.
+// NewSession initializes a new SMTP session using the backend's
+// TrustedDomains and no other restrictions.
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{
+	return bkd.newSession(c, Policy{TrustedDomains: bkd.TrustedDomains})
+}
+
+// WithPolicy returns an smtp.Backend whose sessions apply p and share this
+// backend's handlers, so several listeners can feed the same pipeline.
+func (bkd *Backend) WithPolicy(p Policy) smtp.Backend {
+	return smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return bkd.newSession(c, p)
+	})
+}
+
+func (bkd *Backend) newSession(c *smtp.Conn, p Policy) (smtp.Session, error) {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+
+	if bkd.draining {
+		if c != nil && c.Conn() != nil {
+			Reject(c.Conn(), c.Server().Domain, ErrShuttingDown)
+		}
+		return nil, ErrShuttingDown
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
 		State:           c,
+		Handler:         bkd.Handler,
 		OnEmailReceived: bkd.OnEmailReceived,
 		OnEmailFailed:   bkd.OnEmailFailed,
-		TrustedDomains:  bkd.TrustedDomains,
-	}, nil
+		OnFailed:        bkd.OnFailed,
+		TrustedDomains:  p.TrustedDomains,
+		Policy:          p,
+		backend:         bkd,
+		started:         time.Now(),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+	bkd.init()
+	bkd.sessions[s] = struct{}{}
+	return s, nil
 }
 
 func NewBackend(
@@ -34,3 +138,126 @@ func NewBackend(
 		TrustedDomains:  TrustedDomains,
 	}
 }
+
+// init lazily allocates the tracking state; callers must hold bkd.mu.
+func (bkd *Backend) init() {
+	if bkd.sessions == nil {
+		bkd.sessions = make(map[*Session]struct{})
+		bkd.handlers = make(map[string]struct{})
+		bkd.changed = make(chan struct{})
+	}
+}
+
+// notify wakes up Wait; callers must hold bkd.mu.
+func (bkd *Backend) notify() {
+	close(bkd.changed)
+	bkd.changed = make(chan struct{})
+}
+
+func (bkd *Backend) endSession(s *Session) {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+
+	bkd.init()
+	delete(bkd.sessions, s)
+	bkd.notify()
+}
+
+// Reject answers conn with err and closes it. It is used in place of the
+// greeting, and for sessions refused by NewSession: go-smtp would send that
+// error as the reply to HELO/EHLO but keep the connection open, waiting for
+// the next command.
+func Reject(conn net.Conn, domain string, err *smtp.SMTPError) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	code := err.EnhancedCode
+	fmt.Fprintf(conn, "%d %d.%d.%d %s %s\r\n", err.Code, code[0], code[1], code[2], domain, err.Message)
+}
+
+// runHandler calls fn while recording that the handler for email id is in flight.
+func (bkd *Backend) runHandler(id string, fn func()) {
+	bkd.mu.Lock()
+	bkd.init()
+	bkd.handlers[id] = struct{}{}
+	bkd.mu.Unlock()
+
+	defer func() {
+		bkd.mu.Lock()
+		delete(bkd.handlers, id)
+		bkd.notify()
+		bkd.mu.Unlock()
+	}()
+
+	fn()
+}
+
+// Drain stops the backend from accepting new sessions and transactions.
+// Open sessions may finish the message they are sending.
+func (bkd *Backend) Drain() {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	bkd.draining = true
+}
+
+// Draining reports whether Drain has been called.
+func (bkd *Backend) Draining() bool {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	return bkd.draining
+}
+
+// Wait blocks until every session has logged out and every handler has
+// returned, or until ctx is done.
+func (bkd *Backend) Wait(ctx context.Context) error {
+	for {
+		bkd.mu.Lock()
+		bkd.init()
+		if len(bkd.sessions) == 0 && len(bkd.handlers) == 0 {
+			bkd.mu.Unlock()
+			return nil
+		}
+		changed := bkd.changed
+		bkd.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// SessionInfo describes an open session.
+type SessionInfo struct {
+	RemoteAddr string
+	Hostname   string
+	From       string
+	Recipients int
+	Pending    bool // a received message is being handed to the handler
+}
+
+// DrainReport lists the work still in flight when a shutdown deadline expired.
+type DrainReport struct {
+	Sessions []SessionInfo
+	Handlers []string // IDs of emails whose handler was still running
+}
+
+// Empty reports whether nothing was abandoned.
+func (r *DrainReport) Empty() bool {
+	return len(r.Sessions) == 0 && len(r.Handlers) == 0
+}
+
+// Report returns the sessions and handlers that are currently in flight.
+func (bkd *Backend) Report() *DrainReport {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+
+	report := &DrainReport{}
+	for s := range bkd.sessions {
+		report.Sessions = append(report.Sessions, s.info())
+	}
+	for id := range bkd.handlers {
+		report.Handlers = append(report.Handlers, id)
+	}
+	return report
+}
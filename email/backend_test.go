@@ -0,0 +1,87 @@
+package email
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A draining backend answers new sessions with 421 and closes the
+// connection instead of waiting for more commands.
+func TestDrainRefusesSession(t *testing.T) {
+	bkd := &Backend{}
+	bkd.Drain()
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "421 4.3.2 mx.example.com ")
+	c.ExpectClosed()
+}
+
+// A session open when the backend starts draining gets 421 for its next
+// transaction, which tells the client to quit.
+func TestDrainRefusesTransaction(t *testing.T) {
+	bkd := &Backend{}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	bkd.Drain()
+	c.Cmd("MAIL FROM:<bob@example.org>", "421 4.3.2 Service shutting down")
+	c.Cmd("QUIT", "221 ")
+	c.ExpectClosed()
+}
+
+// Until every session has logged out and every handler has returned, Wait
+// blocks and Report lists them. Draining lets the message in flight finish.
+func TestWaitAndReport(t *testing.T) {
+	release := make(chan struct{})
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		<-release
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	waitFor(t, "the handler to start", func() bool { return len(bkd.Report().Handlers) == 1 })
+
+	report := bkd.Report()
+	want := SessionInfo{
+		RemoteAddr: c.Conn.LocalAddr().String(),
+		Hostname:   "client.example.org",
+		From:       "bob@example.org",
+		Recipients: 1,
+		Pending:    true,
+	}
+	if len(report.Sessions) != 1 || report.Sessions[0] != want {
+		t.Errorf("Report().Sessions = %+v, want [%+v]", report.Sessions, want)
+	}
+	if report.Empty() {
+		t.Error("Report().Empty() with a session open")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := bkd.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait with a handler running = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	bkd.Drain()
+	if !bkd.Draining() {
+		t.Error("Draining() = false after Drain")
+	}
+	close(release)
+	c.Expect("250 ")
+	c.Cmd("QUIT", "221 ")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bkd.Wait(ctx); err != nil {
+		t.Fatalf("Wait after logout = %v", err)
+	}
+	if report := bkd.Report(); !report.Empty() {
+		t.Errorf("Report() after Wait = %+v, want empty", report)
+	}
+}
@@ -0,0 +1,151 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errTemporaryFailure is sent for envelope hook errors that carry no SMTP
+// status of their own.
+var errTemporaryFailure = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Temporary failure, try again later",
+}
+
+// Connection describes the client of a session. Addresses and names
+// announced by a trusted relay with XCLIENT or XFORWARD replace the ones of
+// the relay itself.
+type Connection struct {
+	Listener   string    // Name of the listener the client connected to
+	RemoteAddr string    // Address of the TCP peer, or the socket path
+	ClientIP   net.IP    // Client IP address, nil for unix sockets
+	ClientName string    // Reverse DNS name reported by a trusted relay
+	Helo       string    // HELO/EHLO name
+	AuthUser   string    // SMTP AUTH identity, empty when not authenticated
+	TLS        *TLSState // Negotiated TLS parameters, nil for plaintext sessions
+	StartedAt  time.Time // When the session began (the first HELO/EHLO, or STARTTLS)
+}
+
+// TLSState describes the TLS connection of a session.
+type TLSState struct {
+	Version      string // e.g. "TLS 1.3"
+	CipherSuite  string // e.g. "TLS_AES_128_GCM_SHA256"
+	ServerName   string // SNI name requested by the client
+	ClientCert   string // Subject of the client certificate, empty if none was sent
+	ClientIssuer string // Issuer of the client certificate
+}
+
+// Envelope holds the SMTP transaction a message arrived with.
+type Envelope struct {
+	From       string       // MAIL FROM address, empty for the null sender
+	Params     MailParams   // MAIL FROM parameters
+	Recipients []RcptParams // RCPT TO parameters, in the order of Email.RcptTo
+	MailAt     time.Time    // When MAIL FROM was accepted
+	DataAt     time.Time    // When the message data was complete
+}
+
+// MailParams holds the ESMTP parameters of MAIL FROM.
+type MailParams struct {
+	Size     int64  // SIZE, 0 when not given
+	Body     string // BODY: 7BIT, 8BITMIME or BINARYMIME
+	SMTPUTF8 bool
+	Ret      string // RET: FULL or HDRS
+	EnvID    string // ENVID
+	Auth     string // AUTH, "<>" for an empty identity
+}
+
+// RcptParams holds the ESMTP parameters of one RCPT TO.
+type RcptParams struct {
+	Address string
+	Notify  []string // NOTIFY: NEVER, or some of SUCCESS, FAILURE and DELAY
+	ORcpt   string   // ORCPT as "type;address", e.g. "rfc822;alice@example.com"
+}
+
+func newMailParams(opts *smtp.MailOptions) MailParams {
+	if opts == nil {
+		return MailParams{}
+	}
+	p := MailParams{
+		Size:     opts.Size,
+		Body:     string(opts.Body),
+		SMTPUTF8: opts.UTF8,
+		Ret:      string(opts.Return),
+		EnvID:    opts.EnvelopeID,
+	}
+	if opts.Auth != nil {
+		p.Auth = *opts.Auth
+		if p.Auth == "" {
+			p.Auth = "<>"
+		}
+	}
+	return p
+}
+
+func newRcptParams(address string, opts *smtp.RcptOptions) RcptParams {
+	p := RcptParams{Address: address}
+	if opts == nil {
+		return p
+	}
+	for _, n := range opts.Notify {
+		p.Notify = append(p.Notify, string(n))
+	}
+	if opts.OriginalRecipient != "" {
+		p.ORcpt = string(opts.OriginalRecipientType) + ";" + opts.OriginalRecipient
+	}
+	return p
+}
+
+// MailHook decides on a MAIL FROM command. Returning nil accepts the sender;
+// an *smtp.SMTPError is sent to the client as is and any other error is
+// reported as a temporary failure.
+type MailHook func(ctx context.Context, conn Connection, from EmailUser, opts *smtp.MailOptions) error
+
+// RcptHook decides on a RCPT TO command, after the built-in recipient checks
+// passed. Errors are handled as for MailHook.
+type RcptHook func(ctx context.Context, conn Connection, to EmailUser, opts *smtp.RcptOptions) error
+
+// connection returns the current description of the session's client.
+func (s *Session) connection() Connection {
+	c := Connection{
+		Listener:  s.Policy.Listener,
+		ClientIP:  s.clientIP(),
+		AuthUser:  s.authUser(),
+		StartedAt: s.started,
+	}
+	if s.State == nil || s.State.Conn() == nil {
+		return c
+	}
+
+	c.RemoteAddr = s.State.Conn().RemoteAddr().String()
+	c.Helo = s.State.Hostname()
+	if state, ok := s.State.TLSConnectionState(); ok {
+		c.TLS = newTLSState(state)
+	}
+
+	// A trusted relay may have told us about the original client.
+	if attrs, ok := forwardedAttributes(s.State.Conn()); ok {
+		if attrs.Helo != "" {
+			c.Helo = attrs.Helo
+		}
+		c.ClientName = attrs.Name
+	}
+	return c
+}
+
+func newTLSState(state tls.ConnectionState) *TLSState {
+	t := &TLSState{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		t.ClientCert = state.PeerCertificates[0].Subject.String()
+		t.ClientIssuer = state.PeerCertificates[0].Issuer.String()
+	}
+	return t
+}
@@ -0,0 +1,122 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/internal/smtptest"
+	"github.com/emersion/go-smtp"
+)
+
+// testCertificate returns a self-signed certificate for commonName.
+func testCertificate(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// The email records the client, its HELO name, the TLS parameters and the
+// authenticated identity of the session it arrived on.
+func TestEmailConnection(t *testing.T) {
+	emails := make(chan *Email, 1)
+	bkd := &Backend{
+		Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+			emails <- e
+			return nil
+		}),
+		Credentials: credentialsFunc(func(ctx context.Context, username, password string) error { return nil }),
+	}
+	s := smtp.NewServer(bkd.WithPolicy(Policy{Listener: "submission"}))
+	s.Domain = "mx.example.com"
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "mx.example.com")},
+		ClientAuth:   tls.RequestClientCert,
+	}
+	c := smtptest.Serve(t, s, smtptest.Listen(t))
+
+	c.Cmd("EHLO client.example.org", "250")
+	started := time.Now() // STARTTLS begins a new session
+	c.Cmd("STARTTLS", "220 ")
+	c.StartTLS(&tls.Config{
+		ServerName:         "mx.example.com",
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{testCertificate(t, "client.example.org")},
+		MinVersion:         tls.VersionTLS13,
+	})
+
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("AUTH PLAIN "+plainAuth("bob", "secret"), "235 ")
+	mail := time.Now()
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	e := <-emails
+	conn := e.Connection
+	loopback := net.IPv4(127, 0, 0, 1)
+	if conn.Listener != "submission" || conn.Helo != "client.example.org" || !conn.ClientIP.Equal(loopback) || conn.RemoteAddr == "" {
+		t.Errorf("Connection = %+v", conn)
+	}
+	if conn.StartedAt.Before(started) || conn.StartedAt.After(mail) {
+		t.Errorf("StartedAt = %s, want between %s and %s", conn.StartedAt, started, mail)
+	}
+	if !e.ClientIP.Equal(loopback) || e.AuthUser != "bob" || conn.AuthUser != "bob" {
+		t.Errorf("ClientIP = %s, AuthUser = %q, Connection.AuthUser = %q", e.ClientIP, e.AuthUser, conn.AuthUser)
+	}
+	want := TLSState{
+		Version:      "TLS 1.3",
+		CipherSuite:  tls.CipherSuiteName(c.Conn.(*tls.Conn).ConnectionState().CipherSuite),
+		ServerName:   "mx.example.com",
+		ClientCert:   "CN=client.example.org",
+		ClientIssuer: "CN=client.example.org",
+	}
+	if conn.TLS == nil || *conn.TLS != want {
+		t.Errorf("TLS = %+v, want %+v", conn.TLS, want)
+	}
+}
+
+// A plaintext session without AUTH leaves the TLS state and identity empty.
+func TestEmailConnectionPlaintext(t *testing.T) {
+	emails := make(chan *Email, 1)
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		emails <- e
+		return nil
+	})}
+	c := dialBackend(t, bkd, false)
+	c.Cmd("HELO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	e := <-emails
+	if e.Connection.TLS != nil || e.AuthUser != "" || e.Connection.Helo != "client.example.org" {
+		t.Errorf("Connection = %+v, AuthUser = %q", e.Connection, e.AuthUser)
+	}
+}
@@ -0,0 +1,224 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DeadLetters keeps the emails that could not be processed: messages that
+// failed to parse, handlers that panicked and spooled emails that were given
+// up on. Each one is stored in Dir as <id>.eml, the raw message as it was
+// received below the Received and Return-Path headers getmail prepended,
+// and <id>.json, the DeadLetter record with the envelope and connection.
+// They stay there until they are re-driven or removed.
+type DeadLetters struct {
+	Dir string
+}
+
+// DeadLetter describes a stored email and why it failed.
+type DeadLetter struct {
+	ID         string       `json:"id"`
+	EmailID    string       `json:"email_id,omitempty"` // Email.ID given when it was received
+	From       EmailUser    `json:"from"`               // Envelope sender
+	RcptTo     []EmailUser  `json:"rcpt_to"`            // Envelope recipients
+	Connection Connection   `json:"connection"`
+	Envelope   Envelope     `json:"envelope"` // MAIL and RCPT parameters
+	DNSBL      *DNSBLResult `json:"dnsbl,omitempty"`
+	SPF        bool         `json:"spf"`
+	SPFResult  SPFResult    `json:"spf_result,omitempty"`
+	ReceivedAt time.Time    `json:"received_at"`
+	Error      string       `json:"error"`
+	Unparsable bool         `json:"unparsable,omitempty"` // The message failed to parse
+	FailedAt   time.Time    `json:"failed_at"`
+	Size       int          `json:"size"` // Size of the raw message in bytes
+}
+
+// NewDeadLetters returns the dead-letter store in dir, creating the
+// directory if needed.
+func NewDeadLetters(dir string) (*DeadLetters, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	return &DeadLetters{Dir: dir}, nil
+}
+
+// Add stores email, its raw message and session data, which failed with
+// cause.
+func (d *DeadLetters) Add(email *Email, cause error) (*DeadLetter, error) {
+	data, err := email.RawBytes()
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+
+	uuid, err := NewUUIDv7()
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	dl := &DeadLetter{
+		ID:         uuid.String(),
+		EmailID:    email.ID,
+		From:       EmailUser{Email: email.Envelope.From},
+		RcptTo:     email.RcptTo,
+		Connection: email.Connection,
+		Envelope:   email.Envelope,
+		DNSBL:      email.DNSBL,
+		SPF:        email.SPF,
+		SPFResult:  email.SPFResult,
+		ReceivedAt: email.ReceivedAt,
+		Unparsable: errors.Is(cause, ErrUnparsable),
+		FailedAt:   time.Now(),
+		Size:       len(data),
+	}
+	if cause != nil {
+		dl.Error = cause.Error()
+	}
+
+	meta, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	if err := writeFileSync(d.path(dl.ID, ".eml"), data); err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	if err := writeFileSync(d.path(dl.ID, ".json"), meta); err != nil {
+		os.Remove(d.path(dl.ID, ".eml"))
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	return dl, nil
+}
+
+// OnFailed stores the email and logs the outcome. It can be used as
+// Backend.OnFailed and Spool.OnFailed.
+func (d *DeadLetters) OnFailed(email *Email, err error) {
+	dl, addErr := d.Add(email, err)
+	if addErr != nil {
+		LogError("DeadLetters", fmt.Errorf("failed email from %s lost: %w", email.Envelope.From, addErr))
+		return
+	}
+	LogWarning("DeadLetters", fmt.Sprintf("stored failed email from %s as %s: %v", email.Envelope.From, dl.ID, err))
+}
+
+// List returns the stored emails, oldest first. Records that cannot be read
+// are logged and left out.
+func (d *DeadLetters) List() ([]*DeadLetter, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+
+	var list []*DeadLetter
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || strings.HasPrefix(id, ".") {
+			continue
+		}
+		dl, err := d.Get(id)
+		if err != nil {
+			// One bad record must not hide the others.
+			LogError("DeadLetters", err)
+			continue
+		}
+		list = append(list, dl)
+	}
+	slices.SortFunc(list, func(a, b *DeadLetter) int { return a.FailedAt.Compare(b.FailedAt) })
+	return list, nil
+}
+
+// Get returns the record of the email stored as id.
+func (d *DeadLetters) Get(id string) (*DeadLetter, error) {
+	if err := checkDeadLetterID(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(d.path(id, ".json"))
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	dl := &DeadLetter{}
+	if err := json.Unmarshal(data, dl); err != nil {
+		return nil, fmt.Errorf("dead letters: %s: %w", id, err)
+	}
+	return dl, nil
+}
+
+// Raw returns the raw message stored as id.
+func (d *DeadLetters) Raw(id string) ([]byte, error) {
+	if err := checkDeadLetterID(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(d.path(id, ".eml"))
+	if err != nil {
+		return nil, fmt.Errorf("dead letters: %w", err)
+	}
+	return data, nil
+}
+
+// Remove deletes the email stored as id.
+func (d *DeadLetters) Remove(id string) error {
+	if err := checkDeadLetterID(id); err != nil {
+		return err
+	}
+	if err := os.Remove(d.path(id, ".json")); err != nil {
+		return fmt.Errorf("dead letters: %w", err)
+	}
+	if err := os.Remove(d.path(id, ".eml")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("dead letters: %w", err)
+	}
+	return nil
+}
+
+// Redrive parses the email stored as id again and hands it to h with its
+// original ID, envelope and connection. The email is removed once h accepts
+// it; otherwise it stays in the store and the error is returned, wrapping
+// ErrUnparsable when the message still does not parse.
+func (d *DeadLetters) Redrive(ctx context.Context, id string, h Handler) error {
+	dl, err := d.Get(id)
+	if err != nil {
+		return err
+	}
+	raw, err := d.Raw(id)
+	if err != nil {
+		return err
+	}
+
+	email, err := parseEmail(bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("dead letters: %s: %w: %w", id, ErrUnparsable, err)
+	}
+	if dl.EmailID != "" {
+		email.ID = dl.EmailID
+	}
+	email.ReceivedAt = dl.ReceivedAt
+	email.Connection = dl.Connection
+	email.ClientIP = dl.Connection.ClientIP
+	email.AuthUser = dl.Connection.AuthUser
+	email.RcptTo = dl.RcptTo
+	email.Envelope = dl.Envelope
+	email.DNSBL = dl.DNSBL
+	email.SPF = dl.SPF
+	email.SPFResult = dl.SPFResult
+
+	if err := Recover(nil)(h).HandleEmail(ctx, email); err != nil {
+		return fmt.Errorf("dead letters: %s: %w", id, err)
+	}
+	return d.Remove(id)
+}
+
+func (d *DeadLetters) path(id, ext string) string {
+	return filepath.Join(d.Dir, id+ext)
+}
+
+// checkDeadLetterID rejects IDs that would point outside the store.
+func checkDeadLetterID(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return fmt.Errorf("dead letters: invalid id %q", id)
+	}
+	return nil
+}
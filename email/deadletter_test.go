@@ -0,0 +1,189 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestDeadLetters(t *testing.T) {
+	d, err := NewDeadLetters(filepath.Join(t.TempDir(), "dead"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := d.Add(testEmail(t, spoolMessage), errors.New("handler panicked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	second, err := d.Add(&Email{Raw: strings.NewReader("not a message")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+		t.Fatalf("List = %v, want %s then %s", list, first.ID, second.ID)
+	}
+	if dl := list[0]; dl.From.Email != "bounces@example.org" || len(dl.RcptTo) != 1 || dl.Envelope.From != "bounces@example.org" ||
+		dl.Connection.Helo != "client.example.org" || dl.Error != "handler panicked" || dl.Size != len(spoolMessage) {
+		t.Errorf("record = %+v", dl)
+	}
+
+	raw, err := d.Raw(first.ID)
+	if err != nil || string(raw) != spoolMessage {
+		t.Errorf("Raw = %q, %v", raw, err)
+	}
+
+	if err := d.Remove(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(second.ID); err == nil {
+		t.Error("Get found a removed email")
+	}
+	if err := d.Remove(second.ID); err == nil {
+		t.Error("Remove of a removed email succeeded")
+	}
+}
+
+func TestDeadLettersListSkipsCorrupt(t *testing.T) {
+	d, err := NewDeadLetters(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := d.Add(testEmail(t, spoolMessage), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"corrupt.json":    `{"id":`,
+		".tmp.json.1":     `{}`,
+		"notes.txt":       "ignored",
+		"orphan.eml":      spoolMessage,
+		"wrong-type.json": `{"rcpt_to":"alice"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(d.Dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(d.Dir, "dir.json"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != good.ID {
+		t.Errorf("List = %v, want only %s", list, good.ID)
+	}
+}
+
+func TestDeadLettersInvalidID(t *testing.T) {
+	d := &DeadLetters{Dir: t.TempDir()}
+	for _, id := range []string{"", ".", "..", ".hidden", "../dead", "a/b", `a\b`} {
+		if _, err := d.Get(id); err == nil || !strings.Contains(err.Error(), "invalid id") {
+			t.Errorf("Get(%q) = %v", id, err)
+		}
+		if _, err := d.Raw(id); err == nil {
+			t.Errorf("Raw(%q) succeeded", id)
+		}
+		if err := d.Remove(id); err == nil {
+			t.Errorf("Remove(%q) succeeded", id)
+		}
+	}
+}
+
+func TestDeadLettersRedrive(t *testing.T) {
+	d, err := NewDeadLetters(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := testEmail(t, spoolMessage)
+	failed.ReceivedAt = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	failed.Connection.ClientIP = net.ParseIP("192.0.2.25")
+	failed.Connection.AuthUser = "bob"
+	failed.Envelope.Params = MailParams{Size: 120, Ret: "HDRS", EnvID: "abc"}
+	failed.Envelope.Recipients[0].Notify = []string{"FAILURE"}
+	failed.DNSBL = &DNSBLResult{Matches: []DNSBLMatch{{Zone: "bl.example", Weight: 1, Answers: []string{"127.0.0.2"}}}, Score: 1}
+	failed.SPFResult = SPFSoftFail
+	dl, err := d.Add(failed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refusal or a panic keeps the email.
+	refuse := HandlerFunc(func(context.Context, *Email) error {
+		return &smtp.SMTPError{Code: 451, Message: "later"}
+	})
+	panics := HandlerFunc(func(context.Context, *Email) error { panic("boom") })
+	for _, h := range []Handler{refuse, panics} {
+		if err := d.Redrive(context.Background(), dl.ID, h); err == nil {
+			t.Error("Redrive succeeded")
+		}
+		if _, err := d.Get(dl.ID); err != nil {
+			t.Errorf("email gone after a failed redrive: %v", err)
+		}
+	}
+
+	var got *Email
+	accept := HandlerFunc(func(_ context.Context, e *Email) error { got = e; return nil })
+	if err := d.Redrive(context.Background(), dl.ID, accept); err != nil {
+		t.Fatal(err)
+	}
+	// The ID, envelope and connection are passed on as they were received.
+	for _, field := range []string{"ID", "ReceivedAt", "Connection", "Envelope", "RcptTo", "DNSBL", "SPF", "SPFResult"} {
+		want := reflect.ValueOf(*failed).FieldByName(field).Interface()
+		have := reflect.ValueOf(*got).FieldByName(field).Interface()
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("redriven %s = %+v, want %+v", field, have, want)
+		}
+	}
+	if !got.ClientIP.Equal(failed.Connection.ClientIP) || got.AuthUser != "bob" || got.Subject != "Hello" {
+		t.Errorf("redriven email = %+v", got)
+	}
+	if _, err := d.Get(dl.ID); err == nil {
+		t.Error("email kept after a successful redrive")
+	}
+}
+
+// A message that failed to parse is marked as such, and a redrive that
+// still can't parse it keeps it and says why.
+func TestDeadLettersRedriveUnparsable(t *testing.T) {
+	d, err := NewDeadLetters(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl, err := d.Add(&Email{Raw: strings.NewReader("not a message")}, fmt.Errorf("%w: no header", ErrUnparsable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dl.Unparsable {
+		t.Error("record not marked unparsable")
+	}
+
+	called := false
+	accept := HandlerFunc(func(context.Context, *Email) error { called = true; return nil })
+	if err := d.Redrive(context.Background(), dl.ID, accept); !errors.Is(err, ErrUnparsable) {
+		t.Errorf("Redrive = %v, want ErrUnparsable", err)
+	}
+	if called {
+		t.Error("handler called for an unparsable message")
+	}
+	if _, err := d.Get(dl.ID); err != nil {
+		t.Errorf("email gone after a failed redrive: %v", err)
+	}
+}
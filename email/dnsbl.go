@@ -0,0 +1,200 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Actions taken by a DNSBL once a client's score reaches the threshold.
+const (
+	DNSBLReject = "reject" // refuse MAIL with 550
+	DNSBLTag    = "tag"    // accept and mark the email as listed
+	DNSBLLog    = "log"    // accept and only log the listing
+)
+
+// Resolver resolves the DNSBL query names. *net.Resolver implements it.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNSBLZone is a blocklist queried for each client and the weight a listing
+// adds to the client's score.
+type DNSBLZone struct {
+	Zone   string
+	Weight int
+}
+
+// DNSBLMatch is a blocklist that lists the client.
+type DNSBLMatch struct {
+	Zone    string
+	Weight  int
+	Answers []string // 127.0.0.x return codes, their meaning depends on the list
+}
+
+// DNSBLResult holds the outcome of the blocklist lookups for a client.
+type DNSBLResult struct {
+	Matches []DNSBLMatch // In the order of DNSBL.Zones
+	Score   int          // Sum of the weights of the matching lists
+	Listed  bool         // The score reached the threshold and the action is "tag"
+}
+
+// DNSBL checks client addresses against DNS blocklists.
+type DNSBL struct {
+	Zones     []DNSBLZone
+	Threshold int           // Score at which Action applies
+	Action    string        // DNSBLReject, DNSBLTag or DNSBLLog
+	Resolver  Resolver      // net.DefaultResolver when nil
+	Timeout   time.Duration // Per lookup, no limit when zero
+	Exempt    []*net.IPNet  // Clients that are never looked up
+}
+
+// Lookup queries every zone for ip in parallel. Lookup errors are logged and
+// count as not listed, so a broken list never blocks mail.
+func (d *DNSBL) Lookup(ctx context.Context, ip net.IP) *DNSBLResult {
+	result := &DNSBLResult{}
+	name := dnsblName(ip)
+	if name == "" || d.exempt(ip) {
+		return result
+	}
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	// Each lookup fills its zone's slot so the matches keep the configured
+	// order, whichever list answers first.
+	var wg sync.WaitGroup
+	matches := make([]*DNSBLMatch, len(d.Zones))
+	for i, zone := range d.Zones {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lookupCtx := ctx
+			if d.Timeout > 0 {
+				var cancel context.CancelFunc
+				lookupCtx, cancel = context.WithTimeout(ctx, d.Timeout)
+				defer cancel()
+			}
+
+			answers, err := lookupDNSBL(lookupCtx, resolver, name+"."+zone.Zone)
+			if err != nil {
+				LogWarning("DNSBL", fmt.Sprintf("%s lookup for %s failed: %v", zone.Zone, ip, err))
+				return
+			}
+			if len(answers) == 0 {
+				return
+			}
+
+			matches[i] = &DNSBLMatch{Zone: zone.Zone, Weight: zone.Weight, Answers: answers}
+		}()
+	}
+	wg.Wait()
+
+	for _, m := range matches {
+		if m != nil {
+			result.Matches = append(result.Matches, *m)
+			result.Score += m.Weight
+		}
+	}
+	return result
+}
+
+// Check looks up ip and applies the configured action. It returns an
+// SMTPError when the client must be rejected.
+func (d *DNSBL) Check(ctx context.Context, ip net.IP) (*DNSBLResult, error) {
+	result := d.Lookup(ctx, ip)
+	if len(result.Matches) == 0 {
+		return result, nil
+	}
+
+	zones := make([]string, len(result.Matches))
+	for i, m := range result.Matches {
+		zones[i] = m.Zone
+	}
+	LogInfo("DNSBL", fmt.Sprintf("%s listed on %s (score %d/%d)", ip, strings.Join(zones, ", "), result.Score, d.Threshold))
+
+	if result.Score < d.Threshold {
+		return result, nil
+	}
+	switch d.Action {
+	case DNSBLTag:
+		result.Listed = true
+	case DNSBLLog:
+	default:
+		return result, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Client host %s blocked using %s", ip, zones[0]),
+		}
+	}
+	return result, nil
+}
+
+func (d *DNSBL) exempt(ip net.IP) bool {
+	for _, n := range d.Exempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupDNSBL resolves name and returns the listing codes; NXDOMAIN means
+// not listed.
+func lookupDNSBL(ctx context.Context, resolver Resolver, name string) ([]string, error) {
+	addrs, err := resolver.LookupHost(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var answers []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a).To4()
+		if ip == nil || ip[0] != 127 {
+			continue
+		}
+		// 127.255.255.x answers are errors, e.g. queries through an open
+		// resolver that the list refuses to serve.
+		if ip[1] == 255 && ip[2] == 255 {
+			return nil, fmt.Errorf("list returned error code %s", a)
+		}
+		answers = append(answers, a)
+	}
+	return answers, nil
+}
+
+// dnsblName returns the reversed address used as the query prefix:
+// 192.0.2.1 becomes 1.2.0.192, IPv6 addresses are reversed nibble by nibble.
+func dnsblName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip16[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip16[i]>>4])
+		if i > 0 {
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,299 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// resolverFunc adapts a function to the Resolver interface.
+type resolverFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f resolverFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+var (
+	errNXDOMAIN = &net.DNSError{Err: "no such host", IsNotFound: true}
+	errSERVFAIL = &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+)
+
+// stubResolver answers from a table of query names; unknown names are
+// NXDOMAIN. Blocked names hang until the lookup is canceled.
+type stubResolver struct {
+	answers map[string][]string
+	errs    map[string]error
+	blocked map[string]bool
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	r.queries = append(r.queries, host)
+	r.mu.Unlock()
+
+	if r.blocked[host] {
+		<-ctx.Done()
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+	}
+	if err, ok := r.errs[host]; ok {
+		return nil, err
+	}
+	if answers, ok := r.answers[host]; ok {
+		return answers, nil
+	}
+	return nil, errNXDOMAIN
+}
+
+func TestDNSBLName(t *testing.T) {
+	for ip, want := range map[string]string{
+		"192.0.2.1":                         "1.2.0.192",
+		"::ffff:192.0.2.1":                  "1.2.0.192",
+		"2001:db8::1":                       "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+		"2001:db8:1234:5678:9abc:def0:1:ff": "f.f.0.0.1.0.0.0.0.f.e.d.c.b.a.9.8.7.6.5.4.3.2.1.8.b.d.0.1.0.0.2",
+	} {
+		if got := dnsblName(net.ParseIP(ip)); got != want {
+			t.Errorf("dnsblName(%s) = %s, want %s", ip, got, want)
+		}
+	}
+	if got := dnsblName(nil); got != "" {
+		t.Errorf("dnsblName(nil) = %q", got)
+	}
+}
+
+func TestLookupDNSBL(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers []string
+		err     error
+		want    []string
+		wantErr bool
+	}{
+		{name: "listed", answers: []string{"127.0.0.2", "127.0.0.4"}, want: []string{"127.0.0.2", "127.0.0.4"}},
+		{name: "NXDOMAIN", err: errNXDOMAIN},
+		{name: "SERVFAIL", err: errSERVFAIL, wantErr: true},
+		{name: "other error", err: errors.New("boom"), wantErr: true},
+		{name: "non-loopback answers", answers: []string{"192.0.2.1", "::1"}},
+		{name: "error code", answers: []string{"127.255.255.254"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := resolverFunc(func(context.Context, string) ([]string, error) { return tt.answers, tt.err })
+			got, err := lookupDNSBL(context.Background(), resolver, "1.2.0.192.bl.example")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("answers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSBLLookup(t *testing.T) {
+	resolver := &stubResolver{
+		answers: map[string][]string{
+			"1.2.0.192.a.example": {"127.0.0.2"},
+			"1.2.0.192.b.example": {"127.0.0.3"},
+		},
+		errs: map[string]error{
+			"1.2.0.192.servfail.example": errSERVFAIL,
+		},
+		blocked: map[string]bool{
+			"1.2.0.192.slow.example": true,
+		},
+	}
+	d := &DNSBL{
+		Zones: []DNSBLZone{
+			{Zone: "a.example", Weight: 1},
+			{Zone: "b.example", Weight: 2},
+			{Zone: "clean.example", Weight: 4},
+			{Zone: "servfail.example", Weight: 8},
+			{Zone: "slow.example", Weight: 16},
+		},
+		Resolver: resolver,
+		Timeout:  50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	result := d.Lookup(context.Background(), net.ParseIP("192.0.2.1"))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Lookup took %s despite the timeout", elapsed)
+	}
+
+	// Failed and timed out zones count as not listed.
+	if result.Score != 3 {
+		t.Errorf("Score = %d, want 3", result.Score)
+	}
+	var zones []string
+	for _, m := range result.Matches {
+		zones = append(zones, m.Zone)
+	}
+	if !slices.Equal(zones, []string{"a.example", "b.example"}) {
+		t.Errorf("matched zones = %v", zones)
+	}
+	if len(resolver.queries) != len(d.Zones) {
+		t.Errorf("queries = %v", resolver.queries)
+	}
+}
+
+func TestDNSBLLookupIPv6(t *testing.T) {
+	resolver := &stubResolver{}
+	d := &DNSBL{Zones: []DNSBLZone{{Zone: "v6.example", Weight: 1}}, Resolver: resolver}
+	d.Lookup(context.Background(), net.ParseIP("2001:db8::1"))
+
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.v6.example"
+	if len(resolver.queries) != 1 || resolver.queries[0] != want {
+		t.Errorf("queries = %v, want [%s]", resolver.queries, want)
+	}
+}
+
+func TestDNSBLLookupExempt(t *testing.T) {
+	_, exempt, _ := net.ParseCIDR("192.0.2.0/24")
+	resolver := &stubResolver{}
+	d := &DNSBL{Zones: []DNSBLZone{{Zone: "a.example", Weight: 1}}, Resolver: resolver, Exempt: []*net.IPNet{exempt}}
+	d.Lookup(context.Background(), net.ParseIP("192.0.2.1"))
+	if len(resolver.queries) != 0 {
+		t.Errorf("exempt client was looked up: %v", resolver.queries)
+	}
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]string{
+		"1.2.0.192.a.example": {"127.0.0.2"},
+		"1.2.0.192.b.example": {"127.0.0.2"},
+	}}
+	zones := []DNSBLZone{{Zone: "a.example", Weight: 1}, {Zone: "b.example", Weight: 1}}
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		action    string
+		threshold int
+		reject    bool
+		listed    bool
+	}{
+		{action: DNSBLReject, threshold: 2, reject: true},
+		{action: DNSBLReject, threshold: 3},
+		{action: DNSBLTag, threshold: 2, listed: true},
+		{action: DNSBLTag, threshold: 3},
+		{action: DNSBLLog, threshold: 1},
+	}
+	for _, tt := range tests {
+		d := &DNSBL{Zones: zones, Threshold: tt.threshold, Action: tt.action, Resolver: resolver}
+		result, err := d.Check(context.Background(), ip)
+
+		var smtpErr *smtp.SMTPError
+		if tt.reject {
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || !strings.Contains(smtpErr.Message, "192.0.2.1") {
+				t.Errorf("%s at %d: error = %v, want a 550 rejection", tt.action, tt.threshold, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s at %d: unexpected error %v", tt.action, tt.threshold, err)
+		}
+		if result.Score != 2 || result.Listed != tt.listed {
+			t.Errorf("%s at %d: Score = %d, Listed = %v", tt.action, tt.threshold, result.Score, result.Listed)
+		}
+	}
+}
+
+// The rejection names the first listing zone in configured order, not the
+// one that answered first.
+func TestDNSBLCheckZoneOrder(t *testing.T) {
+	resolver := resolverFunc(func(_ context.Context, host string) ([]string, error) {
+		if strings.HasSuffix(host, ".a.example") {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return []string{"127.0.0.2"}, nil
+	})
+	d := &DNSBL{
+		Zones:     []DNSBLZone{{Zone: "a.example", Weight: 1}, {Zone: "b.example", Weight: 1}},
+		Threshold: 1,
+		Action:    DNSBLReject,
+		Resolver:  resolver,
+	}
+	result, err := d.Check(context.Background(), net.ParseIP("192.0.2.1"))
+	if err == nil || err.Error() != "SMTP error 550: Client host 192.0.2.1 blocked using a.example" {
+		t.Errorf("error = %v, want a rejection naming a.example", err)
+	}
+	if len(result.Matches) != 2 || result.Matches[0].Zone != "a.example" {
+		t.Errorf("Matches = %+v, want a.example first", result.Matches)
+	}
+}
+
+// A session looks up its client once, however many transactions it opens,
+// and records the result on every email.
+func TestSessionDNSBLCache(t *testing.T) {
+	var lookups atomic.Int32
+	resolver := resolverFunc(func(_ context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		if host == "1.0.0.127.bl.example" {
+			return []string{"127.0.0.2"}, nil
+		}
+		return nil, errNXDOMAIN
+	})
+	emails := make(chan *Email, 2)
+	bkd := &Backend{
+		OnEmailReceived: func(e *Email) { emails <- e },
+		DNSBL: &DNSBL{
+			Zones:     []DNSBLZone{{Zone: "bl.example", Weight: 1}},
+			Threshold: 1,
+			Action:    DNSBLTag,
+			Resolver:  resolver,
+		},
+	}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	for range 2 {
+		c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+		c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+		c.Cmd("DATA", "354 ")
+		c.Write(testMessage)
+		c.Expect("250 ")
+
+		e := <-emails
+		if e.DNSBL == nil || !e.DNSBL.Listed || e.DNSBL.Score != 1 {
+			t.Errorf("Email.DNSBL = %+v", e.DNSBL)
+		}
+	}
+	c.Cmd("RSET", "250 ")
+	c.Cmd("MAIL FROM:<carol@example.org>", "250 ")
+
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
+
+// A rejected client stays rejected for the rest of the session without new
+// lookups.
+func TestSessionDNSBLReject(t *testing.T) {
+	var lookups atomic.Int32
+	resolver := resolverFunc(func(context.Context, string) ([]string, error) {
+		lookups.Add(1)
+		return []string{"127.0.0.2"}, nil
+	})
+	bkd := &Backend{DNSBL: &DNSBL{
+		Zones:     []DNSBLZone{{Zone: "bl.example", Weight: 1}},
+		Threshold: 1,
+		Action:    DNSBLReject,
+		Resolver:  resolver,
+	}}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "550 5.7.1 ")
+	c.Cmd("MAIL FROM:<bob@example.org>", "550 5.7.1 ")
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
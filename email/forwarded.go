@@ -0,0 +1,37 @@
+package email
+
+import "net"
+
+// ClientAttributes describes the original SMTP client as announced by a
+// trusted upstream MTA with the XCLIENT or XFORWARD extension. Empty fields
+// were not provided.
+type ClientAttributes struct {
+	Addr  net.IP // Client IP address
+	Port  int    // Client TCP port
+	Name  string // Verified reverse DNS name of the client
+	Helo  string // HELO/EHLO name the client sent
+	Proto string // SMTP or ESMTP
+	Login string // SASL login name; counts as SMTP AUTH for RequireAuth, greylisting and DNSBL
+}
+
+// ForwardedConn is implemented by connections from trusted relays that may
+// override the client attributes of the session.
+type ForwardedConn interface {
+	ClientAttributes() ClientAttributes
+}
+
+// forwardedAttributes returns the attributes announced over conn, looking
+// through TLS wrappers.
+func forwardedAttributes(conn net.Conn) (ClientAttributes, bool) {
+	for conn != nil {
+		if fc, ok := conn.(ForwardedConn); ok {
+			return fc.ClientAttributes(), true
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = inner.NetConn()
+	}
+	return ClientAttributes{}, false
+}
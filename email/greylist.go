@@ -0,0 +1,240 @@
+package email
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ErrGreylisted is returned by RCPT for triplets that have not been seen
+// long enough ago.
+var ErrGreylisted = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Greylisted, please try again later",
+}
+
+// Greylist defers mail from unknown (client network, sender, recipient)
+// triplets. A triplet is accepted once it is retried after Delay and within
+// RetryWindow; the client network is then whitelisted for Whitelist, renewed
+// by every accepted recipient.
+type Greylist struct {
+	Path        string        // JSON state file, kept in memory only when empty
+	Delay       time.Duration // Minimum time before a retry is accepted
+	RetryWindow time.Duration // How long an unconfirmed triplet is remembered
+	Whitelist   time.Duration // How long a confirmed client stays whitelisted
+	Exempt      []*net.IPNet  // Clients that are never greylisted
+
+	// Clients are grouped by network since large senders retry from other
+	// hosts of a pool; zero means 24 for IPv4 and 64 for IPv6.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	mu    sync.Mutex
+	state greylistState
+	dirty bool // state changed since the last Save
+}
+
+// greylistState is the persisted form of a Greylist.
+type greylistState struct {
+	Triplets map[string]*greyTriplet `json:"triplets"`
+	Clients  map[string]time.Time    `json:"clients"` // network -> whitelisted until
+}
+
+type greyTriplet struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Passed    bool      `json:"passed"`
+}
+
+// NewGreylist returns a Greylist persisted at path, loading the triplets
+// saved by a previous run. A missing file starts an empty list.
+func NewGreylist(path string, delay, retryWindow, whitelist time.Duration) (*Greylist, error) {
+	g := &Greylist{
+		Path:        path,
+		Delay:       delay,
+		RetryWindow: retryWindow,
+		Whitelist:   whitelist,
+		state: greylistState{
+			Triplets: make(map[string]*greyTriplet),
+			Clients:  make(map[string]time.Time),
+		},
+	}
+	if path == "" {
+		return g, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("greylist: %w", err)
+	}
+	if err := json.Unmarshal(data, &g.state); err != nil {
+		return nil, fmt.Errorf("greylist: %s: %w", path, err)
+	}
+	if g.state.Triplets == nil {
+		g.state.Triplets = make(map[string]*greyTriplet)
+	}
+	if g.state.Clients == nil {
+		g.state.Clients = make(map[string]time.Time)
+	}
+	return g, nil
+}
+
+// Check records the triplet and returns ErrGreylisted unless it may pass.
+// Clients without an IP address (unix sockets) are never greylisted.
+func (g *Greylist) Check(ip net.IP, from, to string) error {
+	return g.check(ip, from, to, time.Now())
+}
+
+func (g *Greylist) check(ip net.IP, from, to string, now time.Time) error {
+	network, ok := g.network(ip)
+	if !ok {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if until, ok := g.state.Clients[network]; ok && now.Before(until) {
+		g.state.Clients[network] = now.Add(g.Whitelist)
+		g.dirty = true
+		return nil
+	}
+
+	key := strings.ToLower(network + "/" + from + "/" + to)
+	t, ok := g.state.Triplets[key]
+	if !ok || g.expired(t, now) {
+		g.state.Triplets[key] = &greyTriplet{FirstSeen: now, LastSeen: now}
+		g.dirty = true
+		return ErrGreylisted
+	}
+
+	// A retry within Delay changes nothing: the triplet still dates from
+	// its first attempt.
+	if !t.Passed && now.Sub(t.FirstSeen) < g.Delay {
+		return ErrGreylisted
+	}
+
+	t.LastSeen = now
+	t.Passed = true
+	g.state.Clients[network] = now.Add(g.Whitelist)
+	g.dirty = true
+	return nil
+}
+
+// Save drops expired entries and writes the list to Path if it changed.
+func (g *Greylist) Save() error {
+	return g.save(time.Now())
+}
+
+func (g *Greylist) save(now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.prune(now)
+	if g.Path == "" || !g.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(&g.state)
+	if err != nil {
+		return fmt.Errorf("greylist: %w", err)
+	}
+
+	// Write a temporary file first so a crash cannot leave a truncated list.
+	tmp, err := os.CreateTemp(filepath.Dir(g.Path), filepath.Base(g.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("greylist: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("greylist: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("greylist: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), g.Path); err != nil {
+		return fmt.Errorf("greylist: %w", err)
+	}
+
+	g.dirty = false
+	return nil
+}
+
+// Run saves the list every interval until ctx is done. Without a Path it
+// only drops expired entries. Run does not save when ctx ends: sessions may
+// still record triplets while the server drains, so the caller saves the
+// list once the server has stopped.
+func (g *Greylist) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := g.Save(); err != nil {
+				LogError("Greylist", err)
+			}
+		}
+	}
+}
+
+// prune drops expired triplets and whitelist entries; callers must hold g.mu.
+func (g *Greylist) prune(now time.Time) {
+	for key, t := range g.state.Triplets {
+		if g.expired(t, now) {
+			delete(g.state.Triplets, key)
+			g.dirty = true
+		}
+	}
+	for network, until := range g.state.Clients {
+		if !now.Before(until) {
+			delete(g.state.Clients, network)
+			g.dirty = true
+		}
+	}
+}
+
+// expired reports whether t should be forgotten: unconfirmed triplets after
+// RetryWindow, confirmed ones once unused for Whitelist.
+func (g *Greylist) expired(t *greyTriplet, now time.Time) bool {
+	if t.Passed {
+		return now.Sub(t.LastSeen) >= g.Whitelist
+	}
+	return now.Sub(t.FirstSeen) >= g.Delay+g.RetryWindow
+}
+
+// network returns the network ip is greylisted under, and false when ip is
+// unknown or exempt.
+func (g *Greylist) network(ip net.IP) (string, bool) {
+	if ip == nil {
+		return "", false
+	}
+	for _, n := range g.Exempt {
+		if n.Contains(ip) {
+			return "", false
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(cmp.Or(g.IPv4Prefix, 24), 32)).String(), true
+	}
+	return ip.Mask(net.CIDRMask(cmp.Or(g.IPv6Prefix, 64), 128)).String(), true
+}
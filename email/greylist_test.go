@@ -0,0 +1,154 @@
+package email
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestGreylist(t *testing.T, path string) *Greylist {
+	t.Helper()
+	g, err := NewGreylist(path, 5*time.Minute, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestGreylistCheck(t *testing.T) {
+	g := newTestGreylist(t, "")
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		after time.Duration // since the first attempt
+		ip    string
+		from  string
+		ok    bool
+	}{
+		{0, "192.0.2.10", "bob@example.org", false},                             // unknown triplet
+		{time.Minute, "192.0.2.10", "bob@example.org", false},                   // retried too early
+		{5 * time.Minute, "192.0.2.77", "bob@example.org", true},                // retried after Delay from the same /24
+		{6 * time.Minute, "192.0.2.10", "carol@example.org", true},              // the network is whitelisted
+		{6 * time.Minute, "198.51.100.1", "bob@example.org", false},             // another network is not
+		{6*time.Minute + 25*time.Hour, "192.0.2.10", "dave@example.org", false}, // whitelist expired
+	}
+	for i, st := range steps {
+		err := g.check(net.ParseIP(st.ip), st.from, "alice@example.com", now.Add(st.after))
+		if st.ok && err != nil || !st.ok && !errors.Is(err, ErrGreylisted) {
+			t.Errorf("step %d (%s from %s): %v", i, st.from, st.ip, err)
+		}
+	}
+
+	// Clients without an address and exempt ones pass at once.
+	if err := g.check(nil, "bob@example.org", "alice@example.com", now); err != nil {
+		t.Errorf("unix socket client: %v", err)
+	}
+	_, exempt, _ := net.ParseCIDR("203.0.113.0/24")
+	g.Exempt = []*net.IPNet{exempt}
+	if err := g.check(net.ParseIP("203.0.113.5"), "bob@example.org", "alice@example.com", now); err != nil {
+		t.Errorf("exempt client: %v", err)
+	}
+}
+
+// A triplet retried after RetryWindow has passed starts over.
+func TestGreylistRetryWindow(t *testing.T) {
+	g := newTestGreylist(t, "")
+	ip := net.ParseIP("2001:db8::1")
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, after := range []time.Duration{0, 5*time.Minute + time.Hour, 5*time.Minute + time.Hour + time.Minute} {
+		if err := g.check(ip, "bob@example.org", "alice@example.com", now.Add(after)); !errors.Is(err, ErrGreylisted) {
+			t.Errorf("after %s: %v", after, err)
+		}
+	}
+	if err := g.check(net.ParseIP("2001:db8::2:1"), "bob@example.org", "alice@example.com", now.Add(2*time.Hour+6*time.Minute)); err != nil {
+		t.Errorf("retry from the same /64 after Delay: %v", err)
+	}
+}
+
+func TestGreylistPrefixes(t *testing.T) {
+	g := newTestGreylist(t, "")
+	g.IPv4Prefix, g.IPv6Prefix = 32, 128
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	g.check(net.ParseIP("192.0.2.10"), "bob@example.org", "alice@example.com", now)
+	if err := g.check(net.ParseIP("192.0.2.11"), "bob@example.org", "alice@example.com", now.Add(time.Hour)); !errors.Is(err, ErrGreylisted) {
+		t.Errorf("another host with /32 grouping: %v", err)
+	}
+	g.check(net.ParseIP("2001:db8::1"), "bob@example.org", "alice@example.com", now)
+	if err := g.check(net.ParseIP("2001:db8::2"), "bob@example.org", "alice@example.com", now.Add(time.Hour)); !errors.Is(err, ErrGreylisted) {
+		t.Errorf("another host with /128 grouping: %v", err)
+	}
+}
+
+// The list survives a restart, and is only written when it changed.
+func TestGreylistPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	g := newTestGreylist(t, path)
+	ip := net.ParseIP("192.0.2.10")
+	now := time.Now()
+
+	g.check(ip, "bob@example.org", "alice@example.com", now)
+	if err := g.save(now); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An early retry changes nothing, so nothing is written.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	g.check(ip, "bob@example.org", "alice@example.com", now.Add(time.Minute))
+	if err := g.save(now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("saved without changes: %v", err)
+	}
+
+	// A new list picks up the triplet and accepts the retry.
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	g2 := newTestGreylist(t, path)
+	if err := g2.check(ip, "bob@example.org", "alice@example.com", now.Add(5*time.Minute)); err != nil {
+		t.Errorf("retry after a restart: %v", err)
+	}
+}
+
+// Expired entries are dropped from the saved list.
+func TestGreylistSavePrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	g := newTestGreylist(t, path)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	g.check(net.ParseIP("192.0.2.10"), "bob@example.org", "alice@example.com", now)
+	g.check(net.ParseIP("192.0.2.10"), "bob@example.org", "alice@example.com", now.Add(5*time.Minute))
+	if err := g.save(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.save(now.Add(48 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	g2 := newTestGreylist(t, path)
+	if len(g2.state.Triplets) != 0 || len(g2.state.Clients) != 0 {
+		t.Errorf("expired entries saved: %+v", g2.state)
+	}
+}
+
+func TestNewGreylistBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewGreylist(path, time.Minute, time.Hour, time.Hour); err == nil {
+		t.Error("NewGreylist accepted a corrupt file")
+	}
+}
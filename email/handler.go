@@ -0,0 +1,46 @@
+package email
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Handler processes a received email while the client waits for the reply
+// to DATA. Returning nil accepts the message. An *smtp.SMTPError is sent to
+// the client as is, so a handler can reject a message with a 5xx code or
+// defer it with a 4xx code; any other error is reported as a temporary
+// failure.
+type Handler interface {
+	HandleEmail(ctx context.Context, email *Email) error
+}
+
+// HandlerFunc adapts an ordinary function to a Handler.
+type HandlerFunc func(ctx context.Context, email *Email) error
+
+func (f HandlerFunc) HandleEmail(ctx context.Context, email *Email) error {
+	return f(ctx, email)
+}
+
+// CallbackHandler adapts an OnEmailReceived callback to a Handler that
+// accepts every message.
+func CallbackHandler(onReceived func(email *Email)) Handler {
+	return HandlerFunc(func(_ context.Context, email *Email) error {
+		onReceived(email)
+		return nil
+	})
+}
+
+// replyError turns a handler or hook error into the reply sent to the
+// client: SMTP errors are kept, anything else becomes fallback.
+func replyError(err error, fallback *smtp.SMTPError) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return fallback
+}
@@ -0,0 +1,148 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/internal/smtptest"
+	"github.com/emersion/go-smtp"
+)
+
+// sendMessage runs one transaction and returns the reply to the message.
+func sendMessage(c *smtptest.Client) string {
+	c.T.Helper()
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	return c.Reply()
+}
+
+func TestHandlerReply(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"accepted", nil, "250 2.0.0 "},
+		{"rejected", &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Message refused by policy"}, "550 5.7.1 Message refused by policy\r\n"},
+		{"deferred", &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}, "452 4.2.2 Mailbox full\r\n"},
+		{"wrapped", fmt.Errorf("store: %w", &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "Bad content"}), "554 5.6.0 Bad content\r\n"},
+		{"plain error", errors.New("database unavailable"), "451 4.3.0 Delivery failed, try again later\r\n"},
+	}
+	for _, tt := range tests {
+		bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+			return tt.err
+		})}
+		c := dialBackend(t, bkd, false)
+		c.Cmd("EHLO client.example.org", "250")
+		if got := sendMessage(c); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: reply %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A handler that outlives HandlerTimeout has its ctx canceled and the client
+// is told to retry, while the handler keeps running until it returns.
+func TestHandlerTimeout(t *testing.T) {
+	canceled := make(chan error, 1)
+	release := make(chan struct{})
+	bkd := &Backend{
+		HandlerTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			<-release
+			return nil
+		}),
+	}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	if got := sendMessage(c); !strings.HasPrefix(got, "451 4.3.0 ") {
+		t.Errorf("reply %q, want 451 4.3.0", got)
+	}
+	if err := <-canceled; err != context.DeadlineExceeded {
+		t.Errorf("handler ctx error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if report := bkd.Report(); len(report.Handlers) != 1 {
+		t.Errorf("handlers in flight after the timeout = %v, want 1", report.Handlers)
+	}
+
+	close(release)
+	c.Cmd("QUIT", "221 ")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := bkd.Wait(ctx); err != nil {
+		t.Errorf("Wait after the handler returned: %v", err)
+	}
+}
+
+// Without a Handler the OnEmailReceived callback gets the email and it is
+// accepted.
+func TestCallbackHandler(t *testing.T) {
+	received := make(chan *Email, 1)
+	bkd := NewBackend(func(e *Email) { received <- e }, nil, nil)
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	if got := sendMessage(c); !strings.HasPrefix(got, "250 ") {
+		t.Errorf("reply %q", got)
+	}
+	if e := <-received; e.Subject != "Hello" {
+		t.Errorf("callback got subject %q", e.Subject)
+	}
+}
+
+// A panicking handler is reported to OnFailed with the session data, or to
+// OnEmailFailed when OnFailed is nil. So is a message that fails to parse,
+// with an error wrapping ErrUnparsable.
+func TestFailureCallbacks(t *testing.T) {
+	panics := HandlerFunc(func(context.Context, *Email) error { panic("boom") })
+
+	failed := make(chan *Email, 1)
+	bkd := &Backend{Handler: panics, OnFailed: func(e *Email, err error) { failed <- e }}
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	sendMessage(c)
+	e := <-failed
+	raw, _ := io.ReadAll(e.Raw)
+	if e.Envelope.From != "bob@example.org" || len(e.RcptTo) != 1 || e.Connection.Helo != "client.example.org" ||
+		!strings.HasPrefix(string(raw), "Received: ") {
+		t.Errorf("OnFailed got %+v", e)
+	}
+
+	type call struct {
+		from EmailUser
+		to   []EmailUser
+	}
+	calls := make(chan call, 1)
+	bkd = NewBackend(nil, func(from EmailUser, to []EmailUser, raw io.Reader, err error) {
+		calls <- call{from, to}
+	}, nil)
+	bkd.Handler = panics
+	c = dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	sendMessage(c)
+	if got := <-calls; got.from.Email != "bob@example.org" || len(got.to) != 1 {
+		t.Errorf("OnEmailFailed got %+v", got)
+	}
+
+	errs := make(chan error, 1)
+	bkd = &Backend{OnFailed: func(e *Email, err error) { errs <- err }}
+	c = dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write("not a message\r\n.\r\n")
+	c.Reply()
+	if err := <-errs; !errors.Is(err, ErrUnparsable) {
+		t.Errorf("OnFailed error = %v, want ErrUnparsable", err)
+	}
+}
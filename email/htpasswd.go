@@ -0,0 +1,165 @@
+package email
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdStore is a CredentialStore backed by an htpasswd-style file with
+// one "username:hash" entry per line. Hashes may be bcrypt ($2a$, $2b$,
+// $2y$, as written by "htpasswd -B") or argon2id in the PHC string format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash). Blank lines and lines
+// starting with # are ignored. The file is re-read when it changes.
+type HtpasswdStore struct {
+	Path string
+
+	file watchedFile[map[string]string]
+}
+
+// dummyHash is compared against when the user is unknown, so that unknown
+// and known usernames take about the same time to reject.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("getmail"), bcrypt.DefaultCost)
+	return hash
+})
+
+// NewHtpasswdStore loads the credentials file at path.
+func NewHtpasswdStore(path string) (*HtpasswdStore, error) {
+	store := &HtpasswdStore{Path: path}
+	if _, err := store.users(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Authenticate checks password against the hash stored for username.
+func (h *HtpasswdStore) Authenticate(ctx context.Context, username, password string) error {
+	users, err := h.users()
+	if err != nil {
+		// Keep serving the last good copy of the file.
+		LogError("HtpasswdStore", err)
+	}
+
+	hash, ok := users[username]
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return ErrInvalidCredentials
+	}
+	return checkPasswordHash(hash, password)
+}
+
+// users returns the entries of the file, reading it again if it changed.
+func (h *HtpasswdStore) users() (map[string]string, error) {
+	users, err := h.file.load(h.Path, func(data []byte) (map[string]string, error) {
+		users := make(map[string]string)
+		err := eachLine(data, func(n int, line string) error {
+			username, hash, ok := strings.Cut(line, ":")
+			if !ok || username == "" || hash == "" {
+				return fmt.Errorf("%s:%d: expected username:hash", h.Path, n)
+			}
+			if !supportedHash(hash) {
+				return fmt.Errorf("%s:%d: unsupported hash for user %q (use bcrypt or argon2id)", h.Path, n, username)
+			}
+			if strings.HasPrefix(hash, "$argon2id$") {
+				// Bad parameters would make argon2 panic at login.
+				if _, err := parseArgon2id(hash); err != nil {
+					return fmt.Errorf("%s:%d: user %q: %w", h.Path, n, username, err)
+				}
+			}
+			users[username] = hash
+			return nil
+		})
+		return users, err
+	})
+	if err != nil {
+		return users, fmt.Errorf("htpasswd: %w", err)
+	}
+	return users, nil
+}
+
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$argon2id$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPasswordHash compares password with a bcrypt or argon2id hash.
+func checkPasswordHash(hash, password string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, password)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrInvalidCredentials
+		}
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	return nil
+}
+
+// argon2idHash is a parsed argon2id PHC string.
+type argon2idHash struct {
+	memory     uint32 // KiB
+	iterations uint32
+	threads    uint8
+	salt       []byte
+	key        []byte
+}
+
+// parseArgon2id parses a $argon2id$v=19$m=65536,t=3,p=4$salt$hash string
+// and checks its parameters against the limits of RFC 9106.
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads); err != nil {
+		return nil, fmt.Errorf("malformed argon2id parameters: %w", err)
+	}
+	if h.iterations < 1 || h.threads < 1 || h.memory < 8*uint32(h.threads) {
+		return nil, fmt.Errorf("invalid argon2id parameters %q (need t >= 1, p >= 1 and m >= 8*p)", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("malformed argon2id salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("malformed argon2id hash: %w", err)
+	}
+	if len(h.key) == 0 {
+		return nil, fmt.Errorf("empty argon2id hash")
+	}
+	return h, nil
+}
+
+// checkArgon2id verifies password against an argon2id hash.
+func checkArgon2id(hash, password string) error {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return fmt.Errorf("htpasswd: %w", err)
+	}
+	got := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(got, h.key) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package email
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeHtpasswd writes lines to a credentials file and returns its path.
+func writeHtpasswd(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// argon2idPHC hashes password with the given parameters in PHC format.
+func argon2idPHC(password string, m, t uint32, p uint8) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, t, m, p, 32)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestHtpasswdStore(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeHtpasswd(t, "# users", "alice:"+string(hash), "", "carol:"+argon2idPHC("hunter2", 64, 1, 1))
+	store, err := NewHtpasswdStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, tt := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"carol", "hunter2", true},
+		{"carol", "secret", false},
+		{"bob", "secret", false},
+	} {
+		err := store.Authenticate(ctx, tt.user, tt.password)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s/%s: %v", tt.user, tt.password, err)
+		}
+	}
+}
+
+// Argon2id parameters that would make argon2 panic are refused when the
+// file is loaded, not at login.
+func TestHtpasswdArgon2idParameters(t *testing.T) {
+	good := argon2idPHC("secret", 64, 1, 1)
+	salt, key := strings.Split(good, "$")[4], strings.Split(good, "$")[5]
+	for _, hash := range []string{
+		"$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key,
+		"$argon2id$v=19$m=7,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=16$m=64,t=1,p=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1$" + salt + "$" + key,
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$",
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt + "$!!",
+		"$argon2id$v=19$m=64,t=1,p=1$" + salt,
+	} {
+		path := writeHtpasswd(t, "alice:"+hash)
+		if _, err := NewHtpasswdStore(path); err == nil || !strings.Contains(err.Error(), ":1: user \"alice\"") {
+			t.Errorf("%s: error = %v", hash, err)
+		}
+	}
+}
+
+// A broken file is reported and the last good copy stays in use.
+func TestHtpasswdReloadKeepsUsers(t *testing.T) {
+	path := writeHtpasswd(t, "alice:"+argon2idPHC("secret", 64, 1, 1))
+	store, err := NewHtpasswdStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := "alice:$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5\n"
+	if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := store.file.modTime.Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Authenticate(context.Background(), "alice", "secret"); err != nil {
+		t.Errorf("after a bad reload: %v", err)
+	}
+}
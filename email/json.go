@@ -0,0 +1,572 @@
+package email
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"time"
+)
+
+// SchemaVersion is the schemaVersion of the JSON written by Email.MarshalJSON.
+// It changes only when a field is removed or changes meaning; new optional
+// fields keep the version.
+const SchemaVersion = 1
+
+// JSONSchema is the JSON Schema (draft 2020-12) of the JSON form of an
+// Email, as published in email/schema/email.v1.schema.json.
+//
+//go:embed schema/email.v1.schema.json
+var JSONSchema []byte
+
+// JSONOptions selects the optional parts of the JSON form of an Email.
+type JSONOptions struct {
+	AttachmentContent bool // Attachment content, base64 encoded
+	Raw               bool // The raw message, base64 encoded
+
+	// AttachmentPart, when set, names the part of a multipart body that
+	// carries the content of the attachment at index, for attachments
+	// written without their content.
+	AttachmentPart func(index int) string
+}
+
+// The types below are the JSON form of an Email. They are kept apart from
+// the Go types so the wire format stays stable when those change.
+
+type jsonEmail struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	ID            string         `json:"id"`
+	ReceivedAt    time.Time      `json:"receivedAt"`
+	From          jsonUser       `json:"from"`
+	RcptTo        []jsonUser     `json:"rcptTo"`
+	Recipients    []jsonUser     `json:"recipients,omitempty"`
+	Subject       string         `json:"subject"`
+	Headers       *jsonHeaders   `json:"headers,omitempty"`
+	Text          *string        `json:"text,omitempty"`
+	HTML          *string        `json:"html,omitempty"`
+	Attachments   []*jsonContent `json:"attachments"`
+	ClientIP      string         `json:"clientIp,omitempty"`
+	AuthUser      string         `json:"authUser,omitempty"`
+	Connection    jsonConnection `json:"connection"`
+	Envelope      jsonEnvelope   `json:"envelope"`
+	SPF           bool           `json:"spf"`
+	SPFResult     string         `json:"spfResult,omitempty"`
+	DKIM          bool           `json:"dkim"`
+	DMARC         bool           `json:"dmarc"`
+	DNSBL         *jsonDNSBL     `json:"dnsbl,omitempty"`
+	Raw           []byte         `json:"raw,omitempty"`
+}
+
+type jsonUser struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email"`
+	Tag   string `json:"tag,omitempty"`
+}
+
+type jsonHeaders struct {
+	MimeVersion             string            `json:"mimeVersion,omitempty"`
+	Date                    string            `json:"date,omitempty"`
+	Subject                 string            `json:"subject,omitempty"`
+	From                    jsonUser          `json:"from"`
+	To                      []jsonUser        `json:"to,omitempty"`
+	Cc                      []jsonUser        `json:"cc,omitempty"`
+	ContentType             jsonContentType   `json:"contentType"`
+	ContentTransferEncoding string            `json:"contentTransferEncoding,omitempty"`
+	Extra                   map[string]string `json:"extra,omitempty"`
+}
+
+type jsonContentType struct {
+	MediaType string            `json:"mediaType"`
+	SubType   string            `json:"subType"`
+	Params    map[string]string `json:"params,omitempty"`
+}
+
+type jsonContent struct {
+	ContentType string             `json:"contentType"`
+	Filename    string             `json:"filename,omitempty"`
+	Size        int64              `json:"size"`
+	Headers     jsonContentHeaders `json:"headers"`
+	Part        string             `json:"part,omitempty"`
+	Content     *[]byte            `json:"content,omitempty"`
+}
+
+type jsonContentHeaders struct {
+	MimeVersion             string            `json:"mimeVersion,omitempty"`
+	ContentType             jsonContentType   `json:"contentType"`
+	ContentTransferEncoding string            `json:"contentTransferEncoding,omitempty"`
+	Extra                   map[string]string `json:"extra,omitempty"`
+}
+
+type jsonConnection struct {
+	Listener   string     `json:"listener,omitempty"`
+	RemoteAddr string     `json:"remoteAddr,omitempty"`
+	ClientIP   string     `json:"clientIp,omitempty"`
+	ClientName string     `json:"clientName,omitempty"`
+	Helo       string     `json:"helo,omitempty"`
+	AuthUser   string     `json:"authUser,omitempty"`
+	TLS        *jsonTLS   `json:"tls,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+}
+
+type jsonTLS struct {
+	Version      string `json:"version"`
+	CipherSuite  string `json:"cipherSuite"`
+	ServerName   string `json:"serverName,omitempty"`
+	ClientCert   string `json:"clientCert,omitempty"`
+	ClientIssuer string `json:"clientIssuer,omitempty"`
+}
+
+type jsonEnvelope struct {
+	From       string         `json:"from"`
+	Params     jsonMailParams `json:"params"`
+	Recipients []jsonRcpt     `json:"recipients"`
+	MailAt     *time.Time     `json:"mailAt,omitempty"`
+	DataAt     *time.Time     `json:"dataAt,omitempty"`
+}
+
+type jsonMailParams struct {
+	Size     int64  `json:"size,omitempty"`
+	Body     string `json:"body,omitempty"`
+	SMTPUTF8 bool   `json:"smtputf8,omitempty"`
+	Ret      string `json:"ret,omitempty"`
+	EnvID    string `json:"envId,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+type jsonRcpt struct {
+	Address string   `json:"address"`
+	Notify  []string `json:"notify,omitempty"`
+	ORcpt   string   `json:"orcpt,omitempty"`
+}
+
+type jsonDNSBL struct {
+	Matches []jsonDNSBLMatch `json:"matches"`
+	Score   int              `json:"score"`
+	Listed  bool             `json:"listed"`
+}
+
+type jsonDNSBLMatch struct {
+	Zone    string   `json:"zone"`
+	Weight  int      `json:"weight"`
+	Answers []string `json:"answers"`
+}
+
+// MarshalJSON encodes the email in the versioned JSON form described by
+// JSONSchema, with attachment content but without the raw message. The
+// text and HTML bodies are strings; the readers are left readable.
+func (e *Email) MarshalJSON() ([]byte, error) {
+	return e.MarshalJSONWith(JSONOptions{AttachmentContent: true})
+}
+
+// MarshalJSONWith is MarshalJSON with a choice of the optional parts.
+func (e *Email) MarshalJSONWith(opts JSONOptions) ([]byte, error) {
+	v := &jsonEmail{
+		SchemaVersion: SchemaVersion,
+		ID:            e.ID,
+		ReceivedAt:    e.ReceivedAt,
+		From:          toJSONUser(e.From),
+		RcptTo:        toJSONUsers(e.RcptTo),
+		Recipients:    toJSONUsers(e.Recipients),
+		Subject:       e.Subject,
+		Attachments:   []*jsonContent{},
+		AuthUser:      e.AuthUser,
+		Connection:    toJSONConnection(e.Connection),
+		Envelope:      toJSONEnvelope(e.Envelope),
+		SPF:           e.SPF,
+		SPFResult:     string(e.SPFResult),
+		DKIM:          e.DKIM,
+		DMARC:         e.DMARC,
+		DNSBL:         toJSONDNSBL(e.DNSBL),
+	}
+	if v.RcptTo == nil {
+		v.RcptTo = []jsonUser{}
+	}
+	if e.ClientIP != nil {
+		v.ClientIP = e.ClientIP.String()
+	}
+	if e.Headers != nil {
+		v.Headers = toJSONHeaders(e.Headers)
+	}
+
+	var err error
+	if v.Text, err = bodyString(e.BodyText); err != nil {
+		return nil, fmt.Errorf("email: text body: %w", err)
+	}
+	if v.HTML, err = bodyString(e.BodyHTML); err != nil {
+		return nil, fmt.Errorf("email: HTML body: %w", err)
+	}
+	for i, a := range e.Attachments {
+		c, err := a.toJSON(opts.AttachmentContent)
+		if err != nil {
+			return nil, fmt.Errorf("email: attachment: %w", err)
+		}
+		if !opts.AttachmentContent && opts.AttachmentPart != nil {
+			c.Part = opts.AttachmentPart(i)
+		}
+		v.Attachments = append(v.Attachments, c)
+	}
+	if opts.Raw {
+		if v.Raw, err = e.RawBytes(); err != nil {
+			return nil, fmt.Errorf("email: raw message: %w", err)
+		}
+	}
+	return json.Marshal(v)
+}
+
+// UnmarshalJSON decodes the JSON form written by MarshalJSON. Bodies,
+// attachments and the raw message become readers over the decoded bytes;
+// an attachment written without its content has a nil reader. JSON of a
+// newer schemaVersion is rejected.
+func (e *Email) UnmarshalJSON(data []byte) error {
+	var v jsonEmail
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.SchemaVersion < 1 || v.SchemaVersion > SchemaVersion {
+		return fmt.Errorf("email: unsupported schemaVersion %d (expected %d)", v.SchemaVersion, SchemaVersion)
+	}
+
+	*e = Email{
+		ID:         v.ID,
+		ReceivedAt: v.ReceivedAt,
+		ClientIP:   net.ParseIP(v.ClientIP),
+		AuthUser:   v.AuthUser,
+		Connection: v.Connection.connection(),
+		Envelope:   v.Envelope.envelope(),
+		From:       v.From.user(),
+		RcptTo:     fromJSONUsers(v.RcptTo),
+		Recipients: fromJSONUsers(v.Recipients),
+		Subject:    v.Subject,
+		SPF:        v.SPF,
+		SPFResult:  SPFResult(v.SPFResult),
+		DKIM:       v.DKIM,
+		DMARC:      v.DMARC,
+		DNSBL:      v.DNSBL.result(),
+	}
+	if v.Headers != nil {
+		e.Headers = v.Headers.headers()
+	}
+	if v.Text != nil {
+		e.BodyText = textContent("plain", *v.Text)
+	}
+	if v.HTML != nil {
+		e.BodyHTML = textContent("html", *v.HTML)
+	}
+	for _, c := range v.Attachments {
+		e.Attachments = append(e.Attachments, c.content())
+	}
+	if v.Raw != nil {
+		e.Raw = bytes.NewReader(v.Raw)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the part with its metadata and its content, base64
+// encoded, as an attachment of the email JSON form.
+func (rp *EmailContent) MarshalJSON() ([]byte, error) {
+	c, err := rp.toJSON(true)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(c)
+}
+
+// UnmarshalJSON decodes the form written by MarshalJSON.
+func (rp *EmailContent) UnmarshalJSON(data []byte) error {
+	var c jsonContent
+	if err := json.Unmarshal(data, &c); err != nil {
+		return err
+	}
+	*rp = *c.content()
+	return nil
+}
+
+// Bytes returns the content of the part without consuming it.
+func (rp *EmailContent) Bytes() ([]byte, error) {
+	return readerBytes(&rp.R)
+}
+
+// RawBytes returns the raw message without consuming Raw.
+func (e *Email) RawBytes() ([]byte, error) {
+	return readerBytes(&e.Raw)
+}
+
+// readerBytes returns everything *r holds, from the start. A seekable
+// reader is rewound before and after reading; any other reader is replaced
+// by one over the bytes read, so the data can be read again either way.
+func readerBytes(r *io.Reader) ([]byte, error) {
+	if *r == nil {
+		return nil, nil
+	}
+	seeker, ok := (*r).(io.Seeker)
+	if !ok {
+		data, err := io.ReadAll(*r)
+		*r = bytes.NewReader(data)
+		return data, err
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(*r)
+	if err != nil {
+		return nil, err
+	}
+	_, err = seeker.Seek(0, io.SeekStart)
+	return data, err
+}
+
+func (rp *EmailContent) toJSON(withContent bool) (*jsonContent, error) {
+	data, err := rp.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	c := &jsonContent{
+		ContentType: rp.ContentType(),
+		Filename:    rp.Filename(),
+		Size:        int64(len(data)),
+		Headers: jsonContentHeaders{
+			MimeVersion:             rp.Headers.MimeVersion,
+			ContentType:             toJSONContentType(rp.Headers.ContentType),
+			ContentTransferEncoding: rp.Headers.ContentTransferEncoding,
+			Extra:                   rp.Headers.Extra,
+		},
+	}
+	if withContent {
+		// A pointer, so that empty content is written as "" rather than
+		// left out like content that wasn't requested.
+		if data == nil {
+			data = []byte{}
+		}
+		c.Content = &data
+	}
+	return c, nil
+}
+
+func (c *jsonContent) content() *EmailContent {
+	rp := &EmailContent{
+		Headers: EmailContentHeader{
+			MimeVersion:             c.Headers.MimeVersion,
+			ContentType:             c.Headers.ContentType.contentType(),
+			ContentTransferEncoding: c.Headers.ContentTransferEncoding,
+			Extra:                   Headers(c.Headers.Extra),
+		},
+		Size: c.Size,
+	}
+	if c.Content != nil {
+		rp.R = bytes.NewReader(*c.Content)
+	}
+	return rp
+}
+
+// bodyString returns the content of a body as a string, nil without a body.
+func bodyString(c *EmailContent) (*string, error) {
+	if c == nil {
+		return nil, nil
+	}
+	data, err := c.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+func textContent(subType, s string) *EmailContent {
+	return &EmailContent{
+		R:       bytes.NewReader([]byte(s)),
+		Headers: EmailContentHeader{ContentType: HeaderContentType{MediaType: "text", SubType: subType}},
+		Size:    int64(len(s)),
+	}
+}
+
+func toJSONUser(u EmailUser) jsonUser {
+	return jsonUser{Name: u.Name, Email: u.Email, Tag: u.Tag}
+}
+
+func (u jsonUser) user() EmailUser {
+	return EmailUser{Name: u.Name, Email: u.Email, Tag: u.Tag}
+}
+
+func toJSONUsers(users []EmailUser) []jsonUser {
+	if users == nil {
+		return nil
+	}
+	out := make([]jsonUser, len(users))
+	for i, u := range users {
+		out[i] = toJSONUser(u)
+	}
+	return out
+}
+
+func fromJSONUsers(users []jsonUser) []EmailUser {
+	if users == nil {
+		return nil
+	}
+	out := make([]EmailUser, len(users))
+	for i, u := range users {
+		out[i] = u.user()
+	}
+	return out
+}
+
+func toJSONHeaders(h *MimeHeaders) *jsonHeaders {
+	return &jsonHeaders{
+		MimeVersion:             h.MimeVersion,
+		Date:                    h.Date,
+		Subject:                 h.Subject,
+		From:                    toJSONUser(h.From),
+		To:                      toJSONUsers(h.To),
+		Cc:                      toJSONUsers(h.Cc),
+		ContentType:             toJSONContentType(h.ContentType),
+		ContentTransferEncoding: h.ContentTransferEncoding,
+		Extra:                   h.Extra,
+	}
+}
+
+func (h *jsonHeaders) headers() *MimeHeaders {
+	return &MimeHeaders{
+		MimeVersion:             h.MimeVersion,
+		Date:                    h.Date,
+		Subject:                 h.Subject,
+		From:                    h.From.user(),
+		To:                      fromJSONUsers(h.To),
+		Cc:                      fromJSONUsers(h.Cc),
+		ContentType:             h.ContentType.contentType(),
+		ContentTransferEncoding: h.ContentTransferEncoding,
+		Extra:                   Headers(h.Extra),
+	}
+}
+
+func toJSONContentType(ct HeaderContentType) jsonContentType {
+	return jsonContentType{MediaType: ct.MediaType, SubType: ct.SubType, Params: ct.Params}
+}
+
+func (ct jsonContentType) contentType() HeaderContentType {
+	return HeaderContentType{MediaType: ct.MediaType, SubType: ct.SubType, Params: Headers(maps.Clone(ct.Params))}
+}
+
+func toJSONConnection(c Connection) jsonConnection {
+	v := jsonConnection{
+		Listener:   c.Listener,
+		RemoteAddr: c.RemoteAddr,
+		ClientName: c.ClientName,
+		Helo:       c.Helo,
+		AuthUser:   c.AuthUser,
+		StartedAt:  timeOrNil(c.StartedAt),
+	}
+	if c.ClientIP != nil {
+		v.ClientIP = c.ClientIP.String()
+	}
+	if c.TLS != nil {
+		v.TLS = &jsonTLS{
+			Version:      c.TLS.Version,
+			CipherSuite:  c.TLS.CipherSuite,
+			ServerName:   c.TLS.ServerName,
+			ClientCert:   c.TLS.ClientCert,
+			ClientIssuer: c.TLS.ClientIssuer,
+		}
+	}
+	return v
+}
+
+func (v jsonConnection) connection() Connection {
+	c := Connection{
+		Listener:   v.Listener,
+		RemoteAddr: v.RemoteAddr,
+		ClientIP:   net.ParseIP(v.ClientIP),
+		ClientName: v.ClientName,
+		Helo:       v.Helo,
+		AuthUser:   v.AuthUser,
+	}
+	if v.StartedAt != nil {
+		c.StartedAt = *v.StartedAt
+	}
+	if v.TLS != nil {
+		c.TLS = &TLSState{
+			Version:      v.TLS.Version,
+			CipherSuite:  v.TLS.CipherSuite,
+			ServerName:   v.TLS.ServerName,
+			ClientCert:   v.TLS.ClientCert,
+			ClientIssuer: v.TLS.ClientIssuer,
+		}
+	}
+	return c
+}
+
+func toJSONEnvelope(env Envelope) jsonEnvelope {
+	v := jsonEnvelope{
+		From: env.From,
+		Params: jsonMailParams{
+			Size:     env.Params.Size,
+			Body:     env.Params.Body,
+			SMTPUTF8: env.Params.SMTPUTF8,
+			Ret:      env.Params.Ret,
+			EnvID:    env.Params.EnvID,
+			Auth:     env.Params.Auth,
+		},
+		Recipients: []jsonRcpt{},
+		MailAt:     timeOrNil(env.MailAt),
+		DataAt:     timeOrNil(env.DataAt),
+	}
+	for _, r := range env.Recipients {
+		v.Recipients = append(v.Recipients, jsonRcpt{Address: r.Address, Notify: r.Notify, ORcpt: r.ORcpt})
+	}
+	return v
+}
+
+func (v jsonEnvelope) envelope() Envelope {
+	env := Envelope{
+		From: v.From,
+		Params: MailParams{
+			Size:     v.Params.Size,
+			Body:     v.Params.Body,
+			SMTPUTF8: v.Params.SMTPUTF8,
+			Ret:      v.Params.Ret,
+			EnvID:    v.Params.EnvID,
+			Auth:     v.Params.Auth,
+		},
+	}
+	for _, r := range v.Recipients {
+		env.Recipients = append(env.Recipients, RcptParams{Address: r.Address, Notify: r.Notify, ORcpt: r.ORcpt})
+	}
+	if v.MailAt != nil {
+		env.MailAt = *v.MailAt
+	}
+	if v.DataAt != nil {
+		env.DataAt = *v.DataAt
+	}
+	return env
+}
+
+func toJSONDNSBL(r *DNSBLResult) *jsonDNSBL {
+	if r == nil {
+		return nil
+	}
+	v := &jsonDNSBL{Matches: []jsonDNSBLMatch{}, Score: r.Score, Listed: r.Listed}
+	for _, m := range r.Matches {
+		v.Matches = append(v.Matches, jsonDNSBLMatch{Zone: m.Zone, Weight: m.Weight, Answers: m.Answers})
+	}
+	return v
+}
+
+func (v *jsonDNSBL) result() *DNSBLResult {
+	if v == nil {
+		return nil
+	}
+	r := &DNSBLResult{Score: v.Score, Listed: v.Listed}
+	for _, m := range v.Matches {
+		r.Matches = append(r.Matches, DNSBLMatch{Zone: m.Zone, Weight: m.Weight, Answers: m.Answers})
+	}
+	return r
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,288 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const jsonTestMessage = "From: Bob <bob@example.org>\r\n" +
+	"To: Alice <alice@example.com>\r\n" +
+	"Cc: carol@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"X-Ticket: 42\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"b2\"\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>See attached.</p>\r\n" +
+	"--b2--\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--b1--\r\n"
+
+func TestEmailJSONRoundTrip(t *testing.T) {
+	e := testEmail(t, jsonTestMessage)
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Email
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"ID", "ReceivedAt", "ClientIP", "AuthUser", "Connection", "Envelope", "From", "RcptTo", "Recipients", "Subject", "Headers", "SPF", "SPFResult", "DKIM", "DMARC", "DNSBL"} {
+		want := reflect.ValueOf(*e).FieldByName(field).Interface()
+		have := reflect.ValueOf(got).FieldByName(field).Interface()
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%s = %+v, want %+v", field, have, want)
+		}
+	}
+
+	if got.Headers.Extra["X-Ticket"] != "42" {
+		t.Errorf("Headers.Extra = %v", got.Headers.Extra)
+	}
+	for _, body := range []struct {
+		name string
+		c    *EmailContent
+		want string
+	}{
+		{"text", got.BodyText, "See attached."},
+		{"HTML", got.BodyHTML, "<p>See attached.</p>"},
+	} {
+		data, err := body.c.Bytes()
+		if err != nil || strings.TrimSpace(string(data)) != body.want {
+			t.Errorf("%s body = %q, %v", body.name, data, err)
+		}
+	}
+	if len(got.Attachments) != 1 {
+		t.Fatalf("%d attachments", len(got.Attachments))
+	}
+	a := got.Attachments[0]
+	content, _ := a.Bytes()
+	if a.Filename() != "report.pdf" || a.ContentType() != "application/pdf" || string(content) != "%PDF-1.4\n" || a.Size != int64(len(content)) {
+		t.Errorf("attachment %s %s, %d bytes: %q", a.Filename(), a.ContentType(), a.Size, content)
+	}
+	if got.Raw != nil {
+		t.Error("raw message written without JSONOptions.Raw")
+	}
+
+	// Marshaling leaves the readers readable.
+	again, err := json.Marshal(e)
+	if err != nil || !bytes.Equal(again, data) {
+		t.Errorf("second marshal differs: %v", err)
+	}
+}
+
+func TestEmailJSONSchemaVersion(t *testing.T) {
+	for _, tt := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{"schemaVersion":1,"id":"x"}`, true},
+		{`{"id":"x"}`, false},
+		{`{"schemaVersion":0,"id":"x"}`, false},
+		{`{"schemaVersion":2,"id":"x"}`, false},
+		{`{"schemaVersion":"1"}`, false},
+	} {
+		var e Email
+		err := json.Unmarshal([]byte(tt.json), &e)
+		if (err == nil) != tt.ok {
+			t.Errorf("Unmarshal(%s) = %v, want ok %v", tt.json, err, tt.ok)
+		}
+	}
+}
+
+func TestMarshalJSONWith(t *testing.T) {
+	e := testEmail(t, jsonTestMessage)
+	raw, _ := e.RawBytes()
+
+	part := func(i int) string { return fmt.Sprintf("file%d", i) }
+	tests := []struct {
+		opts        JSONOptions
+		content     bool
+		part        any
+		rawIncluded bool
+	}{
+		{JSONOptions{}, false, nil, false},
+		{JSONOptions{AttachmentContent: true}, true, nil, false},
+		{JSONOptions{Raw: true}, false, nil, true},
+		{JSONOptions{AttachmentPart: part}, false, "file0", false},
+		{JSONOptions{AttachmentContent: true, AttachmentPart: part}, true, nil, false},
+	}
+	for _, tt := range tests {
+		data, err := e.MarshalJSONWith(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct {
+			Attachments []map[string]any `json:"attachments"`
+			Raw         []byte           `json:"raw"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		if len(v.Attachments) != 1 {
+			t.Fatalf("%+v: %d attachments", tt.opts, len(v.Attachments))
+		}
+		if _, ok := v.Attachments[0]["content"]; ok != tt.content {
+			t.Errorf("%+v: attachment content present = %v", tt.opts, ok)
+		}
+		if v.Attachments[0]["part"] != tt.part {
+			t.Errorf("%+v: attachment part = %v, want %v", tt.opts, v.Attachments[0]["part"], tt.part)
+		}
+		if v.Attachments[0]["size"] != float64(9) {
+			t.Errorf("%+v: attachment size = %v", tt.opts, v.Attachments[0]["size"])
+		}
+		if tt.rawIncluded != (v.Raw != nil) || (tt.rawIncluded && !bytes.Equal(v.Raw, raw)) {
+			t.Errorf("%+v: raw = %q", tt.opts, v.Raw)
+		}
+	}
+}
+
+// An empty attachment keeps an empty "content", unlike one written without
+// its content.
+func TestMarshalJSONEmptyAttachment(t *testing.T) {
+	e := NewEmail()
+	e.Attachments = []*EmailContent{{R: bytes.NewReader(nil)}}
+
+	for _, withContent := range []bool{true, false} {
+		data, err := e.MarshalJSONWith(JSONOptions{AttachmentContent: withContent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.Contains(data, []byte(`"content":""`)); got != withContent {
+			t.Errorf("content %v: empty content present = %v in %s", withContent, got, data)
+		}
+		var back Email
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatal(err)
+		}
+		if got := back.Attachments[0].R != nil; got != withContent {
+			t.Errorf("content %v: decoded attachment has a reader = %v", withContent, got)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	file, err := os.ReadFile("schema/email.v1.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file, JSONSchema) {
+		t.Error("embedded schema differs from the file")
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(JSONSchema, &schema); err != nil {
+		t.Fatalf("schema is not valid JSON: %v", err)
+	}
+
+	// A fully populated email and a bare one both conform.
+	bare := NewEmail()
+	for _, e := range []*Email{testEmail(t, jsonTestMessage), bare} {
+		data, err := e.MarshalJSONWith(JSONOptions{AttachmentContent: true, Raw: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		checkSchema(t, schema, schema, v, "$")
+	}
+}
+
+// checkSchema validates v against the subset of JSON Schema the email schema
+// uses: $ref, type, const, enum, required, properties and items. Properties
+// missing from the schema are reported, so the schema keeps up with the
+// encoder.
+func checkSchema(t *testing.T, root, s map[string]any, v any, path string) {
+	t.Helper()
+	if ref, ok := s["$ref"].(string); ok {
+		def := root
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			def, _ = def[name].(map[string]any)
+		}
+		if def == nil {
+			t.Fatalf("%s: unresolved $ref %s", path, ref)
+		}
+		s = def
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, v) {
+		t.Errorf("%s = %v, want %v", path, v, c)
+	}
+	if enum, ok := s["enum"].([]any); ok && !slices.Contains(enum, v) {
+		t.Errorf("%s = %v, not in %v", path, v, enum)
+	}
+
+	switch s["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			t.Errorf("%s is %T, want an object", path, v)
+			return
+		}
+		required, _ := s["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				t.Errorf("%s: missing required %s", path, name)
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		for name, value := range obj {
+			if props == nil {
+				continue // free-form, such as extra headers
+			}
+			p, ok := props[name].(map[string]any)
+			if !ok {
+				t.Errorf("%s.%s is not in the schema", path, name)
+				continue
+			}
+			checkSchema(t, root, p, value, path+"."+name)
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			t.Errorf("%s is %T, want an array", path, v)
+			return
+		}
+		items, _ := s["items"].(map[string]any)
+		for i, item := range arr {
+			if items != nil {
+				checkSchema(t, root, items, item, path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			t.Errorf("%s is %T, want a string", path, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			t.Errorf("%s is %T, want a boolean", path, v)
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			t.Errorf("%s = %v, want an integer", path, v)
+		}
+	}
+}
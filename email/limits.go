@@ -0,0 +1,209 @@
+package email
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	// ErrTooManyConnections is returned when a client network already has
+	// the maximum number of open sessions.
+	ErrTooManyConnections = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections from your address, try again later",
+	}
+
+	// ErrMessageRateExceeded is returned by MAIL when a client network has
+	// sent too many messages in the last minute.
+	ErrMessageRateExceeded = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Message rate limit exceeded, try again later",
+	}
+
+	// ErrRecipientRateExceeded is returned by RCPT when a sender has
+	// addressed too many recipients in the last hour.
+	ErrRecipientRateExceeded = &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Recipient rate limit exceeded for this sender, try again later",
+	}
+)
+
+// Limits configures a Limiter. A zero limit is not enforced.
+type Limits struct {
+	// ConnectionsPerIP caps the concurrent connections per client network.
+	// It is enforced by whoever accepts the connections, through Connect
+	// and Disconnect.
+	ConnectionsPerIP  int
+	MessagesPerMinute int // MAIL commands per client network per minute
+	RecipientsPerHour int // Accepted recipients per sender per hour
+
+	// Clients are grouped by network so a bot cannot spread over a range;
+	// zero means 32 for IPv4 and 64 for IPv6.
+	IPv4Prefix int
+	IPv6Prefix int
+
+	Exempt []*net.IPNet // Clients that are never limited, e.g. relays
+}
+
+// Limiter enforces per-client connection and rate limits. Rate counters
+// use fixed windows and are dropped once their window has passed.
+type Limiter struct {
+	limits Limits
+
+	mu         sync.Mutex
+	conns      map[string]int
+	messages   *window
+	recipients *window
+}
+
+// NewLimiter returns a Limiter enforcing limits.
+func NewLimiter(limits Limits) *Limiter {
+	if limits.IPv4Prefix == 0 {
+		limits.IPv4Prefix = 32
+	}
+	if limits.IPv6Prefix == 0 {
+		limits.IPv6Prefix = 64
+	}
+	return &Limiter{
+		limits:     limits,
+		conns:      make(map[string]int),
+		messages:   newWindow(time.Minute),
+		recipients: newWindow(time.Hour),
+	}
+}
+
+// Connect registers a new connection from ip. Every successful call must
+// be paired with Disconnect.
+func (l *Limiter) Connect(ip net.IP) error {
+	key, ok := l.networkKey(ip)
+	if !ok || l.limits.ConnectionsPerIP <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[key] >= l.limits.ConnectionsPerIP {
+		return ErrTooManyConnections
+	}
+	l.conns[key]++
+	return nil
+}
+
+// Disconnect releases a connection registered with Connect.
+func (l *Limiter) Disconnect(ip net.IP) {
+	key, ok := l.networkKey(ip)
+	if !ok || l.limits.ConnectionsPerIP <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[key] <= 1 {
+		delete(l.conns, key)
+	} else {
+		l.conns[key]--
+	}
+}
+
+// Message counts a new transaction from ip.
+func (l *Limiter) Message(ip net.IP) error {
+	key, ok := l.networkKey(ip)
+	if !ok || l.limits.MessagesPerMinute <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.messages.add(key, l.limits.MessagesPerMinute, time.Now()) {
+		return ErrMessageRateExceeded
+	}
+	return nil
+}
+
+// Recipient counts a recipient addressed by sender from ip; the exemption
+// list is checked against ip.
+func (l *Limiter) Recipient(ip net.IP, sender string) error {
+	if l.limits.RecipientsPerHour <= 0 || l.exempt(ip) {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.recipients.add(strings.ToLower(sender), l.limits.RecipientsPerHour, time.Now()) {
+		return ErrRecipientRateExceeded
+	}
+	return nil
+}
+
+// networkKey returns the network ip is counted under, and false when ip is
+// unknown or exempt.
+func (l *Limiter) networkKey(ip net.IP) (string, bool) {
+	if ip == nil || l.exempt(ip) {
+		return "", false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.limits.IPv4Prefix, 32)).String(), true
+	}
+	return ip.Mask(net.CIDRMask(l.limits.IPv6Prefix, 128)).String(), true
+}
+
+func (l *Limiter) exempt(ip net.IP) bool {
+	for _, n := range l.limits.Exempt {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// window counts events per key in fixed windows of length size.
+type window struct {
+	size   time.Duration
+	counts map[string]*windowCount
+	swept  time.Time
+}
+
+type windowCount struct {
+	start time.Time
+	n     int
+}
+
+func newWindow(size time.Duration) *window {
+	return &window{size: size, counts: make(map[string]*windowCount)}
+}
+
+// add counts one event for key at now and reports whether the key is still
+// within max events for the current window.
+func (w *window) add(key string, max int, now time.Time) bool {
+	// Drop expired counters at most once per window.
+	if now.Sub(w.swept) >= w.size {
+		for k, c := range w.counts {
+			if now.Sub(c.start) >= w.size {
+				delete(w.counts, k)
+			}
+		}
+		w.swept = now
+	}
+
+	c, ok := w.counts[key]
+	if !ok || now.Sub(c.start) >= w.size {
+		c = &windowCount{start: now}
+		w.counts[key] = c
+	}
+	if c.n >= max {
+		return false
+	}
+	c.n++
+	return true
+}
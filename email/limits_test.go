@@ -0,0 +1,132 @@
+package email
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWindowRollover(t *testing.T) {
+	w := newWindow(time.Minute)
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, want := range []bool{true, true, false} {
+		if got := w.add("a", 2, t0.Add(time.Duration(i)*time.Second)); got != want {
+			t.Errorf("add #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if w.add("a", 2, t0.Add(59*time.Second)) {
+		t.Error("add before the window ended succeeded")
+	}
+	if !w.add("b", 2, t0.Add(59*time.Second)) {
+		t.Error("other key was limited")
+	}
+
+	// A new window starts once the old one has passed.
+	if !w.add("a", 2, t0.Add(time.Minute)) {
+		t.Error("add in the next window failed")
+	}
+	if !w.add("a", 2, t0.Add(time.Minute)) || w.add("a", 2, t0.Add(time.Minute)) {
+		t.Error("next window does not apply the limit")
+	}
+}
+
+func TestWindowSweep(t *testing.T) {
+	w := newWindow(time.Minute)
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	w.add("old", 1, t0)
+	w.add("new", 1, t0.Add(30*time.Second))
+
+	w.add("other", 1, t0.Add(70*time.Second))
+	if _, ok := w.counts["old"]; ok {
+		t.Error("expired counter was kept")
+	}
+	if _, ok := w.counts["new"]; !ok {
+		t.Error("live counter was dropped")
+	}
+}
+
+func TestLimiterConnections(t *testing.T) {
+	_, exempt, _ := net.ParseCIDR("10.0.0.0/8")
+	l := NewLimiter(Limits{ConnectionsPerIP: 2, IPv4Prefix: 24, Exempt: []*net.IPNet{exempt}})
+
+	a, b, c := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	if err := l.Connect(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Connect(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Connect(c); err != ErrTooManyConnections {
+		t.Fatalf("third connection from the /24: %v, want ErrTooManyConnections", err)
+	}
+	if err := l.Connect(net.ParseIP("198.51.100.1")); err != nil {
+		t.Errorf("other network: %v", err)
+	}
+
+	l.Disconnect(a)
+	if err := l.Connect(c); err != nil {
+		t.Errorf("connection after a disconnect: %v", err)
+	}
+
+	for range 3 {
+		if err := l.Connect(net.ParseIP("10.1.2.3")); err != nil {
+			t.Errorf("exempt client: %v", err)
+		}
+		if err := l.Connect(nil); err != nil {
+			t.Errorf("unknown address: %v", err)
+		}
+	}
+}
+
+func TestLimiterIPv6Prefix(t *testing.T) {
+	l := NewLimiter(Limits{ConnectionsPerIP: 1})
+	if err := l.Connect(net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Connect(net.ParseIP("2001:db8::ffff")); err != ErrTooManyConnections {
+		t.Errorf("same /64: %v, want ErrTooManyConnections", err)
+	}
+	if err := l.Connect(net.ParseIP("2001:db8:0:1::1")); err != nil {
+		t.Errorf("other /64: %v", err)
+	}
+}
+
+func TestLimiterMessages(t *testing.T) {
+	l := NewLimiter(Limits{MessagesPerMinute: 2})
+	ip := net.ParseIP("192.0.2.1")
+	for range 2 {
+		if err := l.Message(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Message(ip); err != ErrMessageRateExceeded {
+		t.Errorf("third message: %v, want ErrMessageRateExceeded", err)
+	}
+	if err := l.Message(net.ParseIP("192.0.2.2")); err != nil {
+		t.Errorf("other client: %v", err)
+	}
+}
+
+func TestLimiterRecipients(t *testing.T) {
+	_, exempt, _ := net.ParseCIDR("10.0.0.0/8")
+	l := NewLimiter(Limits{RecipientsPerHour: 2, Exempt: []*net.IPNet{exempt}})
+	ip := net.ParseIP("192.0.2.1")
+
+	if err := l.Recipient(ip, "bob@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	// The sender is counted across clients and case.
+	if err := l.Recipient(net.ParseIP("198.51.100.1"), "Bob@Example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Recipient(ip, "bob@example.org"); err != ErrRecipientRateExceeded {
+		t.Errorf("third recipient: %v, want ErrRecipientRateExceeded", err)
+	}
+	if err := l.Recipient(ip, "carol@example.org"); err != nil {
+		t.Errorf("other sender: %v", err)
+	}
+	if err := l.Recipient(net.ParseIP("10.0.0.1"), "bob@example.org"); err != nil {
+		t.Errorf("exempt client: %v", err)
+	}
+}
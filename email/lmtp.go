@@ -0,0 +1,51 @@
+package email
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errDeliveryFailed is reported for a message or LMTP recipient whose
+// delivery failed.
+var errDeliveryFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Delivery failed, try again later",
+}
+
+// LMTPData implements smtp.LMTPSession. Unlike Data, the message is
+// delivered once per recipient, and each recipient gets its own
+// status so the LMTP client (e.g. Postfix) can retry only the ones that
+// failed. The message is parsed once; every delivery receives an
+// independent copy of the email, with its own ID, whose RcptTo holds that
+// single recipient.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("LMTPData: failed to read message: %w", err)
+	}
+
+	s.mu.Lock()
+	rcpts, params := s.RcptTo, s.envelope.Recipients
+	s.mu.Unlock()
+
+	// A message that can't be parsed fails for every recipient.
+	parsed, err := s.newEmail(raw, rcpts, params)
+	if err != nil {
+		return err
+	}
+
+	defer s.setEmail(nil)
+	for i, rcpt := range rcpts {
+		email, err := parsed.clone()
+		if err == nil {
+			s.address(email, raw, rcpts[i:i+1], params[i:i+1])
+			s.setEmail(email)
+			err = replyError(s.deliver(email), errDeliveryFailed)
+		}
+		status.SetStatus(rcpt.Email, err)
+	}
+	return nil
+}
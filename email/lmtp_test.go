@@ -0,0 +1,132 @@
+package email
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Every recipient gets its own copy of the email, traced for that recipient,
+// and its own status: a handler error is passed on as is and a panic becomes
+// a temporary failure.
+func TestLMTPData(t *testing.T) {
+	type delivery struct {
+		email *Email
+		raw   string
+	}
+	deliveries := make(chan delivery, 4)
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		raw, _ := io.ReadAll(e.Raw)
+		deliveries <- delivery{e, string(raw)}
+		switch e.RcptTo[0].Email {
+		case "carol@example.com":
+			return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 2, 1}, Message: "mailbox disabled"}
+		case "erin@example.com":
+			panic("mailbox unavailable")
+		}
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, true)
+	c.Cmd("LHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice+news@example.com>", "250 ")
+	c.Cmd("RCPT TO:<carol@example.com>", "250 ")
+	c.Cmd("RCPT TO:<dave@example.com>", "250 ")
+	c.Cmd("RCPT TO:<erin@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+	c.Expect("550 5.2.1 ")
+	c.Expect("250 ")
+	c.Expect("451 4.3.0 ")
+
+	ids := make(map[string]bool)
+	for _, want := range []string{"alice+news@example.com", "carol@example.com", "dave@example.com", "erin@example.com"} {
+		d := <-deliveries
+		if len(d.email.RcptTo) != 1 || d.email.RcptTo[0].Email != want {
+			t.Fatalf("RcptTo = %v, want [%s]", d.email.RcptTo, want)
+		}
+		if len(d.email.Envelope.Recipients) != 1 || d.email.Envelope.Recipients[0].Address != want {
+			t.Errorf("Envelope.Recipients = %v, want [%s]", d.email.Envelope.Recipients, want)
+		}
+		if !strings.Contains(d.raw, "with LMTP id "+d.email.ID+"\r\n\tfor <"+want+">;") {
+			t.Errorf("trace for %s:\n%s", want, d.raw)
+		}
+		ids[d.email.ID] = true
+	}
+	if len(ids) != 4 {
+		t.Errorf("copies share IDs: %v", ids)
+	}
+
+	// The transaction is over.
+	c.Cmd("DATA", "502 5.5.1 Missing RCPT")
+}
+
+// A handler that consumes or changes its copy leaves the next recipient's
+// copy intact.
+func TestLMTPDataIndependentCopies(t *testing.T) {
+	var bodies []string
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		body, _ := io.ReadAll(e.BodyText)
+		bodies = append(bodies, string(body))
+		if _, ok := e.Headers.Extra["X-Seen"]; ok {
+			t.Errorf("%s: sees the header added for another recipient", e.RcptTo[0].Email)
+		}
+		e.Headers.Extra["X-Seen"] = "yes"
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, true)
+	c.Cmd("LHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("RCPT TO:<carol@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+	c.Expect("250 ")
+
+	if len(bodies) != 2 || bodies[0] == "" || bodies[1] != bodies[0] {
+		t.Errorf("bodies = %q", bodies)
+	}
+}
+
+// A session delivering over LMTP has a pending message in the drain report.
+func TestLMTPDataPending(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, true)
+	c.Cmd("LHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("RCPT TO:<carol@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+
+	pending := func() bool {
+		report := bkd.Report()
+		return len(report.Sessions) == 1 && report.Sessions[0].Pending
+	}
+	for range 2 {
+		<-started
+		if !pending() {
+			t.Errorf("session not pending during delivery: %+v", bkd.Report().Sessions)
+		}
+		release <- struct{}{}
+	}
+	c.Expect("250 ")
+	c.Expect("250 ")
+	if pending() {
+		t.Errorf("session still pending after delivery: %+v", bkd.Report().Sessions)
+	}
+}
@@ -0,0 +1,130 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a Handler with a processing step.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with the middlewares. The first middleware is the outermost,
+// so Chain(h, Recover(nil), Logging()) runs Recover, then Logging, then h.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Recover turns a panic in the next handler into an error, so the client
+// gets a temporary failure instead of the process crashing. report, when
+// set, is called with the email and the error.
+func Recover(report func(email *Email, err error)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, email *Email) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic in handler: %v", r)
+					LogError("Recover", err)
+					if report != nil {
+						report(email, err)
+					}
+				}
+			}()
+			return next.HandleEmail(ctx, email)
+		})
+	}
+}
+
+// Logging logs the outcome of every email handled by next.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, email *Email) error {
+			start := time.Now()
+			err := next.HandleEmail(ctx, email)
+			if err != nil {
+				LogWarning("Handler", fmt.Sprintf("email %s from %s to %d recipient(s) refused after %s: %v",
+					email.ID, email.Envelope.From, len(email.RcptTo), time.Since(start), err))
+			} else {
+				LogInfo("Handler", fmt.Sprintf("email %s from %s to %d recipient(s) accepted in %s",
+					email.ID, email.Envelope.From, len(email.RcptTo), time.Since(start)))
+			}
+			return err
+		})
+	}
+}
+
+// Timing reports how long next took for every email, e.g. to feed a
+// metrics histogram.
+func Timing(observe func(email *Email, elapsed time.Duration, err error)) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, email *Email) error {
+			start := time.Now()
+			err := next.HandleEmail(ctx, email)
+			observe(email, time.Since(start), err)
+			return err
+		})
+	}
+}
+
+// RequireAuth refuses emails from clients that did not authenticate with
+// SMTP AUTH (or XCLIENT LOGIN).
+func RequireAuth() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, email *Email) error {
+			if email.AuthUser == "" {
+				return ErrAuthRequired
+			}
+			return next.HandleEmail(ctx, email)
+		})
+	}
+}
+
+// SPF checks the client address against the SPF record of the envelope
+// sender's domain, or of the HELO name for the null sender (RFC 7208 section
+// 2.3), and records the result in Email.SPFResult; Email.SPF is set for a
+// pass. It passes every email on, whatever the result: Evaluate does not
+// resolve every mechanism, so a fail is not reliable enough to refuse mail.
+func SPF() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, email *Email) error {
+			result, err := checkEnvelopeSPF(ctx, email)
+			if err != nil {
+				LogWarning("SPF", fmt.Sprintf("email %s: %v", email.ID, err))
+			}
+			email.SPFResult = result
+			email.SPF = result == SPFPass
+			return next.HandleEmail(ctx, email)
+		})
+	}
+}
+
+// checkEnvelopeSPF is the check of the SPF middleware. Without a client
+// address or a domain to check, such as a bare hostname or an address
+// literal HELO, the result is none.
+func checkEnvelopeSPF(ctx context.Context, email *Email) (SPFResult, error) {
+	domain := email.Connection.Helo
+	if from := email.Envelope.From; from != "" {
+		domain = from[strings.LastIndexByte(from, '@')+1:]
+	}
+	if email.ClientIP == nil || domain == "" || strings.HasPrefix(domain, "[") || !strings.Contains(domain, ".") {
+		return SPFNone, nil
+	}
+	return NewSPFRecord(domain).Evaluate(ctx, domain, email.ClientIP)
+}
+
+// Filter passes only the emails match accepts on to next. The others are
+// answered with err, or silently accepted and dropped when err is nil.
+func Filter(match func(email *Email) bool, err error) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, email *Email) error {
+			if !match(email) {
+				return err
+			}
+			return next.HandleEmail(ctx, email)
+		})
+	}
+}
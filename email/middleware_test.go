@@ -0,0 +1,149 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The first middleware given to Chain runs outermost.
+func TestChain(t *testing.T) {
+	var calls []string
+	step := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, e *Email) error {
+				calls = append(calls, name)
+				return next.HandleEmail(ctx, e)
+			})
+		}
+	}
+	h := Chain(HandlerFunc(func(context.Context, *Email) error {
+		calls = append(calls, "handler")
+		return nil
+	}), step("first"), step("second"))
+
+	if err := h.HandleEmail(context.Background(), NewEmail()); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(calls, ","); got != "first,second,handler" {
+		t.Errorf("calls = %s, want first,second,handler", got)
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	errRefused := errors.New("refused")
+	var observed error
+	timing := Timing(func(e *Email, elapsed time.Duration, err error) { observed = err })
+
+	tests := []struct {
+		name     string
+		mw       Middleware
+		authUser string
+		nextErr  error
+		wantErr  error
+		wantNext bool
+		wantLog  string
+	}{
+		{name: "logging accepted", mw: Logging(), wantNext: true, wantLog: "accepted in"},
+		{name: "logging refused", mw: Logging(), nextErr: errRefused, wantErr: errRefused, wantNext: true, wantLog: "refused after"},
+		{name: "timing", mw: timing, nextErr: errRefused, wantErr: errRefused, wantNext: true},
+		{name: "require auth", mw: RequireAuth(), wantErr: ErrAuthRequired},
+		{name: "require auth, authenticated", mw: RequireAuth(), authUser: "bob", wantNext: true},
+		{name: "filter match", mw: Filter(func(*Email) bool { return true }, errRefused), wantNext: true},
+		{name: "filter reject", mw: Filter(func(*Email) bool { return false }, errRefused), wantErr: errRefused},
+		{name: "filter drop", mw: Filter(func(*Email) bool { return false }, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			e := NewEmail()
+			e.AuthUser = tt.authUser
+
+			called := false
+			next := HandlerFunc(func(context.Context, *Email) error { called = true; return tt.nextErr })
+			if err := tt.mw(next).HandleEmail(context.Background(), e); err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if called != tt.wantNext {
+				t.Errorf("next called %v, want %v", called, tt.wantNext)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("log = %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+	if observed != errRefused {
+		t.Errorf("Timing observed %v, want %v", observed, errRefused)
+	}
+	if ErrAuthRequired.Code != 530 {
+		t.Errorf("RequireAuth replies %d, want 530", ErrAuthRequired.Code)
+	}
+}
+
+func TestSPFMiddleware(t *testing.T) {
+	queries := stubTXT(t, map[string][]string{
+		"envelope.example": {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"header.example":   {"v=spf1 ip4:198.51.100.0/24 -all"},
+		"mx.relay.example": {"v=spf1 ip4:192.0.2.1/32 -all"},
+	})
+
+	tests := []struct {
+		name         string
+		envelopeFrom string
+		helo         string
+		ip           string
+		query        string
+		result       SPFResult
+	}{
+		{name: "envelope pass", envelopeFrom: "bounces@envelope.example", ip: "192.0.2.7", query: "envelope.example", result: SPFPass},
+		{name: "envelope fail", envelopeFrom: "bounces@envelope.example", ip: "198.51.100.7", query: "envelope.example", result: SPFFail},
+		{name: "null sender uses HELO", helo: "mx.relay.example", ip: "192.0.2.1", query: "mx.relay.example", result: SPFPass},
+		{name: "null sender, HELO fails", helo: "mx.relay.example", ip: "192.0.2.2", query: "mx.relay.example", result: SPFFail},
+		{name: "lookup error", envelopeFrom: "bob@unknown.example", ip: "192.0.2.7", query: "unknown.example", result: SPFTempError},
+		{name: "address literal HELO", helo: "[192.0.2.1]", ip: "192.0.2.1", result: SPFNone},
+		{name: "bare hostname HELO", helo: "localhost", ip: "192.0.2.1", result: SPFNone},
+		{name: "no client address", envelopeFrom: "bounces@envelope.example", helo: "mx.relay.example", result: SPFNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*queries = nil
+			e := NewEmail()
+			// The header From is not what SPF checks.
+			e.From = EmailUser{Email: "bob@header.example"}
+			e.Envelope.From = tt.envelopeFrom
+			e.Connection.Helo = tt.helo
+			e.ClientIP = net.ParseIP(tt.ip)
+
+			// Whatever the result, the email is passed on.
+			called := false
+			next := HandlerFunc(func(context.Context, *Email) error { called = true; return nil })
+			if err := SPF()(next).HandleEmail(context.Background(), e); err != nil || !called {
+				t.Errorf("err = %v, next called %v", err, called)
+			}
+
+			if e.SPFResult != tt.result {
+				t.Errorf("Email.SPFResult = %s, want %s", e.SPFResult, tt.result)
+			}
+			if e.SPF != (tt.result == SPFPass) {
+				t.Errorf("Email.SPF = %v with result %s", e.SPF, e.SPFResult)
+			}
+			want := []string{}
+			if tt.query != "" {
+				want = []string{tt.query}
+			}
+			if len(*queries) != len(want) || (len(want) == 1 && (*queries)[0] != want[0]) {
+				t.Errorf("queries = %v, want %v", *queries, want)
+			}
+		})
+	}
+}
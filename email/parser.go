@@ -11,6 +11,10 @@ import (
 	"strings"
 )
 
+// ErrUnparsable wraps the error of a message that could not be parsed, as
+// reported to Backend.OnFailed and returned by DeadLetters.Redrive.
+var ErrUnparsable = errors.New("message could not be parsed")
+
 func parseHeaders(h map[string][]string) Headers {
 	headers := make(Headers)
 	for k, v := range h {
@@ -351,3 +355,9 @@ func parseEmail(r io.Reader) (*Email, error) {
 
 	return email, nil
 }
+
+// ParseEmail parses a raw message outside of an SMTP session. Session data
+// such as ClientIP is left empty.
+func ParseEmail(r io.Reader) (*Email, error) {
+	return parseEmail(r)
+}
@@ -0,0 +1,89 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// traceHeaders returns the Received header for email, preceded by a
+// Return-Path header when the backend asks for one. eol is the line ending
+// used by the message so the headers blend in.
+func (s *Session) traceHeaders(email *Email, eol string) []byte {
+	var b bytes.Buffer
+	if s.backend != nil && s.backend.ReturnPath {
+		fmt.Fprintf(&b, "Return-Path: <%s>%s", email.Envelope.From, eol)
+	}
+
+	conn := email.Connection
+	b.WriteString("Received: from ")
+	b.WriteString(orUnknown(conn.Helo))
+	switch {
+	case conn.ClientIP != nil && conn.ClientName != "":
+		fmt.Fprintf(&b, " (%s [%s])", conn.ClientName, conn.ClientIP)
+	case conn.ClientIP != nil:
+		fmt.Fprintf(&b, " ([%s])", conn.ClientIP)
+	default:
+		b.WriteString(" (local socket)")
+	}
+	if conn.TLS != nil {
+		fmt.Fprintf(&b, "%s\t(using %s with cipher %s)", eol, conn.TLS.Version, conn.TLS.CipherSuite)
+	}
+
+	fmt.Fprintf(&b, "%s\tby %s (getmail) with %s id %s", eol, orUnknown(s.serverDomain()), s.protocol(conn), email.ID)
+	if len(email.RcptTo) == 1 {
+		fmt.Fprintf(&b, "%s\tfor <%s>", eol, email.RcptTo[0].Email)
+	}
+	fmt.Fprintf(&b, ";%s\t%s%s", eol, email.ReceivedAt.Format(time.RFC1123Z), eol)
+	return b.Bytes()
+}
+
+// protocol returns the "with" keyword of the Received header as registered
+// by RFC 3848, e.g. ESMTPSA for an authenticated session over TLS.
+func (s *Session) protocol(conn Connection) string {
+	proto := "ESMTP"
+	if s.State != nil {
+		if attrs, ok := forwardedAttributes(s.State.Conn()); ok && attrs.Proto != "" {
+			proto = strings.ToUpper(attrs.Proto)
+		}
+		if srv := s.State.Server(); srv != nil && srv.LMTP {
+			proto = "LMTP"
+		}
+	}
+	if proto == "SMTP" {
+		// RFC 3848 has no S or A variants of plain SMTP.
+		return proto
+	}
+	if conn.TLS != nil {
+		proto += "S"
+	}
+	if conn.AuthUser != "" {
+		proto += "A"
+	}
+	return proto
+}
+
+// serverDomain returns the domain the server announces in its greeting.
+func (s *Session) serverDomain() string {
+	if s.State == nil || s.State.Server() == nil {
+		return ""
+	}
+	return s.State.Server().Domain
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// lineEnding returns the line ending used by the message header.
+func lineEnding(raw []byte) string {
+	i := bytes.IndexByte(raw, '\n')
+	if i < 0 || (i > 0 && raw[i-1] == '\r') {
+		return "\r\n"
+	}
+	return "\n"
+}
@@ -0,0 +1,129 @@
+package email
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceHeaders(t *testing.T) {
+	received := time.Date(2026, 3, 4, 5, 6, 7, 0, time.FixedZone("", 3600))
+	tlsState := &TLSState{Version: "TLS 1.3", CipherSuite: "TLS_AES_128_GCM_SHA256"}
+	ip := net.ParseIP("192.0.2.1")
+
+	tests := []struct {
+		name       string
+		conn       Connection
+		rcpts      []EmailUser
+		returnPath bool
+		eol        string
+		want       string
+	}{
+		{
+			name:  "ESMTP",
+			conn:  Connection{Helo: "client.example.org", ClientIP: ip},
+			rcpts: []EmailUser{{Email: "alice@example.com"}},
+			eol:   "\r\n",
+			want: "Received: from client.example.org ([192.0.2.1])\r\n" +
+				"\tby unknown (getmail) with ESMTP id ID\r\n" +
+				"\tfor <alice@example.com>;\r\n" +
+				"\tWed, 04 Mar 2026 05:06:07 +0100\r\n",
+		},
+		{
+			name:  "ESMTPS with rDNS",
+			conn:  Connection{Helo: "client.example.org", ClientIP: ip, ClientName: "mail.example.org", TLS: tlsState},
+			rcpts: []EmailUser{{Email: "alice@example.com"}, {Email: "carol@example.com"}},
+			eol:   "\r\n",
+			want: "Received: from client.example.org (mail.example.org [192.0.2.1])\r\n" +
+				"\t(using TLS 1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n" +
+				"\tby unknown (getmail) with ESMTPS id ID;\r\n" +
+				"\tWed, 04 Mar 2026 05:06:07 +0100\r\n",
+		},
+		{
+			name:  "ESMTPA",
+			conn:  Connection{Helo: "client.example.org", ClientIP: ip, AuthUser: "bob"},
+			rcpts: []EmailUser{{Email: "alice@example.com"}},
+			eol:   "\r\n",
+			want: "Received: from client.example.org ([192.0.2.1])\r\n" +
+				"\tby unknown (getmail) with ESMTPA id ID\r\n" +
+				"\tfor <alice@example.com>;\r\n" +
+				"\tWed, 04 Mar 2026 05:06:07 +0100\r\n",
+		},
+		{
+			name:       "ESMTPSA with Return-Path and LF",
+			conn:       Connection{Helo: "client.example.org", ClientIP: ip, AuthUser: "bob", TLS: tlsState},
+			rcpts:      []EmailUser{{Email: "alice@example.com"}},
+			returnPath: true,
+			eol:        "\n",
+			want: "Return-Path: <bob@example.org>\n" +
+				"Received: from client.example.org ([192.0.2.1])\n" +
+				"\t(using TLS 1.3 with cipher TLS_AES_128_GCM_SHA256)\n" +
+				"\tby unknown (getmail) with ESMTPSA id ID\n" +
+				"\tfor <alice@example.com>;\n" +
+				"\tWed, 04 Mar 2026 05:06:07 +0100\n",
+		},
+		{
+			name:  "unix socket without HELO",
+			conn:  Connection{},
+			rcpts: []EmailUser{{Email: "alice@example.com"}},
+			eol:   "\r\n",
+			want: "Received: from unknown (local socket)\r\n" +
+				"\tby unknown (getmail) with ESMTP id ID\r\n" +
+				"\tfor <alice@example.com>;\r\n" +
+				"\tWed, 04 Mar 2026 05:06:07 +0100\r\n",
+		},
+	}
+	for _, tt := range tests {
+		s := &Session{backend: &Backend{ReturnPath: tt.returnPath}}
+		e := &Email{
+			ID:         "ID",
+			ReceivedAt: received,
+			Connection: tt.conn,
+			Envelope:   Envelope{From: "bob@example.org"},
+			RcptTo:     tt.rcpts,
+		}
+		if got := string(s.traceHeaders(e, tt.eol)); got != tt.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The Received header names the server and the protocol of the listener.
+func TestTraceHeadersSession(t *testing.T) {
+	raws := make(chan []byte, 1)
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		raw, _ := io.ReadAll(e.Raw)
+		raws <- raw
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	raw := string(<-raws)
+	want := "Received: from client.example.org ([127.0.0.1])\r\n\tby mx.example.com (getmail) with ESMTP id "
+	if !strings.HasPrefix(raw, want) || !strings.HasSuffix(raw, "\r\n"+strings.TrimSuffix(testMessage, ".\r\n")) {
+		t.Errorf("raw message:\n%s", raw)
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	for raw, want := range map[string]string{
+		"Subject: x\r\n\r\nbody\r\n": "\r\n",
+		"Subject: x\n\nbody\n":       "\n",
+		"\nbody":                     "\n",
+		"Subject: x":                 "\r\n",
+	} {
+		if got := lineEnding([]byte(raw)); got != want {
+			t.Errorf("lineEnding(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
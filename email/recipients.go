@@ -0,0 +1,143 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	// ErrUnknownRecipient is returned by RCPT for addresses the registry
+	// does not know.
+	ErrUnknownRecipient = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Recipient address rejected: User unknown",
+	}
+
+	// ErrRelayDenied is returned by RCPT for addresses outside the trusted
+	// domains.
+	ErrRelayDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Relaying denied: recipient domain not accepted here",
+	}
+
+	errRecipientLookup = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Recipient lookup failed, try again later",
+	}
+)
+
+// SubaddressSeparator splits the mailbox from the tag in user+tag@domain.
+const SubaddressSeparator = "+"
+
+// RecipientRegistry decides which recipients are accepted.
+type RecipientRegistry interface {
+	// LookupRecipient reports whether mail for address is accepted. The
+	// address has its subaddress tag removed. An error defers the
+	// recipient with a temporary failure. ctx is canceled when the session
+	// ends, so lookups against remote directories should honor it.
+	LookupRecipient(ctx context.Context, address string) (bool, error)
+}
+
+// StaticRecipients is a RecipientRegistry backed by a file with one pattern
+// per line:
+//
+//	alice@example.com      exact mailbox
+//	*@example.com          catch-all for a domain
+//	*@*.example.com        any mailbox at any subdomain of example.com
+//	alice@*.example.com    one mailbox at any subdomain
+//
+// Matching ignores case. Blank lines and lines starting with # are ignored.
+// The file is re-read when it changes.
+type StaticRecipients struct {
+	Path string
+
+	file watchedFile[map[string]struct{}]
+}
+
+// NewStaticRecipients loads the recipients file at path.
+func NewStaticRecipients(path string) (*StaticRecipients, error) {
+	r := &StaticRecipients{Path: path}
+	if _, err := r.patterns(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LookupRecipient reports whether a pattern in the file matches address.
+func (r *StaticRecipients) LookupRecipient(ctx context.Context, address string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	patterns, err := r.patterns()
+	if err != nil {
+		// Keep serving the last good copy of the file.
+		LogError("StaticRecipients", err)
+	}
+
+	local, domain, ok := strings.Cut(strings.ToLower(address), "@")
+	if !ok {
+		return false, nil
+	}
+
+	for _, l := range []string{local, "*"} {
+		if _, ok := patterns[l+"@"+domain]; ok {
+			return true, nil
+		}
+		// Walk up the parent domains for subdomain wildcards.
+		parent := domain
+		for {
+			_, rest, found := strings.Cut(parent, ".")
+			if !found || rest == "" {
+				break
+			}
+			if _, ok := patterns[l+"@*."+rest]; ok {
+				return true, nil
+			}
+			parent = rest
+		}
+	}
+	return false, nil
+}
+
+// patterns returns the patterns of the file, reading it again if it
+// changed.
+func (r *StaticRecipients) patterns() (map[string]struct{}, error) {
+	patterns, err := r.file.load(r.Path, func(data []byte) (map[string]struct{}, error) {
+		patterns := make(map[string]struct{})
+		err := eachLine(data, func(n int, line string) error {
+			local, domain, ok := strings.Cut(line, "@")
+			if !ok || local == "" || domain == "" || strings.Contains(domain, "@") {
+				return fmt.Errorf("%s:%d: expected mailbox@domain, *@domain or *@*.domain", r.Path, n)
+			}
+			if strings.Contains(strings.TrimPrefix(domain, "*."), "*") || (strings.Contains(local, "*") && local != "*") {
+				return fmt.Errorf("%s:%d: unsupported wildcard in %q", r.Path, n, line)
+			}
+			patterns[strings.ToLower(line)] = struct{}{}
+			return nil
+		})
+		return patterns, err
+	})
+	if err != nil {
+		return patterns, fmt.Errorf("recipients: %w", err)
+	}
+	return patterns, nil
+}
+
+// splitSubaddress splits user+tag@domain into user@domain and tag.
+func splitSubaddress(address string) (string, string) {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return address, ""
+	}
+	mailbox, tag, ok := strings.Cut(local, SubaddressSeparator)
+	if !ok || mailbox == "" {
+		return address, ""
+	}
+	return mailbox + "@" + domain, tag
+}
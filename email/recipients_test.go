@@ -0,0 +1,122 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// registryFunc adapts a function to the RecipientRegistry interface.
+type registryFunc func(ctx context.Context, address string) (bool, error)
+
+func (f registryFunc) LookupRecipient(ctx context.Context, address string) (bool, error) {
+	return f(ctx, address)
+}
+
+func TestStaticRecipients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recipients")
+	err := os.WriteFile(path, []byte("# comment\n\nAlice@Example.com\n*@catchall.example\n*@*.sub.example\nbob@*.dept.example\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStaticRecipients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for address, want := range map[string]bool{
+		"alice@example.com":         true,
+		"ALICE@EXAMPLE.COM":         true,
+		"carol@example.com":         false,
+		"anyone@catchall.example":   true,
+		"anyone@a.catchall.example": false,
+		"anyone@a.sub.example":      true,
+		"anyone@a.b.sub.example":    true,
+		"anyone@sub.example":        false,
+		"bob@sales.dept.example":    true,
+		"carol@sales.dept.example":  false,
+		"no-domain":                 false,
+	} {
+		got, err := r.LookupRecipient(context.Background(), address)
+		if err != nil || got != want {
+			t.Errorf("LookupRecipient(%q) = %v, %v, want %v", address, got, err, want)
+		}
+	}
+}
+
+func TestStaticRecipientsCanceled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recipients")
+	if err := os.WriteFile(path, []byte("alice@example.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewStaticRecipients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if ok, err := r.LookupRecipient(ctx, "alice@example.com"); ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("LookupRecipient = %v, %v, want context.Canceled", ok, err)
+	}
+}
+
+func TestStaticRecipientsInvalid(t *testing.T) {
+	for _, line := range []string{"alice", "@example.com", "alice@", "a*@example.com", "alice@ex*.com"} {
+		path := filepath.Join(t.TempDir(), "recipients")
+		if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewStaticRecipients(path); err == nil {
+			t.Errorf("NewStaticRecipients accepted %q", line)
+		}
+	}
+}
+
+// The registry gets the subaddress-free mailbox and the session's context,
+// which ends with the session.
+func TestSessionRecipientLookup(t *testing.T) {
+	lookups := make(chan context.Context, 1)
+	bkd := &Backend{Recipients: registryFunc(func(ctx context.Context, address string) (bool, error) {
+		lookups <- ctx
+		return address == "alice@example.com", nil
+	})}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice+news@example.com>", "250 ")
+	ctx := <-lookups
+	c.Cmd("RCPT TO:<carol@example.com>", "550 5.1.1 ")
+	<-lookups
+
+	if ctx.Err() != nil {
+		t.Fatalf("context done during the session: %v", ctx.Err())
+	}
+	c.Cmd("QUIT", "221 ")
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("context not canceled after QUIT")
+	}
+}
+
+// Recipients outside the trusted domains are refused for good, before the
+// registry is asked.
+func TestSessionTrustedDomains(t *testing.T) {
+	bkd := &Backend{
+		TrustedDomains: []string{"example.com"},
+		Recipients: registryFunc(func(ctx context.Context, address string) (bool, error) {
+			return address != "alice@example.com", nil
+		}),
+	}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<carol@other.example>", "550 5.7.1 Relaying denied")
+	c.Cmd("RCPT TO:<carol@Example.COM>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "550 5.1.1 ")
+}
@@ -1,9 +1,14 @@
 package email
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-smtp"
 )
@@ -13,23 +18,66 @@ type Session struct {
 	State *smtp.Conn
 
 	TrustedDomains []string
+	Policy         Policy
+
+	AuthUser string // Identity established with SMTP AUTH, empty if none
 
 	From   EmailUser
 	RcptTo []EmailUser
 
-	Email *Email // Current email being processed
+	Email *Email // Email being delivered, nil between transactions
 
-	OnEmailReceived func(email *Email)
+	Handler         Handler
+	OnEmailReceived func(email *Email) // Used when Handler is nil
 	OnEmailFailed   func(from EmailUser, to []EmailUser, raw io.Reader, err error)
+	OnFailed        func(email *Email, err error) // Used instead of OnEmailFailed when set
+
+	backend  *Backend
+	ctx      context.Context // canceled by Logout
+	cancel   context.CancelFunc
+	started  time.Time
+	envelope Envelope
+	dnsbl    *DNSBLResult
+	dnsblErr error
+	dnsblIP  net.IP     // address dnsbl was looked up for
+	mu       sync.Mutex // guards the envelope fields read by Backend.Report
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.backend != nil && s.backend.Draining() {
+		return ErrShuttingDown
+	}
+	if s.Policy.RequireAuth && s.authUser() == "" {
+		return ErrAuthRequired
+	}
+
 	eu, err := parseEmailUser(from)
 	if err != nil {
 		return fmt.Errorf("Mail: failed to parse sender '%s': %w", from, err)
 	}
 
+	if limiter := s.limiter(); limiter != nil {
+		if err := limiter.Message(s.clientIP()); err != nil {
+			LogWarning("SMTP:Mail", fmt.Sprintf("rejecting %s from %s: %v", from, s.clientIP(), err))
+			return err
+		}
+	}
+
+	if err := s.checkDNSBL(); err != nil {
+		return err
+	}
+
+	if s.backend != nil && s.backend.OnMail != nil {
+		if err := s.backend.OnMail(s.context(), s.connection(), eu, opts); err != nil {
+			LogInfo("SMTP:Mail", fmt.Sprintf("OnMail refused %s: %v", from, err))
+			return replyError(err, errTemporaryFailure)
+		}
+	}
+
+	s.mu.Lock()
 	s.From = eu
+	s.envelope = Envelope{From: eu.Email, Params: newMailParams(opts), MailAt: time.Now()}
+	s.mu.Unlock()
 	return nil
 }
 
@@ -42,53 +90,316 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	// If TrustedDomains is set, only allow recipients in those domains
 	if len(s.TrustedDomains) > 0 {
 		if domain, ok := eu.HasDomain(s.TrustedDomains); !ok {
-			return fmt.Errorf("Mail: sender domain '%s' is not a valid domain", domain)
+			LogInfo("SMTP:Rcpt", fmt.Sprintf("rejecting %s: domain %q is not trusted", eu.Email, domain))
+			return ErrRelayDenied
+		}
+	}
+
+	var mailbox string
+	mailbox, eu.Tag = splitSubaddress(eu.Email)
+	if s.backend != nil && s.backend.Recipients != nil {
+		ok, err := s.backend.Recipients.LookupRecipient(s.context(), mailbox)
+		if err != nil {
+			LogError("SMTP:Rcpt", fmt.Errorf("recipient lookup for %s: %w", to, err))
+			return errRecipientLookup
+		}
+		if !ok {
+			LogInfo("SMTP:Rcpt", fmt.Sprintf("rejecting unknown recipient %s", eu.Email))
+			return ErrUnknownRecipient
+		}
+	}
+
+	// Authenticated clients are not greylisted.
+	if s.backend != nil && s.backend.Greylist != nil && s.authUser() == "" {
+		if err := s.backend.Greylist.Check(s.clientIP(), s.From.Email, eu.Email); err != nil {
+			LogInfo("SMTP:Rcpt", fmt.Sprintf("greylisted %s -> %s from %s", s.From.Email, eu.Email, s.clientIP()))
+			return err
+		}
+	}
+
+	if s.backend != nil && s.backend.OnRcpt != nil {
+		if err := s.backend.OnRcpt(s.context(), s.connection(), eu, opts); err != nil {
+			LogInfo("SMTP:Rcpt", fmt.Sprintf("OnRcpt refused %s: %v", to, err))
+			return replyError(err, errTemporaryFailure)
+		}
+	}
+
+	// Only recipients that are accepted count against the sender's quota.
+	if limiter := s.limiter(); limiter != nil {
+		sender := s.authUser()
+		if sender == "" {
+			sender = s.From.Email
+		}
+		if err := limiter.Recipient(s.clientIP(), sender); err != nil {
+			LogWarning("SMTP:Rcpt", fmt.Sprintf("rejecting %s for sender %q: %v", to, sender, err))
+			return err
 		}
 	}
 
+	s.mu.Lock()
 	s.RcptTo = append(s.RcptTo, eu)
+	s.envelope.Recipients = append(s.envelope.Recipients, newRcptParams(eu.Email, opts))
+	s.mu.Unlock()
 	return nil
 }
 
+// Data parses the message and delivers it before replying, so every
+// transaction of a session is handed over on its own and the handler's
+// verdict is the reply the client gets.
 func (s *Session) Data(r io.Reader) error {
-	email, err := parseEmail(r)
+	email, err := s.readEmail(r)
 	if err != nil {
-		LogWarning("SMTP:Data", fmt.Sprintf("error parsing email: %v", err))
-		if s.OnEmailFailed != nil {
-			s.OnEmailFailed(s.From, s.RcptTo, r, err)
-		}
-		return fmt.Errorf("Data: failed to parse email: %w", err)
-	}
-	var clientIP net.IP
-	if s.State != nil && s.State.Conn() != nil {
-		clientAddr := s.State.Conn().RemoteAddr().String()
-		host, _, _ := net.SplitHostPort(clientAddr)
-		clientIP = net.ParseIP(host)
+		return err
 	}
-	email.ClientIP = clientIP
-	email.RcptTo = s.RcptTo
 
+	s.setEmail(email)
+	defer s.setEmail(nil)
+
+	return replyError(s.deliver(email), errDeliveryFailed)
+}
+
+// setEmail records the email being delivered, which shows the session as
+// busy in a DrainReport.
+func (s *Session) setEmail(email *Email) {
+	s.mu.Lock()
 	s.Email = email
+	s.mu.Unlock()
+}
 
-	return nil
+// readEmail parses the message sent with DATA and attaches the session data
+// to it. The trace headers for this hop are prepended to Email.Raw.
+func (s *Session) readEmail(r io.Reader) (*Email, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Data: failed to read email: %w", err)
+	}
+
+	s.mu.Lock()
+	rcptTo, params := s.RcptTo, s.envelope.Recipients
+	s.mu.Unlock()
+	return s.newEmail(raw, rcptTo, params)
+}
+
+// newEmail parses raw as readEmail does, addressed to rcptTo, whose RCPT
+// parameters are params.
+func (s *Session) newEmail(raw []byte, rcptTo []EmailUser, params []RcptParams) (*Email, error) {
+	email, err := parseEmail(bytes.NewReader(raw))
+	if err != nil {
+		LogWarning("SMTP:Data", fmt.Sprintf("error parsing email: %v", err))
+		failed := NewEmail()
+		s.attach(failed, raw, rcptTo, params)
+		s.reportFailure(failed, fmt.Errorf("%w: %w", ErrUnparsable, err))
+		return nil, fmt.Errorf("Data: failed to parse email: %w", err)
+	}
+	s.attach(email, raw, rcptTo, params)
+	return email, nil
 }
 
-func (s *Session) Reset() {}
+// attach sets the session data on email and addresses it.
+func (s *Session) attach(email *Email, raw []byte, rcptTo []EmailUser, params []RcptParams) {
+	email.Connection = s.connection()
+	email.ClientIP = email.Connection.ClientIP
+	email.AuthUser = email.Connection.AuthUser
+	email.Envelope = s.envelope
+	email.Envelope.DataAt = time.Now()
+	email.DNSBL = s.dnsbl
+	s.address(email, raw, rcptTo, params)
+}
+
+// address sets the recipients of email and its Raw, the message raw below
+// the trace headers for those recipients.
+func (s *Session) address(email *Email, raw []byte, rcptTo []EmailUser, params []RcptParams) {
+	email.RcptTo = slices.Clone(rcptTo)
+	email.Envelope.Recipients = slices.Clone(params)
+
+	trace := s.traceHeaders(email, lineEnding(raw))
+	email.Raw = bytes.NewReader(append(trace, raw...))
+}
+
+// Reset clears the envelope after RSET, a repeated EHLO or the end of a
+// transaction.
+func (s *Session) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.From = EmailUser{}
+	s.RcptTo = nil
+	s.envelope = Envelope{}
+	s.Email = nil
+}
 
 func (s *Session) Logout() error {
-	// recover from panic if OnEmailReceived panics
-	defer func() {
-		if r := recover(); r != nil {
-			LogError("SMTP:Logout", fmt.Errorf("panic in OnEmailReceived: %v", r))
-			// Optionally, you could also call OnEmailFailed here
-			if s.OnEmailFailed != nil && s.Email != nil {
-				s.OnEmailFailed(s.From, s.RcptTo, s.Email.Raw, fmt.Errorf("panic in OnEmailReceived: %v", r))
-			}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.backend != nil {
+		s.backend.endSession(s)
+	}
+	return nil
+}
+
+// deliver hands email to the Handler, or to OnEmailReceived when no Handler
+// is set, and waits until it returns or its deadline passes. A handler that
+// outlives its deadline keeps running in the background, but the client is
+// answered with a temporary failure. A panic in the handler is recovered,
+// reported to OnFailed or OnEmailFailed and returned as an error.
+func (s *Session) deliver(email *Email) error {
+	handler := s.Handler
+	if handler == nil {
+		if s.OnEmailReceived == nil {
+			return nil
+		}
+		handler = CallbackHandler(s.OnEmailReceived)
+	}
+
+	// The handler runs on its own goroutine, where a panic would take the
+	// whole server down.
+	handler = Recover(s.reportFailure)(handler)
+
+	ctx, cancel := s.handlerContext()
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+
+		handle := func() { err = handler.HandleEmail(ctx, email) }
+		if s.backend != nil {
+			s.backend.runHandler(email.ID, handle)
+		} else {
+			handle()
 		}
 	}()
 
-	if s.OnEmailReceived != nil && s.Email != nil {
-		s.OnEmailReceived(s.Email)
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("handler did not return: %w", ctx.Err())
 	}
-	return nil
+	if err != nil {
+		LogWarning("SMTP:Deliver", fmt.Sprintf("handler refused email %s: %v", email.ID, err))
+	}
+	return err
+}
+
+// reportFailure hands an email that could not be processed to OnFailed, or
+// to OnEmailFailed when OnFailed is nil, rewinding the raw message in case
+// the handler had read part of it.
+func (s *Session) reportFailure(email *Email, err error) {
+	if s.OnFailed == nil && s.OnEmailFailed == nil {
+		return
+	}
+	if seeker, ok := email.Raw.(io.Seeker); ok {
+		seeker.Seek(0, io.SeekStart)
+	}
+	if s.OnFailed != nil {
+		s.OnFailed(email, err)
+		return
+	}
+	s.OnEmailFailed(EmailUser{Email: email.Envelope.From}, email.RcptTo, email.Raw, err)
+}
+
+// context returns the session's context, which is canceled when the client
+// disconnects or the server closes the session.
+func (s *Session) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// handlerContext returns the context for one handler call, bounded by the
+// backend's HandlerTimeout.
+func (s *Session) handlerContext() (context.Context, context.CancelFunc) {
+	if s.backend != nil && s.backend.HandlerTimeout > 0 {
+		return context.WithTimeout(s.context(), s.backend.HandlerTimeout)
+	}
+	return context.WithCancel(s.context())
+}
+
+// checkDNSBL looks up the client in the backend's blocklists, once per
+// client address. Authenticated clients are not looked up.
+func (s *Session) checkDNSBL() error {
+	if s.backend == nil || s.backend.DNSBL == nil || s.authUser() != "" {
+		return nil
+	}
+
+	ip := s.clientIP()
+	if ip == nil {
+		return nil
+	}
+	if s.dnsbl == nil || !ip.Equal(s.dnsblIP) {
+		s.dnsbl, s.dnsblErr = s.backend.DNSBL.Check(s.context(), ip)
+		s.dnsblIP = ip
+	}
+	return s.dnsblErr
+}
+
+// clientIP returns the address of the client, or of the original client
+// reported by a trusted relay.
+func (s *Session) clientIP() net.IP {
+	if s.State == nil || s.State.Conn() == nil {
+		return nil
+	}
+	if attrs, ok := forwardedAttributes(s.State.Conn()); ok && attrs.Addr != nil {
+		return attrs.Addr
+	}
+	return remoteIP(s.State.Conn())
+}
+
+// remoteIP returns the IP address of the peer of conn, or nil for non-IP
+// connections such as unix sockets.
+func remoteIP(conn net.Conn) net.IP {
+	if conn == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// limiter returns the backend's Limiter, or nil when limits are off.
+func (s *Session) limiter() *Limiter {
+	if s.backend == nil {
+		return nil
+	}
+	return s.backend.Limiter
+}
+
+// authUser returns the SMTP AUTH identity, or the login a trusted relay
+// reported with XCLIENT. Either one exempts the session from RequireAuth,
+// greylisting and DNSBL checks.
+func (s *Session) authUser() string {
+	if s.AuthUser != "" {
+		return s.AuthUser
+	}
+	if s.State != nil {
+		if attrs, ok := forwardedAttributes(s.State.Conn()); ok {
+			return attrs.Login
+		}
+	}
+	return ""
+}
+
+// info returns a snapshot of the session for shutdown reports.
+func (s *Session) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := SessionInfo{
+		From:       s.From.Email,
+		Recipients: len(s.RcptTo),
+		Pending:    s.Email != nil,
+	}
+	if s.State != nil {
+		info.Hostname = s.State.Hostname()
+		if conn := s.State.Conn(); conn != nil {
+			info.RemoteAddr = conn.RemoteAddr().String()
+		}
+	}
+	return info
 }
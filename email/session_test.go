@@ -0,0 +1,282 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/internal/smtptest"
+	"github.com/emersion/go-smtp"
+)
+
+const testMessage = "From: Bob <bob@example.org>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi\r\n" +
+	".\r\n"
+
+// testEmail parses raw and adds the session data an SMTP session records,
+// as handlers get it.
+func testEmail(t *testing.T, raw string) *Email {
+	t.Helper()
+	e, err := parseEmail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	e.ReceivedAt = received
+	e.ClientIP = net.ParseIP("2001:db8::25")
+	e.AuthUser = "bob"
+	e.RcptTo = []EmailUser{{Email: "alice+reports@example.com", Tag: "reports"}}
+	e.Connection = Connection{
+		Listener:   "submission",
+		RemoteAddr: "[2001:db8::25]:41234",
+		ClientIP:   e.ClientIP,
+		ClientName: "client.example.org",
+		Helo:       "client.example.org",
+		AuthUser:   "bob",
+		TLS:        &TLSState{Version: "TLS 1.3", CipherSuite: "TLS_AES_128_GCM_SHA256", ServerName: "mx.example.com"},
+		StartedAt:  received.Add(-time.Second),
+	}
+	e.Envelope = Envelope{
+		From:       "bounces@example.org",
+		Params:     MailParams{Size: 1234, Body: "8BITMIME", Ret: "HDRS", EnvID: "abc"},
+		Recipients: []RcptParams{{Address: "alice+reports@example.com", Notify: []string{"FAILURE", "DELAY"}, ORcpt: "rfc822;alice@example.com"}},
+		MailAt:     received.Add(-500 * time.Millisecond),
+		DataAt:     received,
+	}
+	e.SPF = true
+	e.SPFResult = SPFPass
+	e.DNSBL = &DNSBLResult{Matches: []DNSBLMatch{{Zone: "bl.example", Weight: 2, Answers: []string{"127.0.0.2"}}}, Score: 2}
+	return e
+}
+
+// dialBackend serves bkd on a loopback port and connects to it; lmtp
+// switches the server to LMTP. The greeting has been read when it returns.
+func dialBackend(t *testing.T, bkd *Backend, lmtp bool) *smtptest.Client {
+	t.Helper()
+
+	s := smtp.NewServer(bkd)
+	s.Domain = "mx.example.com"
+	s.LMTP = lmtp
+	s.AllowInsecureAuth = true // loopback, no TLS
+	s.EnableSMTPUTF8 = true
+	s.EnableDSN = true
+	return smtptest.Serve(t, s, smtptest.Listen(t))
+}
+
+// Greylisted recipients must not use up the sender's recipient quota.
+func TestRcptQuotaCountsAcceptedOnly(t *testing.T) {
+	greylist, err := NewGreylist("", time.Hour, 4*time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := NewLimiter(Limits{RecipientsPerHour: 2})
+	bkd := &Backend{Greylist: greylist, Limiter: limiter}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	for range 5 {
+		c.Cmd("RCPT TO:<alice@example.com>", "451 ")
+	}
+
+	for range 2 {
+		if err := limiter.Recipient(net.ParseIP("127.0.0.1"), "bob@example.org"); err != nil {
+			t.Fatalf("quota used up by greylisted recipients: %v", err)
+		}
+	}
+}
+
+// Recipients refused by OnRcpt must not use up the quota either, while
+// accepted ones do.
+func TestRcptQuotaAfterOnRcpt(t *testing.T) {
+	limiter := NewLimiter(Limits{RecipientsPerHour: 2})
+	bkd := &Backend{
+		Limiter: limiter,
+		OnRcpt: func(_ context.Context, _ Connection, to EmailUser, _ *smtp.RcptOptions) error {
+			if strings.HasPrefix(to.Email, "nobody@") {
+				return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+			}
+			return nil
+		},
+	}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	for range 3 {
+		c.Cmd("RCPT TO:<nobody@example.com>", "550 ")
+	}
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("RCPT TO:<carol@example.com>", "250 ")
+	c.Cmd("RCPT TO:<dave@example.com>", "450 4.7.1 ")
+}
+
+// Each DATA is delivered on its own, and the next transaction starts from
+// an empty envelope.
+func TestSessionTransactions(t *testing.T) {
+	emails := make(chan *Email, 2)
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		emails <- e
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org> SIZE=100 RET=HDRS ENVID=first", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com> NOTIFY=FAILURE", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	c.Cmd("MAIL FROM:<carol@example.org>", "250 ")
+	c.Cmd("RCPT TO:<dave@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	first, second := <-emails, <-emails
+	if first.Envelope.From != "bob@example.org" || len(first.RcptTo) != 1 || first.RcptTo[0].Email != "alice@example.com" {
+		t.Errorf("first email: from %s to %v", first.Envelope.From, first.RcptTo)
+	}
+	if second.Envelope.From != "carol@example.org" || len(second.RcptTo) != 1 || second.RcptTo[0].Email != "dave@example.com" {
+		t.Errorf("second email: from %s to %v", second.Envelope.From, second.RcptTo)
+	}
+	if second.Envelope.Params != (MailParams{}) {
+		t.Errorf("second email kept the MAIL parameters: %+v", second.Envelope.Params)
+	}
+	if len(second.Envelope.Recipients) != 1 || second.Envelope.Recipients[0].Notify != nil {
+		t.Errorf("second email kept the RCPT parameters: %+v", second.Envelope.Recipients)
+	}
+	if first.ID == second.ID {
+		t.Errorf("both emails have ID %s", first.ID)
+	}
+
+	// The delivered transaction is over.
+	c.Cmd("DATA", "502 5.5.1 Missing RCPT")
+}
+
+// RSET drops the sender, the recipients and their parameters.
+func TestSessionReset(t *testing.T) {
+	emails := make(chan *Email, 1)
+	bkd := &Backend{Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+		emails <- e
+		return nil
+	})}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org> SIZE=100 ENVID=dropped", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com> NOTIFY=SUCCESS ORCPT=rfc822;alice@example.com", "250 ")
+	c.Cmd("RSET", "250 ")
+	if report := bkd.Report(); len(report.Sessions) != 1 || report.Sessions[0].From != "" || report.Sessions[0].Recipients != 0 {
+		t.Errorf("envelope after RSET: %+v", report.Sessions)
+	}
+	c.Cmd("RCPT TO:<carol@example.com>", "502 5.5.1 Missing MAIL FROM")
+
+	c.Cmd("MAIL FROM:<carol@example.org>", "250 ")
+	c.Cmd("RCPT TO:<dave@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	e := <-emails
+	if e.Envelope.From != "carol@example.org" || len(e.RcptTo) != 1 || e.RcptTo[0].Email != "dave@example.com" {
+		t.Errorf("after RSET: from %s to %v", e.Envelope.From, e.RcptTo)
+	}
+	if e.Envelope.Params != (MailParams{}) || len(e.Envelope.Recipients) != 1 || !reflect.DeepEqual(e.Envelope.Recipients[0], RcptParams{Address: "dave@example.com"}) {
+		t.Errorf("parameters after RSET: %+v", e.Envelope)
+	}
+}
+
+// OnMail sees the sender, its parameters and the client, and its error is
+// the reply to MAIL.
+func TestMailHook(t *testing.T) {
+	type call struct {
+		conn Connection
+		from EmailUser
+		size int64
+	}
+	calls := make(chan call, 3)
+	bkd := &Backend{OnMail: func(ctx context.Context, conn Connection, from EmailUser, opts *smtp.MailOptions) error {
+		calls <- call{conn, from, opts.Size}
+		switch from.Email {
+		case "spam@example.org":
+			return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sender blocked"}
+		case "slow@example.org":
+			return errors.New("reputation service down")
+		}
+		return nil
+	}}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<spam@example.org>", "550 5.7.1 Sender blocked")
+	c.Cmd("MAIL FROM:<slow@example.org>", "451 4.3.0 ")
+	c.Cmd("MAIL FROM:<bob@example.org> SIZE=42", "250 ")
+
+	for _, want := range []string{"spam@example.org", "slow@example.org", "bob@example.org"} {
+		got := <-calls
+		if got.from.Email != want || got.conn.Helo != "client.example.org" || !got.conn.ClientIP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("call for %s: %+v", want, got)
+		}
+		if want == "bob@example.org" && got.size != 42 {
+			t.Errorf("SIZE = %d, want 42", got.size)
+		}
+	}
+
+	// A refused sender leaves no transaction behind; the accepted one does.
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+}
+
+// OnRcpt sees each recipient; refused ones are not part of the message.
+func TestRcptHook(t *testing.T) {
+	emails := make(chan *Email, 1)
+	bkd := &Backend{
+		Handler: HandlerFunc(func(ctx context.Context, e *Email) error {
+			emails <- e
+			return nil
+		}),
+		OnRcpt: func(ctx context.Context, conn Connection, to EmailUser, opts *smtp.RcptOptions) error {
+			switch to.Email {
+			case "gone@example.com":
+				return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+			case "full@example.com":
+				return &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+			case "db@example.com":
+				return errors.New("database unavailable")
+			}
+			return nil
+		},
+	}
+
+	c := dialBackend(t, bkd, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<gone@example.com>", "550 5.1.1 No such user")
+	c.Cmd("RCPT TO:<full@example.com>", "452 4.2.2 Mailbox full")
+	c.Cmd("RCPT TO:<db@example.com>", "451 4.3.0 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+
+	if e := <-emails; len(e.RcptTo) != 1 || e.RcptTo[0].Email != "alice@example.com" {
+		t.Errorf("RcptTo = %v", e.RcptTo)
+	}
+}
+
+// Without hooks every sender and recipient is accepted.
+func TestNilHooks(t *testing.T) {
+	c := dialBackend(t, &Backend{}, false)
+	c.Cmd("EHLO client.example.org", "250")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+}
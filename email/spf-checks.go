@@ -1,13 +1,17 @@
 package email
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strings"
+	"time"
 )
 
-// IpRange holds IPv4 and IPv6 CIDR ranges.
+// SPFRecord checks addresses against the SPF record of Domain. Add and
+// CheckIfContains keep a set of networks for callers that collect them
+// themselves; Evaluate and the checks built on it don't use that set.
 type SPFRecord struct {
 	Domain string
 	ipv4   *map[string]struct{}
@@ -22,6 +26,7 @@ func NewSPFRecord(domain string) *SPFRecord {
 	}
 }
 
+// Add adds ip4 and ip6 networks to the set.
 func (r *SPFRecord) Add(ipv4 []string, ipv6 []string) {
 	for _, ip := range ipv4 {
 		(*r.ipv4)[ip] = struct{}{}
@@ -31,6 +36,8 @@ func (r *SPFRecord) Add(ipv4 []string, ipv6 []string) {
 	}
 }
 
+// CheckIfContains reports whether ip is in one of the networks added with
+// Add.
 func (r *SPFRecord) CheckIfContains(ip net.IP) bool {
 	for cidr := range *r.ipv4 {
 		if _, ipnet, err := net.ParseCIDR(cidr); err == nil && ipnet.Contains(ip) {
@@ -45,89 +52,139 @@ func (r *SPFRecord) CheckIfContains(ip net.IP) bool {
 	return false
 }
 
+// lookupTXT resolves the TXT records of SPF lookups; tests replace it.
+var lookupTXT = net.DefaultResolver.LookupTXT
+
+// SPFTimeout bounds the DNS lookups of CheckSPF and Email.VerifySPF, which
+// take no context.
+const SPFTimeout = 10 * time.Second
+
+// CheckSPF is CheckSPFContext with a timeout of SPFTimeout.
 func (r *SPFRecord) CheckSPF(domain string, ip net.IP) (bool, error) {
-	err := r.fetchSPFNetworks(domain, make(map[string]struct{}))
+	ctx, cancel := context.WithTimeout(context.Background(), SPFTimeout)
+	defer cancel()
+	return r.CheckSPFContext(ctx, domain, ip)
+}
+
+// CheckSPFContext reports whether ip is allowed to send for domain, that is
+// whether Evaluate passes it. A temperror or permerror is returned as an
+// error; any other result is false. The lookups stop when ctx is done.
+func (r *SPFRecord) CheckSPFContext(ctx context.Context, domain string, ip net.IP) (bool, error) {
+	result, err := r.Evaluate(ctx, domain, ip)
 	if err != nil {
-		return false, fmt.Errorf("error fetching SPF records: %w", err)
+		return false, fmt.Errorf("SPF %s: %w", result, err)
 	}
-	return r.CheckIfContains(ip), nil
+	return result == SPFPass, nil
 }
 
-// fetchSPFNetworks recursively fetches and resolves SPF records for a domain.
-func (r *SPFRecord) fetchSPFNetworks(domain string, visited map[string]struct{}) error {
+// SPFResult is the outcome of an SPF evaluation (RFC 7208 section 2.6).
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"      // No domain to check, or it has no SPF record
+	SPFNeutral   SPFResult = "neutral"   // The record makes no assertion about the client
+	SPFPass      SPFResult = "pass"      // The client is allowed to send for the domain
+	SPFFail      SPFResult = "fail"      // The client is not allowed ("-all")
+	SPFSoftFail  SPFResult = "softfail"  // The client is probably not allowed ("~all")
+	SPFTempError SPFResult = "temperror" // A DNS lookup failed, try again later
+	SPFPermError SPFResult = "permerror" // The record is broken, e.g. an include loop
+)
+
+// Evaluate resolves the SPF record of domain and evaluates its mechanisms
+// for ip in order, following includes and redirects. Only the ip4, ip6,
+// include and all mechanisms are evaluated: when the record reaches an a,
+// mx, ptr or exists mechanism before deciding, the result is neutral, since
+// that mechanism might have matched. The lookups stop when ctx is done.
+func (r *SPFRecord) Evaluate(ctx context.Context, domain string, ip net.IP) (SPFResult, error) {
+	return r.evaluate(ctx, domain, ip, make(map[string]struct{}))
+}
+
+func (r *SPFRecord) evaluate(ctx context.Context, domain string, ip net.IP, visited map[string]struct{}) (SPFResult, error) {
 	if _, seen := visited[domain]; seen {
-		return nil // Avoid recursion
+		return SPFPermError, fmt.Errorf("SPF record of %s includes itself", domain)
 	}
 	visited[domain] = struct{}{}
 
-	txtRecords, err := net.LookupTXT(domain)
+	txtRecords, err := lookupTXT(ctx, domain)
 	if err != nil {
-		return fmt.Errorf("TXT lookup failed for %s: %w", domain, err)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return SPFNone, nil
+		}
+		return SPFTempError, fmt.Errorf("TXT lookup failed for %s: %w", domain, err)
 	}
 
-	var allIPv4, allIPv6 []string
-	for _, record := range txtRecords {
-		if !strings.HasPrefix(record, "v=spf1") {
-			continue
+	var record string
+	for _, txt := range txtRecords {
+		if txt == "v=spf1" || strings.HasPrefix(txt, "v=spf1 ") {
+			if record != "" {
+				return SPFPermError, fmt.Errorf("%s has more than one SPF record", domain)
+			}
+			record = txt
 		}
+	}
+	if record == "" {
+		return SPFNone, nil
+	}
 
-		ipv4, ipv6, includes, redirects := r.parseSPFRecord(record)
-		allIPv4 = append(allIPv4, ipv4...)
-		allIPv6 = append(allIPv6, ipv6...)
-
-		for _, inc := range includes {
-			err := r.fetchSPFNetworks(inc, visited)
-			if err != nil {
-				log.Printf("Include failed for %s: %v", inc, err)
-				continue
-			}
+	var redirect string
+	for _, term := range strings.Fields(strings.TrimPrefix(record, "v=spf1")) {
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
 		}
 
-		for _, red := range redirects {
-			err := r.fetchSPFNetworks(red, visited)
-			if err != nil {
-				log.Printf("Redirect failed for %s: %v", red, err)
-				continue
+		name, value, _ := strings.Cut(term, ":")
+		switch strings.ToLower(name) {
+		case "all":
+			return qualifier, nil
+		case "ip4", "ip6":
+			if spfNetworkContains(value, ip) {
+				return qualifier, nil
+			}
+		case "include":
+			result, err := r.evaluate(ctx, value, ip, visited)
+			switch result {
+			case SPFPass:
+				return qualifier, nil
+			case SPFTempError, SPFPermError:
+				return result, err
+			case SPFNone:
+				return SPFPermError, fmt.Errorf("included domain %s has no SPF record", value)
+			}
+		case "a", "mx", "ptr", "exists":
+			return SPFNeutral, nil
+		default:
+			if target, ok := strings.CutPrefix(term, "redirect="); ok {
+				redirect = target
 			}
 		}
 	}
-	r.Add(allIPv4, allIPv6)
-
-	return nil
 
-}
-
-// parseSPFRecord extracts IPs, includes, and redirects from an SPF record.
-func (r *SPFRecord) parseSPFRecord(spf string) (ipv4 []string, ipv6 []string, includes []string, redirects []string) {
-	spf = r.normalizeSPF(spf)
-	parts := strings.Fields(spf)
-
-	for _, part := range parts {
-		switch {
-		case strings.HasPrefix(part, "ip4:"):
-			ip := strings.TrimPrefix(part, "ip4:")
-			ipv4 = append(ipv4, ip)
-		case strings.HasPrefix(part, "ip6:"):
-			ip := strings.TrimPrefix(part, "ip6:")
-			ipv6 = append(ipv6, ip)
-		case strings.HasPrefix(part, "include:"):
-			domain := strings.TrimPrefix(part, "include:")
-			includes = append(includes, domain)
-		case strings.HasPrefix(part, "redirect="):
-			domain := strings.TrimPrefix(part, "redirect=")
-			redirects = append(redirects, domain)
-		}
+	if redirect == "" {
+		return SPFNeutral, nil
 	}
-	return
+	result, err := r.evaluate(ctx, redirect, ip, visited)
+	if result == SPFNone {
+		return SPFPermError, fmt.Errorf("redirect target %s has no SPF record", redirect)
+	}
+	return result, err
 }
 
-// normalizeSPF removes the 'v=spf1' prefix and any terminal 'all' mechanism.
-func (r *SPFRecord) normalizeSPF(spf string) string {
-	spf = strings.TrimPrefix(spf, "v=spf1")
-	spf = strings.TrimSpace(spf)
-	spf = strings.TrimSuffix(spf, "~all")
-	spf = strings.TrimSuffix(spf, "-all")
-	spf = strings.TrimSuffix(spf, "+all")
-	spf = strings.TrimSuffix(spf, "?all")
-	return strings.TrimSpace(spf)
+// spfNetworkContains reports whether ip is in the ip4 or ip6 network cidr,
+// which may also be a single address.
+func spfNetworkContains(cidr string, ip net.IP) bool {
+	if !strings.Contains(cidr, "/") {
+		other := net.ParseIP(cidr)
+		return other != nil && other.Equal(ip)
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	return err == nil && ipnet.Contains(ip)
 }
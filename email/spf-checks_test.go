@@ -0,0 +1,120 @@
+package email
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// stubTXT answers SPF lookups from records, and records the queried names.
+// Names missing from records fail with SERVFAIL.
+func stubTXT(t *testing.T, records map[string][]string) *[]string {
+	t.Helper()
+	var queries []string
+	orig := lookupTXT
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		queries = append(queries, name)
+		if txt, ok := records[name]; ok {
+			return txt, nil
+		}
+		return nil, errSERVFAIL
+	}
+	t.Cleanup(func() { lookupTXT = orig })
+	return &queries
+}
+
+func TestVerifySPFWithoutDomain(t *testing.T) {
+	queries := stubTXT(t, nil)
+	for _, from := range []string{"", "postmaster", "bob@"} {
+		e := NewEmail()
+		e.From = EmailUser{Email: from}
+		e.ClientIP = net.ParseIP("192.0.2.1")
+		pass, err := e.VerifySPFContext(context.Background())
+		if pass || err != nil {
+			t.Errorf("VerifySPFContext with From %q = %v, %v, want a neutral result", from, pass, err)
+		}
+	}
+	if len(*queries) != 0 {
+		t.Errorf("queries = %v", *queries)
+	}
+}
+
+func TestSPFEvaluate(t *testing.T) {
+	stubTXT(t, map[string][]string{
+		"fail.example":     {"some other TXT record", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"},
+		"soft.example":     {"v=spf1 ip4:192.0.2.1 ~all"},
+		"neutral.example":  {"v=spf1 ?all"},
+		"noall.example":    {"v=spf1 ip4:192.0.2.1"},
+		"mx.example":       {"v=spf1 mx -all"},
+		"a.example":        {"v=spf1 ip4:192.0.2.1 a:relay.a.example -all"},
+		"include.example":  {"v=spf1 include:fail.example -all"},
+		"redirect.example": {"v=spf1 redirect=soft.example"},
+		"loop.example":     {"v=spf1 include:loop.example -all"},
+		"nospf.example":    {"v=DMARC1; p=none"},
+		"two.example":      {"v=spf1 -all", "v=spf1 +all"},
+		"badinc.example":   {"v=spf1 include:nospf.example -all"},
+		"tempinc.example":  {"v=spf1 include:servfail.example -all"},
+		"deny.example":     {"v=spf1 -ip4:192.0.2.1 ?ip4:192.0.2.2 +all"},
+	})
+	notFound := lookupTXT
+	lookupTXT = func(ctx context.Context, name string) ([]string, error) {
+		if name == "nxdomain.example" {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return notFound(ctx, name)
+	}
+
+	tests := []struct {
+		domain string
+		ip     string
+		want   SPFResult
+	}{
+		{"fail.example", "192.0.2.7", SPFPass},
+		{"fail.example", "2001:db8::7", SPFPass},
+		{"fail.example", "198.51.100.7", SPFFail},
+		{"soft.example", "192.0.2.1", SPFPass},
+		{"soft.example", "192.0.2.2", SPFSoftFail},
+		{"neutral.example", "192.0.2.1", SPFNeutral},
+		{"noall.example", "192.0.2.2", SPFNeutral},
+		// Mechanisms that are not evaluated might have matched.
+		{"mx.example", "198.51.100.7", SPFNeutral},
+		{"a.example", "192.0.2.1", SPFPass},
+		{"a.example", "198.51.100.7", SPFNeutral},
+		{"include.example", "192.0.2.7", SPFPass},
+		{"include.example", "198.51.100.7", SPFFail},
+		{"redirect.example", "192.0.2.2", SPFSoftFail},
+		{"nospf.example", "192.0.2.1", SPFNone},
+		{"nxdomain.example", "192.0.2.1", SPFNone},
+		{"servfail.example", "192.0.2.1", SPFTempError},
+		{"tempinc.example", "192.0.2.1", SPFTempError},
+		{"loop.example", "192.0.2.1", SPFPermError},
+		{"two.example", "192.0.2.1", SPFPermError},
+		{"badinc.example", "192.0.2.1", SPFPermError},
+		// A qualifier on a matching network decides the result.
+		{"deny.example", "192.0.2.1", SPFFail},
+		{"deny.example", "192.0.2.2", SPFNeutral},
+		{"deny.example", "192.0.2.3", SPFPass},
+	}
+	for _, tt := range tests {
+		result, err := NewSPFRecord(tt.domain).Evaluate(context.Background(), tt.domain, net.ParseIP(tt.ip))
+		if result != tt.want {
+			t.Errorf("Evaluate(%s, %s) = %s, %v, want %s", tt.domain, tt.ip, result, err, tt.want)
+		}
+		wantErr := tt.want == SPFTempError || tt.want == SPFPermError
+		if (err != nil) != wantErr {
+			t.Errorf("Evaluate(%s, %s) error = %v", tt.domain, tt.ip, err)
+		}
+
+		// The boolean checks agree with Evaluate.
+		pass, err := NewSPFRecord(tt.domain).CheckSPFContext(context.Background(), tt.domain, net.ParseIP(tt.ip))
+		if pass != (tt.want == SPFPass) || (err != nil) != wantErr {
+			t.Errorf("CheckSPFContext(%s, %s) = %v, %v, want %s", tt.domain, tt.ip, pass, err, tt.want)
+		}
+		e := NewEmail()
+		e.From = EmailUser{Email: "bob@" + tt.domain}
+		e.ClientIP = net.ParseIP(tt.ip)
+		if pass, err := e.VerifySPFContext(context.Background()); pass != (tt.want == SPFPass) || (err != nil) != wantErr {
+			t.Errorf("VerifySPFContext(%s, %s) = %v, %v, want %s", tt.domain, tt.ip, pass, err, tt.want)
+		}
+	}
+}
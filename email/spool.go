@@ -0,0 +1,478 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Defaults for the zero fields of a Spool; the spool section of the
+// configuration defaults to them as well.
+const (
+	DefaultSpoolWorkers    = 4
+	DefaultSpoolBackoff    = 30 * time.Second
+	DefaultSpoolMaxBackoff = time.Hour
+	DefaultSpoolMaxAge     = 5 * 24 * time.Hour
+)
+
+// spoolCorruptDir is the subdirectory of a spool that holds emails whose
+// metadata could not be loaded.
+const spoolCorruptDir = "corrupt"
+
+// Spool is a Handler that writes every email to Dir before it is accepted
+// and delivers it to Handler in the background, so a slow or failing
+// consumer does not lose mail. Each email is stored as <id>.eml, the raw
+// message, and <id>.json, the session data and delivery state; an email is
+// only accepted once both are synced to disk.
+//
+// Failed deliveries are retried after Backoff, doubled for every further
+// attempt up to MaxBackoff. An email is given up when the handler rejects it
+// with a 5xx SMTP error or panics, when it cannot be read back, or when it is
+// still undelivered after MaxAge. Emails left in Dir by a previous run are
+// queued again by NewSpool; those whose metadata can't be read are moved to
+// the corrupt/ subdirectory.
+type Spool struct {
+	Dir        string
+	Handler    Handler
+	Workers    int           // Concurrent deliveries
+	Timeout    time.Duration // Bound of one delivery attempt, none when zero
+	Backoff    time.Duration // Delay before the first retry
+	MaxBackoff time.Duration // Longest delay between retries
+	MaxAge     time.Duration // How long delivery is retried
+
+	// OnFailed is called with the emails that are given up on. Only their
+	// raw message and session data are set; the message is not parsed.
+	OnFailed func(email *Email, err error)
+
+	mu    sync.Mutex
+	items map[string]*spoolItem
+	wake  chan struct{}
+}
+
+// spoolItem is the persisted state of a spooled email, the data that can't
+// be recovered by parsing the raw message again.
+type spoolItem struct {
+	ID          string       `json:"id"`
+	RcptTo      []EmailUser  `json:"rcpt_to"`
+	Connection  Connection   `json:"connection"`
+	Envelope    Envelope     `json:"envelope"`
+	DNSBL       *DNSBLResult `json:"dnsbl,omitempty"`
+	SPF         bool         `json:"spf"`
+	SPFResult   SPFResult    `json:"spf_result,omitempty"`
+	ReceivedAt  time.Time    `json:"received_at"`
+	SpooledAt   time.Time    `json:"spooled_at"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+	LastError   string       `json:"last_error,omitempty"`
+
+	busy bool // handed to a worker
+}
+
+// NewSpool returns a Spool delivering to handler from dir, creating the
+// directory if needed. Emails spooled by a previous run are queued again;
+// files of a spool write that was interrupted are removed.
+func NewSpool(dir string, handler Handler) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	s := &Spool{
+		Dir:     dir,
+		Handler: handler,
+		items:   make(map[string]*spoolItem),
+		wake:    make(chan struct{}, 1),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// HandleEmail implements Handler: it stores email and queues it for
+// delivery. Only errors writing the spool are returned.
+func (s *Spool) HandleEmail(ctx context.Context, email *Email) error {
+	raw, err := email.RawBytes()
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+
+	now := time.Now()
+	item := &spoolItem{
+		ID:          email.ID,
+		RcptTo:      email.RcptTo,
+		Connection:  email.Connection,
+		Envelope:    email.Envelope,
+		DNSBL:       email.DNSBL,
+		SPF:         email.SPF,
+		SPFResult:   email.SPFResult,
+		ReceivedAt:  email.ReceivedAt,
+		SpooledAt:   now,
+		NextAttempt: now,
+	}
+
+	// The metadata is written last: an .eml without it is an unfinished
+	// write, removed on the next start.
+	if err := writeFileSync(s.path(item.ID, ".eml"), raw); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	if err := s.save(item); err != nil {
+		os.Remove(s.path(item.ID, ".eml"))
+		return err
+	}
+
+	s.mu.Lock()
+	s.items[item.ID] = item
+	s.mu.Unlock()
+	s.notify()
+	return nil
+}
+
+// Len returns the number of emails waiting for delivery.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+// Run delivers spooled emails until ctx is done, then waits for the
+// deliveries in progress. Their contexts are canceled with ctx; an attempt
+// cut short that way is not counted and the email stays in the spool for
+// the next run.
+func (s *Spool) Run(ctx context.Context) {
+	work := make(chan *spoolItem)
+	var wg sync.WaitGroup
+	workers := s.Workers
+	if workers <= 0 {
+		workers = DefaultSpoolWorkers
+	}
+	for range workers {
+		wg.Go(func() {
+			for item := range work {
+				s.attempt(ctx, item)
+			}
+		})
+	}
+	defer wg.Wait()
+	defer close(work)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		item, wait := s.next(time.Now())
+		if item != nil {
+			select {
+			case work <- item:
+			case <-ctx.Done():
+				s.release(item)
+				return
+			}
+			continue
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// next marks the due email that has waited longest as busy and returns it.
+// When none is due, it returns how long to wait for the next one.
+func (s *Spool) next(now time.Time) (*spoolItem, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var first *spoolItem
+	for _, item := range s.items {
+		if item.busy {
+			continue
+		}
+		if first == nil || item.NextAttempt.Before(first.NextAttempt) {
+			first = item
+		}
+	}
+	if first == nil {
+		return nil, time.Hour
+	}
+	if wait := first.NextAttempt.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	first.busy = true
+	return first, 0
+}
+
+// attempt delivers item once and records the outcome.
+func (s *Spool) attempt(ctx context.Context, item *spoolItem) {
+	raw, err := os.ReadFile(s.path(item.ID, ".eml"))
+	if err != nil {
+		s.fail(item, nil, fmt.Errorf("spool: %w", err))
+		return
+	}
+	email, err := item.email(raw)
+	if err != nil {
+		s.fail(item, raw, err)
+		return
+	}
+
+	hctx, cancel := ctx, context.CancelFunc(func() {})
+	if s.Timeout > 0 {
+		hctx, cancel = context.WithTimeout(ctx, s.Timeout)
+	}
+	// A handler that panicked will panic again, so it is not retried.
+	panicked := false
+	err = Recover(func(*Email, error) { panicked = true })(s.Handler).HandleEmail(hctx, email)
+	cancel()
+
+	switch {
+	case err == nil:
+		s.remove(item)
+		return
+	case ctx.Err() != nil && !panicked:
+		s.release(item)
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	item.Attempts++
+	item.LastError = err.Error()
+	item.NextAttempt = now.Add(s.backoff(item.Attempts))
+	s.mu.Unlock()
+
+	if permanentError(err) || panicked {
+		s.fail(item, raw, err)
+		return
+	}
+	if now.Sub(item.SpooledAt) >= s.maxAge() {
+		s.fail(item, raw, fmt.Errorf("spool: giving up after %d attempts: %w", item.Attempts, err))
+		return
+	}
+
+	LogWarning("Spool", fmt.Sprintf("delivery of email %s failed (attempt %d), retrying at %s: %v",
+		item.ID, item.Attempts, item.NextAttempt.Format(time.RFC3339), err))
+	if err := s.save(item); err != nil {
+		LogError("Spool", err)
+	}
+	s.release(item)
+}
+
+// fail gives up on item: it is reported to OnFailed and removed.
+func (s *Spool) fail(item *spoolItem, raw []byte, err error) {
+	LogError("Spool", fmt.Errorf("giving up on email %s: %w", item.ID, err))
+	if s.OnFailed != nil {
+		email := &Email{Raw: bytes.NewReader(raw)}
+		item.restore(email)
+		s.OnFailed(email, err)
+	}
+	s.remove(item)
+}
+
+// remove deletes item from the queue and the directory.
+func (s *Spool) remove(item *spoolItem) {
+	s.mu.Lock()
+	delete(s.items, item.ID)
+	s.mu.Unlock()
+
+	for _, ext := range []string{".json", ".eml"} {
+		if err := os.Remove(s.path(item.ID, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			LogError("Spool", err)
+		}
+	}
+}
+
+// release hands item back to the scheduler.
+func (s *Spool) release(item *spoolItem) {
+	s.mu.Lock()
+	item.busy = false
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Spool) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the metadata of item.
+func (s *Spool) save(item *spoolItem) error {
+	s.mu.Lock()
+	data, err := json.MarshalIndent(item, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	if err := writeFileSync(s.path(item.ID, ".json"), data); err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+	return nil
+}
+
+// recover loads the emails left in Dir and removes unfinished writes.
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("spool: %w", err)
+	}
+
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		id, ext := strings.TrimSuffix(name, filepath.Ext(name)), filepath.Ext(name)
+		switch {
+		case strings.HasPrefix(name, "."):
+			// Temporary file of an interrupted write.
+			os.Remove(filepath.Join(s.Dir, name))
+
+		case ext == ".eml" && !names[id+".json"]:
+			LogWarning("Spool", fmt.Sprintf("removing unfinished email %s", id))
+			os.Remove(filepath.Join(s.Dir, name))
+
+		case ext == ".json":
+			if !names[id+".eml"] {
+				LogWarning("Spool", fmt.Sprintf("removing email %s without a message file", id))
+				os.Remove(filepath.Join(s.Dir, name))
+				continue
+			}
+			item := &spoolItem{}
+			data, err := os.ReadFile(filepath.Join(s.Dir, name))
+			if err == nil {
+				err = json.Unmarshal(data, item)
+			}
+			if err == nil && item.ID != id {
+				err = fmt.Errorf("metadata is for email %q", item.ID)
+			}
+			if err != nil {
+				LogWarning("Spool", fmt.Sprintf("moving email %s with unreadable metadata to %s: %v", id, spoolCorruptDir, err))
+				s.quarantine(id)
+				continue
+			}
+			s.items[id] = item
+		}
+	}
+
+	if len(s.items) > 0 {
+		LogInfo("Spool", fmt.Sprintf("re-queued %d email(s) from %s", len(s.items), s.Dir))
+	}
+	return nil
+}
+
+// quarantine moves the files of email id to the corrupt/ subdirectory, where
+// they are kept for inspection but not delivered.
+func (s *Spool) quarantine(id string) {
+	dir := filepath.Join(s.Dir, spoolCorruptDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		LogError("Spool", err)
+		return
+	}
+	for _, ext := range []string{".eml", ".json"} {
+		if err := os.Rename(s.path(id, ext), filepath.Join(dir, id+ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			LogError("Spool", err)
+		}
+	}
+}
+
+// email parses raw and restores the session data recorded for item.
+func (item *spoolItem) email(raw []byte) (*Email, error) {
+	email, err := parseEmail(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	item.restore(email)
+	return email, nil
+}
+
+// restore sets the session data recorded for item on email.
+func (item *spoolItem) restore(email *Email) {
+	email.ID = item.ID
+	email.ReceivedAt = item.ReceivedAt
+	email.Connection = item.Connection
+	email.ClientIP = item.Connection.ClientIP
+	email.AuthUser = item.Connection.AuthUser
+	email.RcptTo = item.RcptTo
+	email.Envelope = item.Envelope
+	email.DNSBL = item.DNSBL
+	email.SPF = item.SPF
+	email.SPFResult = item.SPFResult
+}
+
+func (s *Spool) path(id, ext string) string {
+	return filepath.Join(s.Dir, id+ext)
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (s *Spool) backoff(attempts int) time.Duration {
+	d, limit := s.Backoff, s.MaxBackoff
+	if d <= 0 {
+		d = DefaultSpoolBackoff
+	}
+	if limit <= 0 {
+		limit = DefaultSpoolMaxBackoff
+	}
+	for i := 1; i < attempts && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+func (s *Spool) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return DefaultSpoolMaxAge
+	}
+	return s.MaxAge
+}
+
+// permanentError reports whether a handler rejected an email for good.
+func permanentError(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
+
+// writeFileSync writes data to path through a synced temporary file, so the
+// file is either complete or missing after a crash.
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself survives a crash.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
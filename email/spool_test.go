@@ -0,0 +1,400 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const spoolMessage = "From: Bob <bob@example.org>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi\r\n"
+
+var errSpoolTest = errors.New("consumer unavailable")
+
+// recordingHandler records the emails it gets and answers with the next of
+// results, then nil.
+type recordingHandler struct {
+	mu      sync.Mutex
+	results []func() error
+	emails  []*Email
+}
+
+func (h *recordingHandler) HandleEmail(ctx context.Context, e *Email) error {
+	h.mu.Lock()
+	n := len(h.emails)
+	h.emails = append(h.emails, e)
+	var result func() error
+	if n < len(h.results) {
+		result = h.results[n]
+	}
+	h.mu.Unlock()
+
+	if result == nil {
+		return nil
+	}
+	return result()
+}
+
+func (h *recordingHandler) calls() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.emails)
+}
+
+// failure is an OnFailed call.
+type failure struct {
+	email *Email
+	raw   string
+	err   error
+}
+
+func runSpool(t *testing.T, s *Spool) (failures chan failure) {
+	t.Helper()
+	failures = make(chan failure, 10)
+	s.OnFailed = func(e *Email, err error) {
+		data, _ := io.ReadAll(e.Raw)
+		failures <- failure{e, string(data), err}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return failures
+}
+
+// nextFailure waits for the next OnFailed call.
+func nextFailure(t *testing.T, failures <-chan failure) failure {
+	t.Helper()
+	select {
+	case f := <-failures:
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for OnFailed")
+		return failure{}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSpoolDelivers(t *testing.T) {
+	dir := t.TempDir()
+	h := &recordingHandler{}
+	s, err := NewSpool(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSpool(t, s)
+
+	e := testEmail(t, spoolMessage)
+	if err := s.HandleEmail(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delivery", func() bool { return h.calls() == 1 && s.Len() == 0 })
+
+	got := h.emails[0]
+	if got.ID != e.ID || got.Envelope.From != "bounces@example.org" || !got.SPF || got.SPFResult != SPFPass ||
+		got.Connection.Helo != "client.example.org" || len(got.RcptTo) != 1 || got.RcptTo[0].Tag != "reports" {
+		t.Errorf("delivered email lost session data: %+v", got)
+	}
+	if got.Subject != "Hello" {
+		t.Errorf("Subject = %q", got.Subject)
+	}
+	if names := spoolFiles(t, dir); len(names) != 0 {
+		t.Errorf("files left after delivery: %v", names)
+	}
+}
+
+func TestSpoolRetries(t *testing.T) {
+	h := &recordingHandler{results: []func() error{
+		func() error { return errSpoolTest },
+		func() error { return &smtp.SMTPError{Code: 451, Message: "later"} },
+	}}
+	s, err := NewSpool(t.TempDir(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Backoff = 10 * time.Millisecond
+	failures := runSpool(t, s)
+
+	start := time.Now()
+	if err := s.HandleEmail(context.Background(), testEmail(t, spoolMessage)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delivery", func() bool { return h.calls() == 3 && s.Len() == 0 })
+
+	// 10ms after the first failure, 20ms after the second.
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("delivered after %s, before the backoff passed", elapsed)
+	}
+	select {
+	case f := <-failures:
+		t.Errorf("OnFailed called: %v", f.err)
+	default:
+	}
+}
+
+// A failed attempt is recorded in the metadata before the next one.
+func TestSpoolRecordsAttempts(t *testing.T) {
+	dir := t.TempDir()
+	h := &recordingHandler{results: []func() error{func() error { return errSpoolTest }}}
+	s, err := NewSpool(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Backoff = time.Hour
+	runSpool(t, s)
+
+	e := testEmail(t, spoolMessage)
+	s.HandleEmail(context.Background(), e)
+	waitFor(t, "the first attempt", func() bool { return h.calls() == 1 })
+
+	var item spoolItem
+	waitFor(t, "the metadata", func() bool {
+		data, err := os.ReadFile(filepath.Join(dir, e.ID+".json"))
+		return err == nil && json.Unmarshal(data, &item) == nil && item.Attempts == 1
+	})
+	if item.LastError != errSpoolTest.Error() {
+		t.Errorf("LastError = %q", item.LastError)
+	}
+	if wait := time.Until(item.NextAttempt); wait < 59*time.Minute {
+		t.Errorf("next attempt in %s, want an hour", wait)
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	tests := []struct {
+		s    *Spool
+		want []time.Duration
+	}{
+		{&Spool{}, []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 16 * time.Minute, 32 * time.Minute, time.Hour, time.Hour}},
+		{&Spool{Backoff: time.Second, MaxBackoff: 5 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := tt.s.backoff(i + 1); got != want {
+				t.Errorf("Backoff %s, MaxBackoff %s: delay after %d attempts = %s, want %s", tt.s.Backoff, tt.s.MaxBackoff, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestSpoolPermanentError(t *testing.T) {
+	dir := t.TempDir()
+	h := &recordingHandler{results: []func() error{
+		func() error {
+			return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+		},
+	}}
+	s, err := NewSpool(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := runSpool(t, s)
+
+	s.HandleEmail(context.Background(), testEmail(t, spoolMessage))
+	f := nextFailure(t, failures)
+	want := testEmail(t, spoolMessage)
+	if f.email.Envelope.From != "bounces@example.org" || !reflect.DeepEqual(f.email.RcptTo, want.RcptTo) ||
+		!reflect.DeepEqual(f.email.Envelope, want.Envelope) || f.email.Connection.Helo != "client.example.org" || !f.email.SPF {
+		t.Errorf("OnFailed got %+v", f.email)
+	}
+	if f.raw != spoolMessage {
+		t.Errorf("OnFailed got raw %q", f.raw)
+	}
+	if h.calls() != 1 {
+		t.Errorf("%d attempts, want 1", h.calls())
+	}
+	waitFor(t, "removal", func() bool { return s.Len() == 0 && len(spoolFiles(t, dir)) == 0 })
+}
+
+func TestSpoolPanicIsPermanent(t *testing.T) {
+	h := &recordingHandler{results: []func() error{func() error { panic("boom") }}}
+	s, err := NewSpool(t.TempDir(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Backoff = time.Millisecond
+	failures := runSpool(t, s)
+
+	s.HandleEmail(context.Background(), testEmail(t, spoolMessage))
+	f := nextFailure(t, failures)
+	if !strings.Contains(f.err.Error(), "panic in handler: boom") {
+		t.Errorf("OnFailed error = %v", f.err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if h.calls() != 1 {
+		t.Errorf("%d attempts, want 1", h.calls())
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	h := &recordingHandler{results: []func() error{
+		func() error { return errSpoolTest },
+		func() error { return errSpoolTest },
+		func() error { return errSpoolTest },
+	}}
+	s, err := NewSpool(t.TempDir(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Backoff = 10 * time.Millisecond
+	s.MaxAge = 25 * time.Millisecond
+	failures := runSpool(t, s)
+
+	s.HandleEmail(context.Background(), testEmail(t, spoolMessage))
+	f := nextFailure(t, failures)
+	if !errors.Is(f.err, errSpoolTest) || !strings.Contains(f.err.Error(), "giving up after") {
+		t.Errorf("OnFailed error = %v", f.err)
+	}
+	if n := h.calls(); n < 2 || n > 3 {
+		t.Errorf("%d attempts before MaxAge, want 2 or 3", n)
+	}
+	waitFor(t, "removal", func() bool { return s.Len() == 0 })
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewSpool(dir, &recordingHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := testEmail(t, spoolMessage)
+	if err := first.HandleEmail(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leftovers of a crash: a temporary file, a message whose metadata was
+	// never written, metadata without its message, and a corrupt record.
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(".tmp.eml.123", "partial")
+	write("unfinished.eml", spoolMessage)
+	write("orphan.json", `{"id":"orphan"}`)
+	write("corrupt.eml", spoolMessage)
+	write("corrupt.json", `{"id":`)
+	write("renamed.eml", spoolMessage)
+	write("renamed.json", `{"id":"other"}`)
+
+	h := &recordingHandler{}
+	s, err := NewSpool(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len = %d after recovery, want 1", s.Len())
+	}
+	want := []string{e.ID + ".eml", e.ID + ".json", spoolCorruptDir}
+	if got := spoolFiles(t, dir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("spool files = %v, want %v", got, want)
+	}
+	corrupt := spoolFiles(t, filepath.Join(dir, spoolCorruptDir))
+	if strings.Join(corrupt, " ") != "corrupt.eml corrupt.json renamed.eml renamed.json" {
+		t.Errorf("corrupt files = %v", corrupt)
+	}
+
+	runSpool(t, s)
+	waitFor(t, "delivery", func() bool { return h.calls() == 1 && s.Len() == 0 })
+	if got := h.emails[0]; got.ID != e.ID || got.Envelope.From != "bounces@example.org" {
+		t.Errorf("recovered email = %s from %s", got.ID, got.Envelope.From)
+	}
+
+	// A restart does not pick up the quarantined emails.
+	again, err := NewSpool(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Len() != 0 {
+		t.Errorf("Len = %d after a second restart", again.Len())
+	}
+}
+
+// An attempt cut short by shutdown is not counted, and the email is
+// delivered after the next start.
+func TestSpoolShutdownKeepsEmail(t *testing.T) {
+	dir := t.TempDir()
+	started := make(chan struct{})
+	h := &recordingHandler{results: []func() error{func() error {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return context.Canceled
+	}}}
+	s, err := NewSpool(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	e := testEmail(t, spoolMessage)
+	s.HandleEmail(context.Background(), e)
+	<-started
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(filepath.Join(dir, e.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item spoolItem
+	if err := json.Unmarshal(data, &item); err != nil || item.Attempts != 0 {
+		t.Errorf("Attempts = %d (%v), want 0", item.Attempts, err)
+	}
+
+	h2 := &recordingHandler{}
+	s2, err := NewSpool(dir, h2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSpool(t, s2)
+	waitFor(t, "delivery after restart", func() bool { return h2.calls() == 1 && s2.Len() == 0 })
+}
@@ -1,9 +1,13 @@
 package email
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"maps"
 	"net"
+	"slices"
 	"strings"
 	"time"
 )
@@ -85,6 +89,13 @@ func (rp *EmailContent) Read(p []byte) (n int, err error) {
 type EmailUser struct {
 	Name  string `json:"Name,omitempty"`  // Name is the display name of the user.
 	Email string `json:"Email,omitempty"` // Email is the email address of the user.
+	Tag   string `json:"Tag,omitempty"`   // Tag is the subaddress of a user+tag@domain recipient.
+}
+
+// Mailbox returns the address without its subaddress tag.
+func (eu EmailUser) Mailbox() string {
+	mailbox, _ := splitSubaddress(eu.Email)
+	return mailbox
 }
 
 func (eu EmailUser) HasDomain(domains []string) (string, bool) {
@@ -141,6 +152,18 @@ type Email struct {
 	// Client ip address
 	ClientIP net.IP
 
+	// AuthUser is the identity the client authenticated as with SMTP AUTH,
+	// empty when the session was not authenticated.
+	AuthUser string
+
+	// Connection describes the client the email was received from: HELO
+	// name, TLS parameters, listener and session start.
+	Connection Connection
+
+	// Envelope holds the MAIL FROM and RCPT TO parameters and the
+	// transaction timestamps.
+	Envelope Envelope
+
 	// From is the email address of the sender.
 	From EmailUser
 
@@ -172,6 +195,14 @@ type Email struct {
 	SPF   bool // SPF check result
 	DKIM  bool // DKIM check result
 	DMARC bool // DMARC check result
+
+	// SPFResult is the result of the SPF middleware, empty when it did not
+	// run.
+	SPFResult SPFResult
+
+	// DNSBL holds the blocklists the client address is listed on, nil when
+	// no lookup was made.
+	DNSBL *DNSBLResult
 }
 
 func NewEmail() *Email {
@@ -182,17 +213,92 @@ func NewEmail() *Email {
 	}
 }
 
+// clone returns a copy of e under a new ID. The copy's headers, recipient
+// lists and content readers are its own, so a handler can consume or modify
+// it without affecting e.
+func (e *Email) clone() (*Email, error) {
+	c := *e
+	uuid, _ := NewUUIDv7()
+	c.ID = uuid.String()
+	c.RcptTo = slices.Clone(e.RcptTo)
+	c.Recipients = slices.Clone(e.Recipients)
+	c.Envelope.Recipients = slices.Clone(e.Envelope.Recipients)
+	if e.Headers != nil {
+		h := *e.Headers
+		h.To, h.Cc = slices.Clone(h.To), slices.Clone(h.Cc)
+		h.ContentType.Params = maps.Clone(h.ContentType.Params)
+		h.Extra = maps.Clone(h.Extra)
+		c.Headers = &h
+	}
+
+	var err error
+	for _, r := range []*io.Reader{&c.Raw, &c.Body} {
+		if *r, err = cloneReader(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, part := range []**EmailContent{&c.BodyText, &c.BodyHTML} {
+		if *part, err = (*part).clone(); err != nil {
+			return nil, err
+		}
+	}
+	if e.Attachments != nil {
+		c.Attachments = make([]*EmailContent, len(e.Attachments))
+		for i, a := range e.Attachments {
+			if c.Attachments[i], err = a.clone(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &c, nil
+}
+
+func (rp *EmailContent) clone() (*EmailContent, error) {
+	if rp == nil {
+		return nil, nil
+	}
+	c := *rp
+	c.Headers.ContentType.Params = maps.Clone(c.Headers.ContentType.Params)
+	c.Headers.Extra = maps.Clone(c.Headers.Extra)
+	var err error
+	c.R, err = cloneReader(&rp.R)
+	return &c, err
+}
+
+// cloneReader returns a new reader over everything *r holds, leaving *r
+// readable from the start.
+func cloneReader(r *io.Reader) (io.Reader, error) {
+	if *r == nil {
+		return nil, nil
+	}
+	data, err := readerBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// VerifySPF is VerifySPFContext with a timeout of SPFTimeout.
 func (e *Email) VerifySPF() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SPFTimeout)
+	defer cancel()
+	return e.VerifySPFContext(ctx)
+}
+
+// VerifySPFContext checks ClientIP against the SPF record of the sender's
+// domain with SPFRecord.CheckSPFContext. The DNS lookups stop when ctx is
+// done.
+func (e *Email) VerifySPFContext(ctx context.Context) (bool, error) {
 	// check if we already have the result
 	if e.SPF {
 		return e.SPF, nil
 	}
 
-	if e.ClientIP == nil || e.From.Email == "" {
-		return false, nil // Cannot verify SPF without client IP or sender email
+	_, domain, _ := strings.Cut(e.From.Email, "@")
+	if e.ClientIP == nil || domain == "" {
+		return false, nil // Cannot verify SPF without client IP or sender domain
 	}
-	domain := strings.SplitN(e.From.Email, "@", 2)[1]
 
 	spfRecord := NewSPFRecord(domain)
-	return spfRecord.CheckSPF(domain, e.ClientIP)
+	return spfRecord.CheckSPFContext(ctx, domain, e.ClientIP)
 }
@@ -0,0 +1,67 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchedFile caches the parsed contents of a file and parses it again when
+// its modification time changes.
+type watchedFile[T any] struct {
+	mu      sync.Mutex
+	modTime time.Time
+	loaded  bool
+	value   T
+}
+
+// load returns the contents of the file at path as parsed by parse. The
+// file is read again only if it changed since the last successful load. If
+// it can't be read or parsed, load returns the error along with the last
+// good value, so that callers can keep serving it.
+func (f *watchedFile[T]) load(path string, parse func(data []byte) (T, error)) (T, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return f.value, err
+	}
+	if f.loaded && info.ModTime().Equal(f.modTime) {
+		return f.value, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f.value, err
+	}
+	value, err := parse(data)
+	if err != nil {
+		return f.value, err
+	}
+
+	f.value = value
+	f.modTime = info.ModTime()
+	f.loaded = true
+	return value, nil
+}
+
+// eachLine calls fn with every line of data that is neither blank nor a
+// comment starting with #, trimmed of surrounding space. n is the line
+// number. eachLine stops at the first error fn returns.
+func eachLine(data []byte, fn func(n int, line string) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(n, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
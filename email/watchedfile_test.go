@@ -0,0 +1,58 @@
+package email
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	if err := os.WriteFile(path, []byte("# comment\n\none\n  two  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	parses := 0
+	parse := func(data []byte) ([]string, error) {
+		parses++
+		var lines []string
+		err := eachLine(data, func(n int, line string) error {
+			if line == "bad" {
+				return errors.New("bad line")
+			}
+			lines = append(lines, line)
+			return nil
+		})
+		return lines, err
+	}
+
+	var f watchedFile[[]string]
+	for range 2 {
+		lines, err := f.load(path, parse)
+		if err != nil || len(lines) != 2 || lines[0] != "one" || lines[1] != "two" {
+			t.Fatalf("load = %q, %v", lines, err)
+		}
+	}
+	if parses != 1 {
+		t.Errorf("unchanged file parsed %d times, want 1", parses)
+	}
+
+	if err := os.WriteFile(path, []byte("bad\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := f.modTime.Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := f.load(path, parse)
+	if err == nil || len(lines) != 2 {
+		t.Errorf("load of a bad file = %q, %v; want the last good copy and an error", lines, err)
+	}
+
+	os.Remove(path)
+	if lines, err := f.load(path, parse); err == nil || len(lines) != 2 {
+		t.Errorf("load of a missing file = %q, %v; want the last good copy and an error", lines, err)
+	}
+}
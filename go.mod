@@ -2,6 +2,10 @@ module github.com/TrueFix/getmail
 
 go 1.25.1
 
-require github.com/emersion/go-smtp v0.24.0
+require (
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
+	github.com/emersion/go-smtp v0.24.0
+	golang.org/x/crypto v0.55.0
+)
 
-require github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6 // indirect
+require golang.org/x/sys v0.47.0 // indirect
@@ -0,0 +1,117 @@
+package smtptest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Client is a raw SMTP client connected to a test server.
+type Client struct {
+	T    testing.TB
+	Conn net.Conn
+	R    *bufio.Reader
+}
+
+// Listen opens a listener on a loopback port.
+func Listen(t testing.TB) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+// Serve serves s on ln and connects to it; ln is usually a wrapper around
+// a listener from Listen. The greeting has been read when it returns.
+func Serve(t testing.TB, s *smtp.Server, ln net.Listener) *Client {
+	t.Helper()
+
+	s.ReadTimeout = 5 * time.Second
+	s.WriteTimeout = 5 * time.Second
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	c := Dial(t, ln.Addr().Network(), ln.Addr().String())
+	c.Expect("220 ")
+	return c
+}
+
+// Dial connects to a server without reading the greeting.
+func Dial(t testing.TB, network, addr string) *Client {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &Client{T: t, Conn: conn, R: bufio.NewReader(conn)}
+}
+
+// StartTLS runs the TLS handshake on the connection, after the server has
+// accepted STARTTLS or right after Dial for implicit TLS.
+func (c *Client) StartTLS(config *tls.Config) {
+	c.T.Helper()
+	conn := tls.Client(c.Conn, config)
+	if err := conn.Handshake(); err != nil {
+		c.T.Fatalf("TLS handshake: %v", err)
+	}
+	c.Conn, c.R = conn, bufio.NewReader(conn)
+}
+
+// Write sends data as is.
+func (c *Client) Write(data string) {
+	c.T.Helper()
+	if _, err := c.Conn.Write([]byte(data)); err != nil {
+		c.T.Fatal(err)
+	}
+}
+
+// Reply reads one, possibly multi-line, reply.
+func (c *Client) Reply() string {
+	c.T.Helper()
+	var out strings.Builder
+	for {
+		line, err := c.R.ReadString('\n')
+		if err != nil {
+			c.T.Fatalf("reading reply: %v (got %q)", err, out.String())
+		}
+		out.WriteString(line)
+		if len(line) < 4 || line[3] != '-' {
+			return out.String()
+		}
+	}
+}
+
+// Expect reads a reply and fails unless it starts with prefix.
+func (c *Client) Expect(prefix string) string {
+	c.T.Helper()
+	reply := c.Reply()
+	if !strings.HasPrefix(reply, prefix) {
+		c.T.Fatalf("reply = %q, want %q", reply, prefix)
+	}
+	return reply
+}
+
+// Cmd sends one command and checks the reply.
+func (c *Client) Cmd(line, prefix string) string {
+	c.T.Helper()
+	c.Write(line + "\r\n")
+	return c.Expect(prefix)
+}
+
+// ExpectClosed fails unless the server has closed the connection.
+func (c *Client) ExpectClosed() {
+	c.T.Helper()
+	if line, err := c.R.ReadString('\n'); err != io.EOF {
+		c.T.Fatalf("connection still open: read %q, %v", line, err)
+	}
+}
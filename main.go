@@ -1,71 +1,68 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"time"
-
-	"github.com/TrueFix/getmail/email"
-	"github.com/TrueFix/getmail/service"
-	"github.com/emersion/go-smtp"
+	"strings"
 )
 
-// createTLSConfig loads TLS certificates and returns the TLS config.
-func createTLSConfig() (*tls.Config, error) {
-	// Check if cert files exist
-	if _, err := os.Stat("config/localhost.crt"); err == nil {
-		if _, err := os.Stat("config/localhost.key"); err != nil {
-			return nil, err
-		}
-	} else {
-		return nil, err
-	}
-
-	// Load cert and key
-	cert, err := tls.LoadX509KeyPair("config/localhost.crt", "config/localhost.key")
-	if err != nil {
-		return nil, err
-	}
+// command is a getmail subcommand.
+type command struct {
+	Name  string
+	Usage string
+	Help  string
+	Run   func(args []string) error
+}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ServerName:   "localhost",
-	}, nil
+var commands = []command{
+	{"serve", "serve [-config file]", "Run the SMTP server", runServe},
+	{"parse", "parse [-pretty=false] [-attachments] [-raw] <message.eml|->", "Parse a message offline and print it as JSON", runParse},
+	{"dead-letters", "dead-letters [-config file] list|show|raw|redrive|remove [id...]", "Inspect and re-drive messages that failed", runDeadLetters},
+	{"check-spf", "check-spf <domain> <ip>", "Check whether ip is allowed to send for domain", runCheckSPF},
+	{"gen-cert", "gen-cert [-domain name] [-days n] [-dir path]", "Generate a self-signed TLS certificate with SANs", runGenCert},
 }
 
-// runSMTPServer sets up and starts the SMTP server.
-func runSMTPServer() error {
-	tlsConfig, err := createTLSConfig()
-	if err != nil {
-		log.Println("[WARN] TLS configuration not loaded:", err)
+func usage() {
+	fmt.Fprint(os.Stderr, "Usage: getmail <command> [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-65s %s\n", c.Usage, c.Help)
 	}
+}
 
-	externalService := &service.Service{}
-
-	backend := email.NewBackend(
-		externalService.OnEmail,
-		externalService.OnEmailFailed,
-		[]string{}, // Trusted domains
-	)
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	server := smtp.NewServer(backend)
-	server.Addr = "0.0.0.0:25"
-	if tlsConfig != nil {
-		server.TLSConfig = tlsConfig
+// run dispatches args to a subcommand and returns the exit status.
+func run(args []string) int {
+	name := "serve"
+	// Without a subcommand (or with only flags) behave like "serve".
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	server.WriteTimeout = 10 * time.Second
-	server.ReadTimeout = 10 * time.Second
-	server.MaxMessageBytes = 1024 * 1024
-	server.MaxRecipients = 50
-
-	log.Println("[INFO] SMTP server listening on", server.Addr)
-	return server.ListenAndServe()
-}
+	if name == "help" {
+		usage()
+		return 0
+	}
 
-func main() {
-	if err := runSMTPServer(); err != nil {
-		log.Fatal("[FATAL]", err)
+	for _, c := range commands {
+		if c.Name == name {
+			err := c.Run(args)
+			switch {
+			case err == nil:
+				return 0
+			case errors.Is(err, errSPFFail):
+				return 1
+			}
+			log.Print("[FATAL] ", err)
+			return 1
+		}
 	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	return 2
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/TrueFix/getmail/email"
+)
+
+// captureStdout returns what f writes to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	f()
+	w.Close()
+	return string(<-out)
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	captureLog(t)
+
+	if got := run([]string{"bogus"}); got != 2 {
+		t.Errorf("run(bogus) = %d, want 2", got)
+	}
+	if got := run([]string{"help"}); got != 0 {
+		t.Errorf("run(help) = %d, want 0", got)
+	}
+	if got := run([]string{"check-spf", "example.com"}); got != 1 {
+		t.Errorf("run(check-spf) with a missing argument = %d, want 1", got)
+	}
+}
+
+func TestRunParse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "message.eml")
+	msg := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.org\r\n" +
+		"Subject: Hello\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Hi Bob\r\n"
+	if err := os.WriteFile(path, []byte(msg), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	out := captureStdout(t, func() { err = runParse([]string{"-pretty=false", path}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "\n") != 1 {
+		t.Errorf("-pretty=false printed %d lines, want 1", strings.Count(out, "\n"))
+	}
+
+	var got struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		Subject       string `json:"subject"`
+		Text          string `json:"text"`
+		Raw           []byte `json:"raw"`
+		Headers       struct {
+			From struct {
+				Email string `json:"email"`
+			} `json:"from"`
+		} `json:"headers"`
+	}
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if got.SchemaVersion != 1 || got.Subject != "Hello" || got.Headers.From.Email != "alice@example.com" {
+		t.Errorf("parse output = %+v", got)
+	}
+	if !strings.Contains(got.Text, "Hi Bob") {
+		t.Errorf("text = %q, want the body", got.Text)
+	}
+	if got.Raw != nil {
+		t.Error("raw included without -raw")
+	}
+
+	if err := runParse(nil); err == nil {
+		t.Error("parse without a message file succeeded")
+	}
+}
+
+// A redrive says whether the message had failed to parse, and keeps one
+// that still doesn't.
+func TestRunDeadLettersRedrive(t *testing.T) {
+	captureLog(t)
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "getmail.json")
+	config := `{"dead_letters": {"dir": "` + filepath.Join(dir, "dead") + `"}}`
+	if err := os.WriteFile(configPath, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := email.NewDeadLetters(filepath.Join(dir, "dead"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseErr := fmt.Errorf("%w: a parser bug", email.ErrUnparsable)
+	fixed, err := store.Add(&email.Email{Raw: strings.NewReader("Subject: Hello\r\nContent-Type: text/plain\r\n\r\nHi\r\n")}, parseErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := store.Add(&email.Email{Raw: strings.NewReader("not a message")}, parseErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() { err = runDeadLetters([]string{"-config", configPath, "redrive", fixed.ID}) })
+	if err != nil || !strings.Contains(out, fixed.ID+": parsed and delivered") {
+		t.Errorf("redrive of a message that parses now: %v, %q", err, out)
+	}
+
+	err = runDeadLetters([]string{"-config", configPath, "redrive", broken.ID})
+	if !errors.Is(err, email.ErrUnparsable) || !strings.Contains(err.Error(), "still not parsable") {
+		t.Errorf("redrive of a message that still fails to parse: %v", err)
+	}
+	if _, err := store.Get(broken.ID); err != nil {
+		t.Errorf("unparsable message not kept: %v", err)
+	}
+}
+
+func TestCertNames(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   []string
+	}{
+		{"localhost", []string{"localhost", "www.localhost", "mail.localhost", "smtp.localhost", "imap.localhost", "pop3.localhost"}},
+		{"example.com", []string{"example.com", "www.example.com", "mail.example.com", "smtp.example.com", "imap.example.com", "pop3.example.com", "localhost"}},
+	}
+	for _, tt := range tests {
+		if got := certNames(tt.domain); !slices.Equal(got, tt.want) {
+			t.Errorf("certNames(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
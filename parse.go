@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/TrueFix/getmail/email"
+)
+
+// runParse runs a message through the same parser as the server and prints
+// the result in the JSON form of email.Email, so parsing failures can be
+// debugged without an SMTP session.
+func runParse(args []string) error {
+	fs := flag.NewFlagSet("parse", flag.ExitOnError)
+	pretty := fs.Bool("pretty", true, "indent the JSON output")
+	content := fs.Bool("attachments", false, "include attachment content (base64) in the output")
+	raw := fs.Bool("raw", false, "include the raw message (base64) in the output")
+	schema := fs.Bool("schema", false, "print the JSON Schema of the output and exit")
+	fs.Parse(args)
+
+	if *schema {
+		_, err := os.Stdout.Write(email.JSONSchema)
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("parse: expected exactly one message file (or - for stdin)")
+	}
+
+	var r io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("parse: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	e, err := email.ParseEmail(r)
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+
+	data, err := e.MarshalJSONWith(email.JSONOptions{AttachmentContent: *content, Raw: *raw})
+	if err != nil {
+		return fmt.Errorf("parse: %w", err)
+	}
+	if *pretty {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err != nil {
+			return fmt.Errorf("parse: %w", err)
+		}
+		data = buf.Bytes()
+	}
+	_, err = fmt.Printf("%s\n", data)
+	return err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/TrueFix/getmail/config"
+	"github.com/TrueFix/getmail/email"
+	"github.com/TrueFix/getmail/server"
+	"github.com/TrueFix/getmail/service"
+)
+
+// runServe loads the configuration and runs the SMTP server.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("GETMAIL_CONFIG"), "path to the JSON configuration file")
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	return runSMTPServer(cfg)
+}
+
+// newHandler returns the email handler selected by the configuration.
+func newHandler(cfg *config.Config) email.Handler {
+	switch cfg.Handler {
+	case "webhook":
+		return &service.Webhook{
+			URLs:        cfg.Webhook.URLs,
+			Secret:      cfg.Webhook.Secret,
+			Attachments: cfg.Webhook.Attachments,
+			Timeout:     cfg.Webhook.Timeout.Duration,
+			Retries:     cfg.Webhook.Retries,
+			Backoff:     cfg.Webhook.Backoff.Duration,
+			MaxBackoff:  cfg.Webhook.MaxBackoff.Duration,
+		}
+	case "maildir":
+		return &service.Maildir{Root: cfg.Maildir.Root, Layout: cfg.Maildir.Layout}
+	default: // "log"
+		return &service.Service{}
+	}
+}
+
+// runSMTPServer sets up the SMTP server and runs it until SIGINT or SIGTERM,
+// then shuts it down gracefully.
+func runSMTPServer(cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var tlsConfig *tls.Config
+	var certs *server.CertStore
+	if cfg.TLS.CertFile != "" || cfg.TLS.CertDir != "" {
+		var err error
+		certs, err = server.NewCertStore(cfg.TLS.CertDir, cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.Server.Domain)
+		if err != nil {
+			log.Println("[WARN] TLS configuration not loaded:", err)
+		} else {
+			tlsConfig = certs.TLSConfig()
+			if cfg.TLS.RequestClientCert {
+				tlsConfig.ClientAuth = tls.RequestClientCert
+			}
+		}
+	}
+
+	// SIGHUP stays handled until the drain is over, so a reload sent during
+	// a shutdown does not kill the process.
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	watchCertificates(watchCtx, certs, cfg.TLS.ReloadInterval.Duration)
+
+	handler := newHandler(cfg)
+
+	// Failed emails are logged whichever handler is used.
+	logService := &service.Service{}
+	onFailed := func(e *email.Email, err error) {
+		logService.OnEmailFailed(email.EmailUser{Email: e.Envelope.From}, e.RcptTo, e.Raw, err)
+	}
+	if cfg.DeadLetters.Dir != "" {
+		deadLetters, err := email.NewDeadLetters(cfg.DeadLetters.Dir)
+		if err != nil {
+			return err
+		}
+		logFailed := onFailed
+		onFailed = func(e *email.Email, err error) {
+			logFailed(e, err)
+			deadLetters.OnFailed(e, err)
+		}
+	}
+
+	backend := email.NewBackend(nil, nil, cfg.TrustedDomains)
+	backend.OnFailed = onFailed
+	backend.Handler = email.Chain(handler, email.Logging())
+	backend.ReturnPath = cfg.Server.ReturnPath
+	backend.HandlerTimeout = cfg.Server.HandlerTimeout.Duration
+
+	if cfg.Auth.HtpasswdFile != "" {
+		store, err := email.NewHtpasswdStore(cfg.Auth.HtpasswdFile)
+		if err != nil {
+			return err
+		}
+		backend.Credentials = store
+	}
+
+	if cfg.Recipients.File != "" {
+		recipients, err := email.NewStaticRecipients(cfg.Recipients.File)
+		if err != nil {
+			return err
+		}
+		backend.Recipients = recipients
+	}
+
+	if cfg.Limits.Enabled() {
+		exempt, err := config.ParseNetworks(cfg.Limits.Exempt)
+		if err != nil {
+			return err
+		}
+		backend.Limiter = email.NewLimiter(email.Limits{
+			ConnectionsPerIP:  cfg.Limits.ConnectionsPerIP,
+			MessagesPerMinute: cfg.Limits.MessagesPerMinute,
+			RecipientsPerHour: cfg.Limits.RecipientsPerHour,
+			IPv4Prefix:        cfg.Limits.IPv4Prefix,
+			IPv6Prefix:        cfg.Limits.IPv6Prefix,
+			Exempt:            exempt,
+		})
+	}
+
+	if cfg.Greylist.Enabled {
+		exempt, err := config.ParseNetworks(cfg.Greylist.Exempt)
+		if err != nil {
+			return err
+		}
+		greylist, err := email.NewGreylist(cfg.Greylist.File, cfg.Greylist.Delay.Duration, cfg.Greylist.RetryWindow.Duration, cfg.Greylist.Whitelist.Duration)
+		if err != nil {
+			return err
+		}
+		greylist.Exempt = exempt
+		greylist.IPv4Prefix = cfg.Greylist.IPv4Prefix
+		greylist.IPv6Prefix = cfg.Greylist.IPv6Prefix
+		backend.Greylist = greylist
+		go greylist.Run(ctx, time.Minute)
+		defer func() {
+			// Keep the triplets recorded while draining.
+			if err := greylist.Save(); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+		}()
+	}
+
+	if len(cfg.DNSBL.Lists) > 0 {
+		dnsbl, err := newDNSBL(cfg.DNSBL)
+		if err != nil {
+			return err
+		}
+		backend.DNSBL = dnsbl
+	}
+
+	if cfg.Spool.Dir != "" {
+		spool, err := email.NewSpool(cfg.Spool.Dir, handler)
+		if err != nil {
+			return err
+		}
+		spool.Workers = cfg.Spool.Workers
+		spool.Timeout = cfg.Server.HandlerTimeout.Duration
+		spool.Backoff = cfg.Spool.Backoff.Duration
+		spool.MaxBackoff = cfg.Spool.MaxBackoff.Duration
+		spool.MaxAge = cfg.Spool.MaxAge.Duration
+		spool.OnFailed = onFailed
+		backend.Handler = email.Chain(spool, email.Logging())
+
+		// Deliveries run until the server has shut down; the ones still in
+		// progress then are retried on the next start.
+		spoolCtx, stopSpool := context.WithCancel(context.Background())
+		spoolDone := make(chan struct{})
+		go func() {
+			spool.Run(spoolCtx)
+			close(spoolDone)
+		}()
+		defer func() {
+			stopSpool()
+			<-spoolDone
+		}()
+	}
+
+	srv, err := server.New(cfg, backend, tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process
+
+	log.Printf("[INFO] Shutting down, waiting up to %s for open sessions", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+
+	report, err := srv.Shutdown(shutdownCtx)
+	logDrainReport(report)
+	if err != nil && err != context.DeadlineExceeded {
+		return err
+	}
+	return <-serveErr
+}
+
+// newDNSBL builds the blocklist checker, using the configured DNS server
+// instead of the system resolver when one is set.
+func newDNSBL(cfg config.DNSBL) (*email.DNSBL, error) {
+	exempt, err := config.ParseNetworks(cfg.Exempt)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsbl := &email.DNSBL{
+		Threshold: cfg.Threshold,
+		Action:    cfg.Action,
+		Timeout:   cfg.Timeout.Duration,
+		Exempt:    exempt,
+	}
+	for _, l := range cfg.Lists {
+		weight := l.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		dnsbl.Zones = append(dnsbl.Zones, email.DNSBLZone{Zone: l.Zone, Weight: weight})
+	}
+
+	if cfg.Resolver != "" {
+		dnsbl.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, cfg.Resolver)
+			},
+		}
+	}
+	return dnsbl, nil
+}
+
+// watchCertificates reloads certs on SIGHUP and, when interval is set, when
+// the files change on disk, until ctx is done. SIGHUP is handled even when
+// certs is nil, so that a reload sent to a server without TLS does not
+// terminate it.
+func watchCertificates(ctx context.Context, certs *server.CertStore, interval time.Duration) {
+	if certs != nil && interval > 0 {
+		go certs.Watch(ctx, interval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if certs == nil {
+					log.Println("[INFO] SIGHUP received, no TLS certificates to reload")
+					continue
+				}
+				log.Println("[INFO] SIGHUP received, reloading TLS certificates")
+				if err := certs.Reload(); err != nil {
+					log.Printf("[ERROR] TLS reload failed, keeping previous certificates: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// logDrainReport logs the sessions and handlers abandoned by a shutdown.
+func logDrainReport(report *email.DrainReport) {
+	if report == nil || report.Empty() {
+		log.Println("[INFO] Shutdown complete, all sessions finished")
+		return
+	}
+
+	log.Printf("[WARN] Shutdown deadline reached: abandoned %d session(s) and %d running handler(s)", len(report.Sessions), len(report.Handlers))
+	for _, s := range report.Sessions {
+		log.Printf("[WARN]   session %s (helo %q, from %q, %d recipient(s), undelivered message: %v)", s.RemoteAddr, s.Hostname, s.From, s.Recipients, s.Pending)
+	}
+	for _, id := range report.Handlers {
+		log.Printf("[WARN]   handler still running for email %s", id)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/server"
+)
+
+// logBuffer collects the output of the standard logger.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// waitFor fails the test unless s is logged within a few seconds.
+func (b *logBuffer) waitFor(t *testing.T, s string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		b.mu.Lock()
+		found := strings.Contains(b.buf.String(), s)
+		b.mu.Unlock()
+		if found {
+			return
+		}
+	}
+	t.Fatalf("%q not logged", s)
+}
+
+// captureLog redirects the standard logger until the test ends.
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+func sighup(t *testing.T) {
+	t.Helper()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Skipf("cannot send SIGHUP: %v", err)
+	}
+}
+
+// Without certificates, SIGHUP is handled rather than terminating the
+// process with the default action.
+func TestWatchCertificatesWithoutTLS(t *testing.T) {
+	logs := captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchCertificates(ctx, nil, time.Second)
+
+	sighup(t)
+	logs.waitFor(t, "SIGHUP received, no TLS certificates to reload")
+}
+
+// SIGHUP reloads the certificates; a failed reload keeps the ones loaded.
+func TestWatchCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	if err := runGenCert([]string{"-domain", "mx.example.com", "-dir", dir}); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := server.NewCertStore(dir, "", "", "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchCertificates(ctx, certs, 0)
+
+	sighup(t)
+	logs.waitFor(t, "TLS: loaded 1 certificate(s)")
+
+	if err := os.WriteFile(filepath.Join(dir, "mx.example.com.crt"), []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sighup(t)
+	logs.waitFor(t, "TLS reload failed, keeping previous certificates")
+	if _, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "mx.example.com"}); err != nil {
+		t.Errorf("no certificate after a failed reload: %v", err)
+	}
+}
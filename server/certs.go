@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertStore serves TLS certificates selected by SNI. Certificates are loaded
+// from a directory of <name>.crt/<name>.key pairs and, optionally, a single
+// cert/key pair; each certificate is indexed by its DNS names (wildcards
+// included). The store can be reloaded at any time without restarting the
+// listeners, since tls.Config asks it for a certificate on every handshake.
+type CertStore struct {
+	Dir      string // directory of <name>.crt/<name>.key pairs, optional
+	CertFile string // single certificate, optional
+	KeyFile  string
+	Default  string // name whose certificate is used when SNI matches nothing
+
+	mu       sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	stamp    string // file sizes and mtimes of the loaded set
+}
+
+// NewCertStore loads the certificates and returns the store. It fails when no
+// certificate could be loaded.
+func NewCertStore(dir, certFile, keyFile, defaultName string) (*CertStore, error) {
+	c := &CertStore{Dir: dir, CertFile: certFile, KeyFile: keyFile, Default: defaultName}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// TLSConfig returns a TLS configuration backed by the store.
+func (c *CertStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// GetCertificate picks the certificate matching the client's SNI name, then
+// the wildcard for its parent domain, then the default certificate.
+func (c *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := c.byName[name]; ok {
+			return cert, nil
+		}
+		if _, parent, ok := strings.Cut(name, "."); ok {
+			if cert, ok := c.byName["*."+parent]; ok {
+				return cert, nil
+			}
+		}
+	}
+
+	if c.fallback == nil {
+		return nil, errors.New("tls: no certificate available")
+	}
+	return c.fallback, nil
+}
+
+// Reload reads every certificate again and swaps them in atomically. On error
+// the previously loaded certificates stay in use.
+func (c *CertStore) Reload() error {
+	pairs, stamp, err := c.pairs()
+	if err != nil {
+		return err
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	var fallback *tls.Certificate
+	for _, p := range pairs {
+		cert, err := tls.LoadX509KeyPair(p[0], p[1])
+		if err != nil {
+			return fmt.Errorf("tls: loading %s: %w", p[0], err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("tls: parsing %s: %w", p[0], err)
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, n := range names {
+			n = strings.ToLower(n)
+			if _, taken := byName[n]; !taken {
+				byName[n] = &cert
+			}
+		}
+		if fallback == nil {
+			fallback = &cert
+		}
+	}
+
+	if len(byName) == 0 && fallback == nil {
+		return errors.New("tls: no certificates found")
+	}
+	if cert, ok := byName[strings.ToLower(c.Default)]; ok {
+		fallback = cert
+	}
+
+	c.mu.Lock()
+	c.byName, c.fallback, c.stamp = byName, fallback, stamp
+	c.mu.Unlock()
+
+	log.Printf("[INFO] TLS: loaded %d certificate(s) for %d name(s)", len(pairs), len(byName))
+	return nil
+}
+
+// pairs lists the cert/key files to load, the single pair first, together
+// with a stamp that changes whenever one of them does.
+func (c *CertStore) pairs() ([][2]string, string, error) {
+	var pairs [][2]string
+	if c.CertFile != "" {
+		pairs = append(pairs, [2]string{c.CertFile, c.KeyFile})
+	}
+
+	if c.Dir != "" {
+		matches, err := filepath.Glob(filepath.Join(c.Dir, "*.crt"))
+		if err != nil {
+			return nil, "", err
+		}
+		sort.Strings(matches)
+		for _, crt := range matches {
+			key := strings.TrimSuffix(crt, ".crt") + ".key"
+			if _, err := os.Stat(key); err != nil {
+				log.Printf("[WARNING] TLS: skipping %s, no matching key file", crt)
+				continue
+			}
+			pairs = append(pairs, [2]string{crt, key})
+		}
+	}
+
+	var stamp strings.Builder
+	for _, p := range pairs {
+		for _, f := range p {
+			info, err := os.Stat(f)
+			if err != nil {
+				return nil, "", fmt.Errorf("tls: %w", err)
+			}
+			fmt.Fprintf(&stamp, "%s:%d:%d;", f, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return pairs, stamp.String(), nil
+}
+
+// Watch polls the certificate files every interval and reloads the store when
+// they change, until ctx is done.
+func (c *CertStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, stamp, err := c.pairs()
+		if err != nil {
+			log.Printf("[WARNING] TLS: checking certificates: %v", err)
+			continue
+		}
+
+		c.mu.RLock()
+		changed := stamp != c.stamp
+		c.mu.RUnlock()
+
+		if changed {
+			if err := c.Reload(); err != nil {
+				log.Printf("[ERROR] TLS: reload failed, keeping previous certificates: %v", err)
+			}
+		}
+	}
+}
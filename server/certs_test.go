@@ -0,0 +1,155 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed <name>.crt/<name>.key pair for dnsNames to
+// dir and returns the certificate file.
+func writeCert(t *testing.T, dir, name string, dnsNames ...string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt := filepath.Join(dir, name+".crt")
+	if err := os.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+// certFor returns the common name of the certificate served for sni.
+func certFor(t *testing.T, c *CertStore, sni string) string {
+	t.Helper()
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+	if err != nil {
+		t.Fatalf("%q: %v", sni, err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "a", "mx.example.com", "smtp.example.com")
+	writeCert(t, dir, "b", "*.example.org")
+	writeCert(t, dir, "c", "mx.example.net")
+
+	c, err := NewCertStore(dir, "", "", "mx.example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		sni, want string
+	}{
+		{"mx.example.com", "a"},
+		{"SMTP.Example.com.", "a"},
+		{"mx.example.org", "b"},   // wildcard
+		{"a.mx.example.org", "c"}, // the wildcard covers one label only
+		{"example.org", "c"},      // nor the parent domain itself
+		{"unknown.example", "c"},  // default
+		{"", "c"},                 // no SNI
+		{"mx.example.net", "c"},
+	} {
+		if got := certFor(t, c, tt.sni); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.sni, got, tt.want)
+		}
+	}
+}
+
+// Without a default name, the single pair is the fallback, and without it
+// the first certificate of the directory.
+func TestCertStoreFallback(t *testing.T) {
+	dir := t.TempDir()
+	writeCert(t, dir, "b", "mx.example.org")
+	writeCert(t, dir, "c", "mx.example.net")
+	single := t.TempDir()
+	crt := writeCert(t, single, "a", "mx.example.com")
+
+	c, err := NewCertStore(dir, crt, filepath.Join(single, "a.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := certFor(t, c, "unknown.example"); got != "a" {
+		t.Errorf("with the single pair: fallback %s, want a", got)
+	}
+
+	c, err = NewCertStore(dir, "", "", "unknown.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := certFor(t, c, "unknown.example"); got != "b" {
+		t.Errorf("directory only: fallback %s, want b", got)
+	}
+}
+
+// A failed reload keeps the certificates loaded before.
+func TestCertStoreReloadFailure(t *testing.T) {
+	dir := t.TempDir()
+	crt := writeCert(t, dir, "a", "mx.example.com")
+	c, err := NewCertStore(dir, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeCert(t, dir, "b", "mx.example.org")
+	if err := os.WriteFile(crt, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Fatal("Reload succeeded with a broken certificate")
+	}
+	if got := certFor(t, c, "mx.example.com"); got != "a" {
+		t.Errorf("after a failed reload: %s, want a", got)
+	}
+	if got := certFor(t, c, "mx.example.org"); got != "a" {
+		t.Errorf("certificate of the failed reload served: %s", got)
+	}
+
+	if err := os.Remove(crt); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := certFor(t, c, "mx.example.org"); got != "b" {
+		t.Errorf("after a good reload: %s, want b", got)
+	}
+}
+
+func TestCertStoreEmpty(t *testing.T) {
+	if _, err := NewCertStore(t.TempDir(), "", "", ""); err == nil {
+		t.Error("NewCertStore succeeded without certificates")
+	}
+}
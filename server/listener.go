@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/emersion/go-smtp"
+)
+
+// drainListener wraps a net.Listener so that, once draining, new connections
+// are answered with a 421 reply and closed instead of being handed to the
+// SMTP server.
+type drainListener struct {
+	net.Listener
+	domain   string
+	draining atomic.Bool
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !l.draining.Load() {
+			return c, nil
+		}
+		go l.reject(c)
+	}
+}
+
+// Drain makes the listener reject every connection accepted from now on.
+func (l *drainListener) Drain() {
+	l.draining.Store(true)
+}
+
+func (l *drainListener) reject(c net.Conn) {
+	email.Reject(c, l.domain, email.ErrShuttingDown)
+}
+
+// limitListener enforces the per-client connection limit of a Limiter as
+// connections are accepted, so a client is counted from the moment it
+// connects, whether or not it ever greets. Clients over the limit get a 421
+// reply in place of the greeting and are disconnected; the others count
+// until their connection is closed. The address of a PROXY protocol client
+// is only known once the header has arrived, so every connection is checked
+// on its own goroutine and Accept returns the ones that were admitted.
+type limitListener struct {
+	net.Listener
+	Limiter *email.Limiter
+	Domain  string
+
+	once     sync.Once
+	accepted chan acceptResult
+	done     chan struct{} // closed when the listener fails for good
+	err      error         // the error that closed done
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		l.accepted = make(chan acceptResult)
+		l.done = make(chan struct{})
+		go l.acceptLoop()
+	})
+
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *limitListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			// Let the server back off from temporary errors, as it does
+			// for its own listeners.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				l.accepted <- acceptResult{err: err}
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.admit(c)
+	}
+}
+
+// admit counts c against its client's limit and hands it to Accept, or
+// rejects it.
+func (l *limitListener) admit(c net.Conn) {
+	ip := clientIP(c)
+	if err := l.Limiter.Connect(ip); err != nil {
+		log.Printf("[WARNING] rejecting connection from %s: %v", ip, err)
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) {
+			smtpErr = email.ErrTooManyConnections
+		}
+		email.Reject(c, l.Domain, smtpErr)
+		return
+	}
+
+	lc := &limitConn{Conn: c, release: func() { l.Limiter.Disconnect(ip) }}
+	select {
+	case l.accepted <- acceptResult{conn: lc}:
+	case <-l.done:
+		lc.Close()
+	}
+}
+
+// limitConn releases its slot in the Limiter when it is closed.
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// clientIP returns the IP address of the peer of c, or nil for non-IP
+// connections such as unix sockets. For a PROXY protocol connection this
+// waits for the header.
+func clientIP(c net.Conn) net.IP {
+	if tcp, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
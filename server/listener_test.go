@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/TrueFix/getmail/internal/smtptest"
+)
+
+// A client over the limit gets 421 before it sends anything and is
+// disconnected; closing an admitted connection frees its slot.
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &limitListener{
+		Listener: inner,
+		Limiter:  email.NewLimiter(email.Limits{ConnectionsPerIP: 2}),
+		Domain:   "mx.example.com",
+	}
+	defer l.Close()
+
+	dial := func() net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	accept := func() net.Conn {
+		t.Helper()
+		type result struct {
+			c   net.Conn
+			err error
+		}
+		ch := make(chan result, 1)
+		go func() {
+			c, err := l.Accept()
+			ch <- result{c, err}
+		}()
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			return r.c
+		case <-time.After(5 * time.Second):
+			t.Fatal("Accept did not return")
+			return nil
+		}
+	}
+
+	dial()
+	first := accept()
+	dial()
+	accept()
+
+	over := smtptest.Dial(t, "tcp", inner.Addr().String())
+	over.Expect("421 4.7.0 mx.example.com ")
+	over.ExpectClosed()
+
+	first.Close()
+	dial()
+	accept()
+}
+
+// Once drained, the listener answers new connections with 421 and closes
+// them; connections accepted before are left alone.
+func TestDrainListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &drainListener{Listener: inner, domain: "mx.example.com"}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	smtptest.Dial(t, "tcp", inner.Addr().String())
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return")
+	}
+
+	l.Drain()
+	after := smtptest.Dial(t, "tcp", inner.Addr().String())
+	after.Expect("421 4.3.2 mx.example.com Service shutting down, try again later\r\n")
+	after.ExpectClosed()
+	select {
+	case <-accepted:
+		t.Error("connection accepted while draining")
+	default:
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV1Prefix and proxyV2Signature start every PROXY protocol version 1
+// and version 2 header.
+var (
+	proxyV1Prefix    = []byte("PROXY")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyListener accepts connections from load balancers that prepend an
+// HAProxy PROXY protocol (v1 or v2) header, so RemoteAddr reports the real
+// client. Only peers inside Trusted may send the header, and they must;
+// connections from anywhere else are passed through untouched.
+type proxyListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Timeout time.Duration // how long to wait for the header
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	// The header is read lazily so a slow peer can't block Accept.
+	return &proxyConn{Conn: c, r: bufio.NewReader(c), timeout: l.Timeout}, nil
+}
+
+func (l *proxyListener) trusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn is a connection whose first bytes are a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+
+	mu       sync.Mutex
+	inHeader bool      // the header is being read under its own deadline
+	deadline time.Time // read deadline last set by the SMTP server
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.mu.Lock()
+			c.inHeader = true
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			c.mu.Unlock()
+
+			// Put back the deadline the server set meanwhile, so the first
+			// command and an implicit TLS handshake are still bounded.
+			defer func() {
+				c.mu.Lock()
+				c.inHeader = false
+				c.Conn.SetReadDeadline(c.deadline)
+				c.mu.Unlock()
+			}()
+		}
+		c.remote, c.local, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			log.Printf("[WARNING] PROXY protocol from %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// SetReadDeadline records t and applies it, unless the header is still being
+// read, in which case it is applied once the header is done.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	if c.inHeader {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetDeadline sets the read deadline as SetReadDeadline does.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the client address announced in the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address announced in the header.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader parses a v1 or v2 header. Nil addresses mean the proxy sent
+// no address information (v1 UNKNOWN, v2 LOCAL or an unsupported family), in
+// which case the connection's own addresses apply.
+//
+// Only the first five bytes are peeked to tell the versions apart: a client
+// sends nothing after a short v1 header such as "PROXY UNKNOWN\r\n" until it
+// has been greeted, so waiting for more would stall the connection.
+func readProxyHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	peek, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading header: %w", err)
+	}
+	switch {
+	case bytes.Equal(peek, proxyV2Signature[:len(proxyV1Prefix)]):
+		return readProxyV2(r)
+	case bytes.Equal(peek, proxyV1Prefix):
+		return readProxyV1(r)
+	default:
+		return nil, nil, errors.New("missing PROXY protocol header")
+	}
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6|UNKNOWN src dst sport dport\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // maximum v1 header length
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long or not CRLF terminated")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[0] == "PROXY" && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 parses the binary header: signature, version/command,
+// family/transport, length and the address block, skipping any TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, nil, errors.New("invalid v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13] >> 4
+	length := binary.BigEndian.Uint16(hdr[14:16])
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL: health check from the proxy itself
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, nil, errors.New("short v2 IPv4 address block")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		return src, dst, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, nil, errors.New("short v2 IPv6 address block")
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		return src, dst, nil
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil, nil
+	}
+}
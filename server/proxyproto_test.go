@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header with the given command, family and address block.
+func proxyV2(command, family byte, addrs []byte) string {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(addrs)))
+	return string(append(hdr, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x30, 0x39, 0, 25}
+	ipv6 := make([]byte, 36)
+	copy(ipv6[0:16], net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:34], 12345)
+	binary.BigEndian.PutUint16(ipv6[34:36], 25)
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0, 1, 'x') // PP2_TYPE_NOOP
+
+	tests := []struct {
+		name   string
+		input  string
+		remote string // "" for no address
+		local  string
+		err    string
+	}{
+		{name: "v1 TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\nEHLO x\r\n", remote: "192.0.2.1:12345", local: "198.51.100.2:25"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 25\r\n", remote: "[2001:db8::1]:12345", local: "[2001:db8::2]:25"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN 192.0.2.1 198.51.100.2 12345 25\r\n"},
+		{name: "v1 bad address", input: "PROXY TCP4 192.0.2 198.51.100.2 12345 25\r\n", err: "invalid address"},
+		{name: "v1 bad port", input: "PROXY TCP4 192.0.2.1 198.51.100.2 123456 25\r\n", err: "invalid port"},
+		{name: "v1 missing fields", input: "PROXY TCP4 192.0.2.1\r\n", err: "malformed v1 header"},
+		{name: "v1 too long", input: "PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", err: "too long"},
+		{name: "v1 without CRLF", input: "PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\n", err: "not CRLF terminated"},
+		{name: "v1 truncated", input: "PROXY TCP4 192.0.2.1", err: "reading v1 header"},
+		{name: "v2 PROXY IPv4", input: proxyV2(0x1, 0x1, ipv4), remote: "192.0.2.1:12345", local: "198.51.100.2:25"},
+		{name: "v2 PROXY IPv6", input: proxyV2(0x1, 0x2, ipv6), remote: "[2001:db8::1]:12345", local: "[2001:db8::2]:25"},
+		{name: "v2 PROXY with TLVs", input: proxyV2(0x1, 0x1, withTLV), remote: "192.0.2.1:12345", local: "198.51.100.2:25"},
+		{name: "v2 LOCAL", input: proxyV2(0x0, 0x0, nil)},
+		{name: "v2 LOCAL with addresses", input: proxyV2(0x0, 0x1, ipv4)},
+		{name: "v2 AF_UNIX", input: proxyV2(0x1, 0x3, make([]byte, 216))},
+		{name: "v2 short IPv4 block", input: proxyV2(0x1, 0x1, ipv4[:8]), err: "short v2 IPv4 address block"},
+		{name: "v2 short IPv6 block", input: proxyV2(0x1, 0x2, ipv6[:32]), err: "short v2 IPv6 address block"},
+		{name: "v2 truncated block", input: proxyV2(0x1, 0x1, ipv4)[:20], err: "reading v2 addresses"},
+		{name: "v2 bad command", input: proxyV2(0x2, 0x1, ipv4), err: "unsupported v2 command"},
+		{name: "v2 bad signature", input: "\r\n\r\n\x00\r\nQUIX\n" + proxyV2(0x1, 0x1, ipv4)[12:], err: "invalid v2 signature"},
+		{name: "v1 prefix only", input: "PROXYTCP4 192.0.2.1 198.51.100.2 12345 25\r\n", err: "malformed v1 header"},
+		{name: "missing header", input: "EHLO client.example.com\r\n", err: "missing PROXY protocol header"},
+		{name: "empty", input: "", err: "reading header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, local, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := addrString(remote); got != tt.remote {
+				t.Errorf("remote = %q, want %q", got, tt.remote)
+			}
+			if got := addrString(local); got != tt.local {
+				t.Errorf("local = %q, want %q", got, tt.local)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderLeavesData(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\nEHLO x\r\n"))
+	if _, _, err := readProxyHeader(r); err != nil {
+		t.Fatal(err)
+	}
+	line, _ := r.ReadString('\n')
+	if line != "EHLO x\r\n" {
+		t.Errorf("data after header = %q", line)
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		trusted string
+		proxied bool
+	}{
+		{"trusted peer", "127.0.0.0/8", true},
+		{"peer outside Trusted", "10.0.0.0/8", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, network, _ := net.ParseCIDR(tt.trusted)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			pl := &proxyListener{Listener: ln, Trusted: []*net.IPNet{network}, Timeout: time.Second}
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\n"))
+
+			c, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			_, proxied := c.(*proxyConn)
+			if proxied != tt.proxied {
+				t.Fatalf("proxied = %v, want %v", proxied, tt.proxied)
+			}
+			want := client.LocalAddr().String()
+			if tt.proxied {
+				want = "192.0.2.1:12345"
+			}
+			if got := c.RemoteAddr().String(); got != want {
+				t.Errorf("RemoteAddr = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+// The read deadline set by the SMTP server before the header was read must
+// still apply afterwards.
+func TestProxyConnKeepsReadDeadline(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	c := &proxyConn{Conn: server, r: bufio.NewReader(server), timeout: time.Minute}
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\n"))
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Read error = %v, want a deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read is not bounded by the read deadline")
+	}
+	if got := c.RemoteAddr().String(); got != "192.0.2.1:12345" {
+		t.Errorf("RemoteAddr = %s", got)
+	}
+}
+
+// Short headers must be parsed as soon as they arrive: the client behind the
+// proxy sends nothing more until it has been greeted.
+func TestProxyConnShortHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header string
+		remote string
+	}{
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "pipe"},
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\n", "192.0.2.1:12345"},
+		{"v2 LOCAL", proxyV2(0x0, 0x0, nil), "pipe"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			// No timeout: a parser waiting for more bytes would block forever.
+			c := &proxyConn{Conn: server, r: bufio.NewReader(server)}
+			go client.Write([]byte(tt.header))
+
+			done := make(chan string, 1)
+			go func() { done <- c.RemoteAddr().String() }()
+
+			select {
+			case got := <-done:
+				if got != tt.remote {
+					t.Errorf("RemoteAddr = %s, want %s", got, tt.remote)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("header not parsed while the connection stays open")
+			}
+
+			// The connection is still usable after the header.
+			go client.Write([]byte("EHLO x\r\n"))
+			line, err := c.r.ReadString('\n')
+			if err != nil || line != "EHLO x\r\n" {
+				t.Errorf("data after header = %q, %v", line, err)
+			}
+		})
+	}
+}
+
+// A peer that never sends the header is dropped after the timeout.
+func TestProxyConnHeaderTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	c := &proxyConn{Conn: server, r: bufio.NewReader(server), timeout: 50 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Read succeeded without a header")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("header read is not bounded by the timeout")
+	}
+}
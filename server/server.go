@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/TrueFix/getmail/config"
+	"github.com/TrueFix/getmail/email"
+	"github.com/emersion/go-smtp"
+)
+
+// Server runs one SMTP server per configured listener on top of a shared
+// email.Backend and shuts them down gracefully.
+type Server struct {
+	Backend *email.Backend
+
+	listeners []*listener
+}
+
+// listener is one configured address with its own SMTP server and policy.
+type listener struct {
+	cfg     config.Listener
+	smtp    *smtp.Server
+	limiter *email.Limiter // enforces the connection limit, nil when off
+
+	mu sync.Mutex
+	ln *drainListener
+}
+
+// New configures an SMTP server for every listener in cfg. tlsConfig may be
+// nil, in which case STARTTLS is not offered.
+func New(cfg *config.Config, backend *email.Backend, tlsConfig *tls.Config) (*Server, error) {
+	srv := &Server{Backend: backend}
+
+	for _, lc := range cfg.ResolvedListeners() {
+		if lc.TLSMode == config.TLSModeImplicit && tlsConfig == nil {
+			return nil, fmt.Errorf("listener %s: implicit TLS requires a certificate", lc.Name)
+		}
+		if lc.RequireAuth && backend.Credentials == nil {
+			return nil, fmt.Errorf("listener %s: require_auth requires SMTP AUTH credentials", lc.Name)
+		}
+
+		s := smtp.NewServer(backend.WithPolicy(email.Policy{
+			Listener:       lc.Name,
+			RequireAuth:    lc.RequireAuth,
+			TrustedDomains: lc.TrustedDomains,
+		}))
+		s.Network = lc.Network
+		s.Addr = lc.Addr
+		s.LMTP = lc.Protocol == config.ProtocolLMTP
+		s.Domain = cfg.Server.Domain
+		if tlsConfig != nil && lc.TLSMode != config.TLSModeNone {
+			s.TLSConfig = tlsConfig
+		}
+
+		s.AllowInsecureAuth = lc.AllowInsecureAuth
+		s.WriteTimeout = lc.WriteTimeout.Duration
+		s.ReadTimeout = lc.ReadTimeout.Duration
+		s.MaxMessageBytes = *lc.MaxMessageBytes
+		s.MaxRecipients = *lc.MaxRecipients
+
+		// Accept the SMTPUTF8 and DSN parameters so they can be recorded in
+		// Email.Envelope.
+		s.EnableSMTPUTF8 = true
+		s.EnableDSN = true
+
+		srv.listeners = append(srv.listeners, &listener{cfg: lc, smtp: s, limiter: backend.Limiter})
+	}
+
+	return srv, nil
+}
+
+// ListenAndServe opens every listener and serves connections until the
+// server is shut down. If any listener fails, the others are closed and the
+// first error is returned.
+func (s *Server) ListenAndServe() error {
+	for _, l := range s.listeners {
+		if err := l.listen(); err != nil {
+			s.close()
+			return err
+		}
+	}
+
+	errs := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func() {
+			log.Printf("[INFO] %s listener %s on %s %s (TLS: %s)", strings.ToUpper(l.cfg.Protocol), l.cfg.Name, l.cfg.Network, l.cfg.Addr, l.cfg.TLSMode)
+			err := l.smtp.Serve(l.ln)
+			if errors.Is(err, smtp.ErrServerClosed) {
+				err = nil
+			}
+			if err != nil {
+				err = fmt.Errorf("listener %s: %w", l.cfg.Name, err)
+			}
+			errs <- err
+		}()
+	}
+
+	var first error
+	for range s.listeners {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			s.close()
+		}
+	}
+	return first
+}
+
+func (l *listener) listen() error {
+	if l.cfg.Network == "unix" {
+		// Remove a socket left behind by a previous run.
+		if info, err := os.Stat(l.cfg.Addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.cfg.Addr)
+		}
+	}
+
+	ln, err := net.Listen(l.cfg.Network, l.cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("listener %s: %w", l.cfg.Name, err)
+	}
+	if l.cfg.ProxyProtocol {
+		trusted, err := config.ParseNetworks(l.cfg.TrustedProxies)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("listener %s: %w", l.cfg.Name, err)
+		}
+		ln = &proxyListener{Listener: ln, Trusted: trusted, Timeout: l.smtp.ReadTimeout}
+	}
+	if l.limiter != nil {
+		ln = &limitListener{Listener: ln, Limiter: l.limiter, Domain: l.smtp.Domain}
+	}
+	if len(l.cfg.XClientPeers) > 0 {
+		trusted, err := config.ParseNetworks(l.cfg.XClientPeers)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("listener %s: %w", l.cfg.Name, err)
+		}
+		ln = &xclientListener{Listener: ln, Trusted: trusted, Domain: l.smtp.Domain}
+	}
+	if l.cfg.TLSMode == config.TLSModeImplicit {
+		ln = tls.NewListener(ln, l.smtp.TLSConfig)
+	}
+
+	l.mu.Lock()
+	l.ln = &drainListener{Listener: ln, domain: l.smtp.Domain}
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *listener) drain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln != nil {
+		l.ln.Drain()
+	}
+}
+
+// close closes every listener and connection immediately.
+func (s *Server) close() error {
+	var first error
+	for _, l := range s.listeners {
+		if err := l.smtp.Close(); err != nil && !errors.Is(err, smtp.ErrServerClosed) && first == nil {
+			first = err
+		}
+
+		// Close the socket ourselves in case Serve was never started.
+		l.mu.Lock()
+		if l.ln != nil {
+			l.ln.Close()
+		}
+		l.mu.Unlock()
+	}
+	return first
+}
+
+// Shutdown stops accepting work and waits for open sessions and running
+// handlers to finish. New connections are answered with 421 meanwhile. When
+// ctx expires first, the remaining connections are closed and the returned
+// report lists what was abandoned.
+func (s *Server) Shutdown(ctx context.Context) (*email.DrainReport, error) {
+	for _, l := range s.listeners {
+		l.drain()
+	}
+	s.Backend.Drain()
+
+	report := &email.DrainReport{}
+	waitErr := s.Backend.Wait(ctx)
+	if waitErr != nil {
+		report = s.Backend.Report()
+	}
+
+	if err := s.close(); err != nil {
+		return report, err
+	}
+	return report, waitErr
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/config"
+	"github.com/TrueFix/getmail/email"
+	"github.com/TrueFix/getmail/internal/smtptest"
+)
+
+// credentialsFunc adapts a function to email.CredentialStore.
+type credentialsFunc func(ctx context.Context, username, password string) error
+
+func (f credentialsFunc) Authenticate(ctx context.Context, username, password string) error {
+	return f(ctx, username, password)
+}
+
+// loadConfig writes data as the configuration file, with $DIR replaced by a
+// temporary directory, and loads it.
+func loadConfig(t *testing.T, data string) (*config.Config, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "getmail.json")
+	if err := os.WriteFile(path, []byte(strings.ReplaceAll(data, "$DIR", dir)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, dir
+}
+
+// startServer runs srv until the test ends and waits for its sockets.
+func startServer(t *testing.T, srv *Server, sockets ...string) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- srv.ListenAndServe() }()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		if err := <-done; err != nil {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	})
+
+	for _, path := range sockets {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(path); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not listening", path)
+			}
+		}
+	}
+}
+
+// Each listener applies its own policy to sessions that feed the same
+// backend: "mx" accepts only its trusted domain and inherits the server's
+// recipient limit, "smtps" speaks TLS from the first byte, requires AUTH
+// and turns the recipient limit off with an explicit 0.
+func TestServerListeners(t *testing.T) {
+	cfg, dir := loadConfig(t, `{
+		"server": {"domain": "mx.example.com", "max_recipients": 1},
+		"auth": {"htpasswd_file": "$DIR/htpasswd"},
+		"tls": {"cert_dir": "$DIR"},
+		"trusted_domains": ["example.com"],
+		"listeners": [
+			{"name": "mx", "network": "unix", "addr": "$DIR/mx.sock", "tls_mode": "none"},
+			{"name": "smtps", "network": "unix", "addr": "$DIR/smtps.sock", "tls_mode": "implicit",
+			 "require_auth": true, "allow_insecure_auth": true, "trusted_domains": [], "max_recipients": 0}
+		]
+	}`)
+	writeCert(t, dir, "mx.example.com", "mx.example.com")
+	certs, err := NewCertStore(dir, "", "", "mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emails := make(chan *email.Email, 2)
+	backend := &email.Backend{
+		Handler: email.HandlerFunc(func(ctx context.Context, e *email.Email) error {
+			emails <- e
+			return nil
+		}),
+		Credentials: credentialsFunc(func(ctx context.Context, username, password string) error {
+			if username != "bob" || password != "secret" {
+				return email.ErrInvalidCredentials
+			}
+			return nil
+		}),
+	}
+	srv, err := New(cfg, backend, &tls.Config{GetCertificate: certs.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startServer(t, srv, filepath.Join(dir, "mx.sock"), filepath.Join(dir, "smtps.sock"))
+
+	mx := smtptest.Dial(t, "unix", filepath.Join(dir, "mx.sock"))
+	mx.Expect("220 mx.example.com ")
+	mx.Cmd("EHLO client.example.org", "250")
+	mx.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	mx.Cmd("RCPT TO:<carol@example.net>", "550 5.7.1 ")
+	mx.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	mx.Cmd("RCPT TO:<dave@example.com>", "452 ")
+	mx.Cmd("DATA", "354 ")
+	mx.Write(testMessage)
+	mx.Expect("250 ")
+
+	smtps := smtptest.Dial(t, "unix", filepath.Join(dir, "smtps.sock"))
+	smtps.StartTLS(&tls.Config{ServerName: "mx.example.com", InsecureSkipVerify: true})
+	smtps.Expect("220 mx.example.com ")
+	smtps.Cmd("EHLO client.example.org", "250")
+	smtps.Cmd("MAIL FROM:<bob@example.org>", "530 5.7.0 ")
+	smtps.Cmd("AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00bob\x00secret")), "235 ")
+	smtps.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	smtps.Cmd("RCPT TO:<carol@example.net>", "250 ")
+	smtps.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	smtps.Cmd("DATA", "354 ")
+	smtps.Write(testMessage)
+	smtps.Expect("250 ")
+
+	for _, want := range []struct {
+		listener string
+		rcpts    int
+		tls      bool
+	}{{"mx", 1, false}, {"smtps", 2, true}} {
+		e := <-emails
+		if e.Connection.Listener != want.listener || len(e.RcptTo) != want.rcpts || (e.Connection.TLS != nil) != want.tls {
+			t.Errorf("email from %s: %d recipient(s), TLS %+v; want %s, %d, TLS %v",
+				e.Connection.Listener, len(e.RcptTo), e.Connection.TLS, want.listener, want.rcpts, want.tls)
+		}
+	}
+}
+
+// A listener that requires AUTH can't be served by a backend that offers
+// none: every MAIL would be refused.
+func TestNewRequireAuthWithoutCredentials(t *testing.T) {
+	cfg, _ := loadConfig(t, `{
+		"auth": {"htpasswd_file": "$DIR/htpasswd"},
+		"listeners": [{"name": "submission", "network": "unix", "addr": "$DIR/submission.sock", "require_auth": true}]
+	}`)
+	_, err := New(cfg, &email.Backend{}, nil)
+	if err == nil {
+		t.Fatal("New accepted require_auth without credentials")
+	}
+}
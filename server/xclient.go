@@ -0,0 +1,466 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TrueFix/getmail/email"
+)
+
+// xclientCaps are advertised in the EHLO reply to trusted peers.
+var xclientCaps = []string{
+	"XCLIENT NAME ADDR PORT PROTO HELO LOGIN",
+	"XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE",
+}
+
+// xclientListener wraps connections so that peers inside Trusted (typically
+// a Postfix front-end) can use the Postfix XCLIENT and XFORWARD extensions
+// to pass on the original client's attributes. go-smtp has no hook for
+// unknown verbs, so the wrapper sits between the socket and the server:
+// it answers XCLIENT/XFORWARD itself, adds them to the EHLO reply of trusted
+// peers and hands everything else through untouched. Other peers get 502 for
+// both commands. Message data (DATA and BDAT) is never inspected.
+//
+// Commands sent after STARTTLS are encrypted and can't be seen here, so an
+// XCLIENT a relay sent over TLS would be lost. Trusted peers are therefore
+// not offered STARTTLS and get 454 if they try it, which makes relays such
+// as Postfix carry on in plaintext. Other peers may use STARTTLS, after
+// which their connection is passed through as is.
+type xclientListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Domain  string
+}
+
+func (l *xclientListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &xclientConn{Conn: c, r: bufio.NewReader(c), trusted: l.Trusted, domain: l.Domain}, nil
+}
+
+// xclientConn tracks the SMTP dialogue of one connection.
+type xclientConn struct {
+	net.Conn
+	r       *bufio.Reader
+	trusted []*net.IPNet
+	domain  string
+
+	once        sync.Once
+	trustedPeer bool
+
+	mu          sync.Mutex
+	pending     []byte // line being handed to the SMTP server
+	passthrough bool   // STARTTLS was issued
+	midLine     bool   // the previous read ended inside a long line
+	ehlo        bool   // an EHLO reply is expected
+	mailCmd     bool   // MAIL was sent, waiting for the reply
+	inMail      bool   // a transaction is open
+	dataCmd     bool   // DATA was sent, waiting for the 354 reply
+	inData      bool   // inside DATA, until the end-of-data line
+	bdat        int64  // bytes left in the current BDAT chunk
+	xclient     email.ClientAttributes
+	xforward    email.ClientAttributes
+	xforwarded  bool // the transaction XFORWARD applied to has ended
+}
+
+func (c *xclientConn) init() {
+	c.once.Do(func() {
+		tcp, ok := c.Conn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+		for _, n := range c.trusted {
+			if n.Contains(tcp.IP) {
+				c.trustedPeer = true
+				return
+			}
+		}
+	})
+}
+
+// ClientAttributes implements email.ForwardedConn. XFORWARD values, which
+// only last for the current transaction, win over XCLIENT values.
+func (c *xclientConn) ClientAttributes() email.ClientAttributes {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a := c.xclient
+	f := c.xforward
+	if f.Addr != nil {
+		a.Addr, a.Port = f.Addr, f.Port
+	}
+	if f.Name != "" {
+		a.Name = f.Name
+	}
+	if f.Helo != "" {
+		a.Helo = f.Helo
+	}
+	if f.Proto != "" {
+		a.Proto = f.Proto
+	}
+	return a
+}
+
+// RemoteAddr reports the client announced with XCLIENT, if any.
+func (c *xclientConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.xclient.Addr != nil {
+		return &net.TCPAddr{IP: c.xclient.Addr, Port: c.xclient.Port}
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *xclientConn) Read(b []byte) (int, error) {
+	c.init()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.pending) == 0 {
+		switch {
+		case c.passthrough:
+			c.mu.Unlock()
+			n, err := c.r.Read(b)
+			c.mu.Lock()
+			return n, err
+		case c.bdat > 0:
+			if int64(len(b)) > c.bdat {
+				b = b[:c.bdat]
+			}
+			c.mu.Unlock()
+			n, err := c.r.Read(b)
+			c.mu.Lock()
+			c.bdat -= int64(n)
+			return n, err
+		}
+
+		c.mu.Unlock()
+		line, err := c.r.ReadSlice('\n')
+		c.mu.Lock()
+		if len(line) == 0 && err != nil {
+			return 0, err
+		}
+		if err == bufio.ErrBufferFull {
+			// A line longer than the buffer is never one of ours.
+			c.pending = append(c.pending[:0], line...)
+			c.midLine = true
+			break
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if c.midLine || c.inData {
+			c.midLine = false
+			if c.inData && string(line) == ".\r\n" {
+				c.inData = false
+				c.inMail = false
+				c.xforwarded = true
+			}
+			c.pending = append(c.pending[:0], line...)
+			break
+		}
+
+		if c.command(line) {
+			c.pending = append(c.pending[:0], line...)
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// command inspects a command line and reports whether it must be passed on
+// to the SMTP server. Callers must hold c.mu.
+func (c *xclientConn) command(line []byte) bool {
+	verb, arg, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), " ")
+	verb = strings.ToUpper(verb)
+	if (verb == "XCLIENT" || verb == "XFORWARD") && !c.trustedPeer {
+		c.reply("502 5.5.1 %s command not implemented", verb)
+		return false
+	}
+
+	switch verb {
+	case "XCLIENT":
+		// The new identity must not apply to an envelope opened under the
+		// old one.
+		if c.inMail {
+			c.reply("503 5.5.1 Error: MAIL transaction in progress")
+			return false
+		}
+		attrs, err := parseXAttributes(arg, c.xclient, true)
+		if err != nil {
+			c.reply("501 5.5.4 %v", err)
+			return false
+		}
+		c.xclient = attrs
+		c.xforward, c.xforwarded = email.ClientAttributes{}, false
+		// Like Postfix, greet again; the client must start over with EHLO.
+		c.reply("220 %s ESMTP Service Ready", c.domain)
+		return false
+	case "XFORWARD":
+		if c.xforwarded {
+			c.xforward, c.xforwarded = email.ClientAttributes{}, false
+		}
+		attrs, err := parseXAttributes(arg, c.xforward, false)
+		if err != nil {
+			c.reply("501 5.5.4 %v", err)
+			return false
+		}
+		c.xforward = attrs
+		c.reply("250 2.0.0 Ok")
+		return false
+	case "EHLO":
+		c.ehlo = c.trustedPeer
+		c.inMail = false
+	case "HELO":
+		c.inMail = false
+	case "DATA":
+		c.dataCmd = true
+	case "BDAT":
+		fields := strings.Fields(arg)
+		if len(fields) > 0 {
+			if size, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				c.bdat = int64(size)
+			}
+			if len(fields) > 1 && strings.EqualFold(fields[1], "LAST") {
+				c.inMail = false
+				c.xforwarded = true
+			}
+		}
+	case "MAIL":
+		// XFORWARD values only describe the transaction they preceded.
+		if c.xforwarded {
+			c.xforward, c.xforwarded = email.ClientAttributes{}, false
+		}
+		c.mailCmd = true
+	case "RSET":
+		c.inMail = false
+		c.xforward, c.xforwarded = email.ClientAttributes{}, false
+	case "STARTTLS":
+		if c.trustedPeer {
+			c.reply("454 4.7.0 TLS not available to XCLIENT peers, continue in plaintext")
+			return false
+		}
+		c.passthrough = true
+	}
+	return true
+}
+
+// reply writes a response of our own. Callers must hold c.mu.
+func (c *xclientConn) reply(format string, args ...any) {
+	fmt.Fprintf(c.Conn, format+"\r\n", args...)
+}
+
+// Write watches the server's replies to add our capabilities to EHLO, in
+// place of STARTTLS, and to learn whether MAIL and DATA were accepted.
+func (c *xclientConn) Write(b []byte) (int, error) {
+	c.init()
+
+	c.mu.Lock()
+	if c.mailCmd && len(b) >= 3 {
+		c.mailCmd = false
+		c.inMail = b[0] == '2'
+	}
+	if c.dataCmd && len(b) >= 3 {
+		c.dataCmd = false
+		c.inData = bytes.HasPrefix(b, []byte("354"))
+	}
+	if c.ehlo {
+		// The reply may come in several writes. The last line of a
+		// multi-line reply has a space after the code.
+		var out bytes.Buffer
+		last, offset := lastReplyLine(b), 0
+		for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+			if offset == last && bytes.HasPrefix(line, []byte("250 ")) {
+				for _, capability := range xclientCaps {
+					fmt.Fprintf(&out, "250-%s\r\n", capability)
+				}
+			}
+			offset += len(line)
+			if len(line) > 4 && bytes.EqualFold(bytes.TrimSpace(line[4:]), []byte("STARTTLS")) {
+				continue
+			}
+			out.Write(line)
+		}
+		c.ehlo = last < 0
+		c.mu.Unlock()
+		if _, err := c.Conn.Write(out.Bytes()); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Write(b)
+}
+
+// lastReplyLine returns the offset of the final line ("NNN text") of a reply
+// in b, or -1 if b only holds continuation lines.
+func lastReplyLine(b []byte) int {
+	for start := 0; start < len(b); {
+		end := bytes.IndexByte(b[start:], '\n')
+		if len(b[start:]) >= 4 && b[start+3] == ' ' {
+			return start
+		}
+		if end < 0 {
+			break
+		}
+		start += end + 1
+	}
+	return -1
+}
+
+// parseXAttributes parses the NAME=value list of XCLIENT or XFORWARD on top
+// of the current attributes. [UNAVAILABLE] and [TEMPUNAVAIL] clear a value.
+func parseXAttributes(arg string, attrs email.ClientAttributes, xclient bool) (email.ClientAttributes, error) {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return attrs, fmt.Errorf("missing attributes")
+	}
+
+	for _, field := range fields {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return attrs, fmt.Errorf("bad attribute %q", field)
+		}
+		value, err := decodeXtext(value)
+		if err != nil || strings.ContainsFunc(value, isControl) {
+			return attrs, fmt.Errorf("bad value for %s", name)
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+
+		switch name = strings.ToUpper(name); name {
+		case "ADDR":
+			attrs.Addr = nil
+			if value != "" {
+				ip := net.ParseIP(strings.TrimPrefix(strings.TrimPrefix(value, "IPV6:"), "ipv6:"))
+				if ip == nil {
+					return attrs, fmt.Errorf("bad address %q", value)
+				}
+				attrs.Addr = ip
+			}
+		case "PORT":
+			attrs.Port = 0
+			if value != "" {
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil {
+					return attrs, fmt.Errorf("bad port %q", value)
+				}
+				attrs.Port = int(port)
+			}
+		case "NAME":
+			if value != "" && !validHostname(value) {
+				return attrs, fmt.Errorf("bad hostname %q", value)
+			}
+			attrs.Name = value
+		case "HELO":
+			if value != "" && !validHostname(value) && !validAddressLiteral(value) {
+				return attrs, fmt.Errorf("bad HELO name %q", value)
+			}
+			attrs.Helo = value
+		case "PROTO":
+			if value != "" && !strings.EqualFold(value, "SMTP") && !strings.EqualFold(value, "ESMTP") {
+				return attrs, fmt.Errorf("bad protocol %q", value)
+			}
+			attrs.Proto = value
+		case "LOGIN":
+			if !xclient {
+				return attrs, fmt.Errorf("unknown attribute %s", name)
+			}
+			attrs.Login = value
+		case "DESTADDR", "DESTPORT":
+			if !xclient {
+				return attrs, fmt.Errorf("unknown attribute %s", name)
+			}
+			// Accepted but not used.
+		case "IDENT", "SOURCE":
+			if xclient {
+				return attrs, fmt.Errorf("unknown attribute %s", name)
+			}
+			// Accepted but not used.
+		default:
+			return attrs, fmt.Errorf("unknown attribute %s", name)
+		}
+	}
+	return attrs, nil
+}
+
+// decodeXtext decodes the "+XX" hex escapes of RFC 3461 xtext.
+func decodeXtext(s string) (string, error) {
+	if !strings.Contains(s, "+") {
+		return s, nil
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			out.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated xtext escape")
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", err
+		}
+		out.WriteByte(byte(v))
+		i += 2
+	}
+	return out.String(), nil
+}
+
+// isControl reports whether r is an ASCII control character. Attribute
+// values end up in the Received header, where CR and LF would start a new
+// header line.
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// validHostname reports whether s is a syntactically valid domain name:
+// dot-separated labels of letters, digits, hyphens and underscores that
+// don't start or end with a hyphen.
+func validHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for label := range strings.SplitSeq(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validAddressLiteral reports whether s is an address literal as sent in
+// HELO, e.g. "[192.0.2.1]" or "[IPv6:2001:db8::1]".
+func validAddressLiteral(s string) bool {
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return false
+	}
+	addr := s[1 : len(s)-1]
+	if v6, ok := strings.CutPrefix(addr, "IPv6:"); ok {
+		ip := net.ParseIP(v6)
+		return ip != nil && ip.To4() == nil
+	}
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() != nil
+}
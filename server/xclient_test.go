@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/TrueFix/getmail/internal/smtptest"
+	"github.com/emersion/go-smtp"
+)
+
+const testMessage = "From: Bob <bob@example.org>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"XCLIENT ADDR=203.0.113.66\r\n" +
+	"Hi\r\n" +
+	".\r\n"
+
+// xclientClient is the relay side of a connection to a test server.
+type xclientClient struct {
+	*smtptest.Client
+	emails chan *email.Email
+}
+
+// dialXClient starts an SMTP server whose xclient_peers is trusted and
+// connects to it. The greeting has been read when it returns.
+func dialXClient(t *testing.T, trusted string) *xclientClient {
+	return dialXClientPolicy(t, trusted, &email.Backend{}, email.Policy{})
+}
+
+// dialXClientPolicy is dialXClient for sessions of bkd that apply p. The
+// Handler of bkd is replaced. The server offers STARTTLS.
+func dialXClientPolicy(t *testing.T, trusted string, bkd *email.Backend, p email.Policy) *xclientClient {
+	t.Helper()
+
+	_, network, err := net.ParseCIDR(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emails := make(chan *email.Email, 1)
+	bkd.Handler = email.HandlerFunc(func(ctx context.Context, e *email.Email) error {
+		emails <- e
+		return nil
+	})
+	dir := t.TempDir()
+	crt := writeCert(t, dir, "mx.example.com", "mx.example.com")
+	cert, err := tls.LoadX509KeyPair(crt, strings.TrimSuffix(crt, ".crt")+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := smtp.NewServer(bkd.WithPolicy(p))
+	s.Domain = "mx.example.com"
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ln := &xclientListener{Listener: smtptest.Listen(t), Trusted: []*net.IPNet{network}, Domain: s.Domain}
+	return &xclientClient{Client: smtptest.Serve(t, s, ln), emails: emails}
+}
+
+// send runs a transaction and returns the email the server received.
+func (c *xclientClient) send() *email.Email {
+	c.T.Helper()
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("DATA", "354 ")
+	c.Write(testMessage)
+	c.Expect("250 ")
+	return c.received()
+}
+
+func (c *xclientClient) received() *email.Email {
+	c.T.Helper()
+	select {
+	case e := <-c.emails:
+		return e
+	case <-time.After(5 * time.Second):
+		c.T.Fatal("no email received")
+		return nil
+	}
+}
+
+func TestXClientCapabilities(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	reply := c.Cmd("EHLO relay.example.com", "250-")
+	for _, capability := range xclientCaps {
+		if !strings.Contains(reply, "250-"+capability+"\r\n") {
+			t.Errorf("EHLO reply lacks %q:\n%s", capability, reply)
+		}
+	}
+	if strings.Contains(reply, "STARTTLS") {
+		t.Errorf("EHLO reply to a trusted peer offers STARTTLS:\n%s", reply)
+	}
+	lines := strings.Split(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "250 ") || strings.Contains(last, "XCLIENT") {
+		t.Errorf("last EHLO line = %q", last)
+	}
+
+	// A second EHLO is extended as well.
+	if reply := c.Cmd("EHLO relay.example.com", "250-"); !strings.Contains(reply, "XCLIENT") {
+		t.Errorf("second EHLO reply lacks XCLIENT:\n%s", reply)
+	}
+	// HELO is answered as is.
+	c.Cmd("HELO relay.example.com", "250 ")
+}
+
+func TestXClientOverrides(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("XCLIENT ADDR=192.0.2.7 PORT=4321 NAME=client.example.org HELO=client+2Eexample.org LOGIN=alice", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+
+	e := c.send()
+	if got := e.ClientIP.String(); got != "192.0.2.7" {
+		t.Errorf("ClientIP = %s", got)
+	}
+	if got := e.Connection.RemoteAddr; got != "192.0.2.7:4321" {
+		t.Errorf("RemoteAddr = %s", got)
+	}
+	if got := e.Connection.ClientName; got != "client.example.org" {
+		t.Errorf("ClientName = %q", got)
+	}
+	if got := e.Connection.Helo; got != "client.example.org" {
+		t.Errorf("Helo = %q, want the decoded xtext", got)
+	}
+	if e.AuthUser != "alice" {
+		t.Errorf("AuthUser = %q", e.AuthUser)
+	}
+}
+
+func TestXClientUnavailable(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("XCLIENT ADDR=192.0.2.7 NAME=client.example.org LOGIN=alice", "220 ")
+	c.Cmd("XCLIENT NAME=[UNAVAILABLE] LOGIN=[TEMPUNAVAIL]", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+
+	e := c.send()
+	if got := e.ClientIP.String(); got != "192.0.2.7" {
+		t.Errorf("ClientIP = %s, want the earlier value", got)
+	}
+	if e.Connection.ClientName != "" || e.AuthUser != "" {
+		t.Errorf("ClientName = %q, AuthUser = %q, want both cleared", e.Connection.ClientName, e.AuthUser)
+	}
+}
+
+func TestXClientUntrustedPeer(t *testing.T) {
+	c := dialXClient(t, "10.0.0.0/8")
+	if reply := c.Cmd("EHLO relay.example.com", "250-"); strings.Contains(reply, "XCLIENT") {
+		t.Errorf("untrusted peer offered XCLIENT:\n%s", reply)
+	}
+	c.Cmd("XCLIENT ADDR=192.0.2.7 LOGIN=alice", "502 5.5.1 ")
+	c.Cmd("XFORWARD ADDR=192.0.2.7", "502 5.5.1 ")
+
+	e := c.send()
+	if got := e.ClientIP.String(); got != "127.0.0.1" {
+		t.Errorf("ClientIP = %s", got)
+	}
+	if e.AuthUser != "" {
+		t.Errorf("AuthUser = %q", e.AuthUser)
+	}
+}
+
+// XCLIENT sent over TLS could not be seen, so trusted peers stay in
+// plaintext; other peers may still use STARTTLS.
+func TestXClientSTARTTLS(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("STARTTLS", "454 4.7.0 ")
+	c.Cmd("XCLIENT ADDR=192.0.2.7", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+	if e := c.send(); e.ClientIP.String() != "192.0.2.7" || e.Connection.TLS != nil {
+		t.Errorf("ClientIP = %s, TLS = %+v", e.ClientIP, e.Connection.TLS)
+	}
+
+	c = dialXClient(t, "10.0.0.0/8")
+	if reply := c.Cmd("EHLO client.example.org", "250-"); !strings.Contains(reply, "250-STARTTLS\r\n") {
+		t.Errorf("EHLO reply to an untrusted peer lacks STARTTLS:\n%s", reply)
+	}
+	c.Cmd("STARTTLS", "220 ")
+	c.StartTLS(&tls.Config{ServerName: "mx.example.com", InsecureSkipVerify: true})
+	c.Cmd("EHLO client.example.org", "250-")
+	if e := c.send(); e.Connection.TLS == nil {
+		t.Error("no TLS state after STARTTLS")
+	}
+}
+
+// A LOGIN passed with XCLIENT counts as authenticated: it satisfies
+// RequireAuth and skips the DNSBL and greylisting checks.
+func TestXClientLogin(t *testing.T) {
+	c := dialXClientPolicy(t, "127.0.0.0/8", &email.Backend{}, email.Policy{RequireAuth: true})
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("XCLIENT ADDR=192.0.2.7", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("MAIL FROM:<bob@example.org>", "530 5.7.0 ")
+	c.Cmd("XCLIENT LOGIN=alice", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+	if e := c.send(); e.AuthUser != "alice" {
+		t.Errorf("AuthUser = %q", e.AuthUser)
+	}
+
+	greylist, err := email.NewGreylist("", time.Hour, 4*time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bkd := &email.Backend{
+		Greylist: greylist,
+		DNSBL: &email.DNSBL{
+			Zones:     []email.DNSBLZone{{Zone: "bl.example", Weight: 1}},
+			Threshold: 1,
+			Action:    email.DNSBLReject,
+			Resolver:  listedResolver{},
+		},
+	}
+	c = dialXClientPolicy(t, "127.0.0.0/8", bkd, email.Policy{})
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("XCLIENT ADDR=192.0.2.7", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("MAIL FROM:<bob@example.org>", "550 5.7.1 ")
+	c.Cmd("XCLIENT LOGIN=alice", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+	// send fails unless MAIL and RCPT get 250, so neither the listing nor
+	// the unknown triplet is held against alice.
+	if e := c.send(); e.AuthUser != "alice" {
+		t.Errorf("AuthUser = %q", e.AuthUser)
+	}
+}
+
+// listedResolver lists every address in every blocklist.
+type listedResolver struct{}
+
+func (listedResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return []string{"127.0.0.2"}, nil
+}
+
+func TestXClientPipelined(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Write("XCLIENT ADDR=192.0.2.9\r\n" +
+		"EHLO relay.example.com\r\n" +
+		"MAIL FROM:<bob@example.org>\r\n" +
+		"RCPT TO:<alice@example.com>\r\n" +
+		"DATA\r\n")
+	c.Expect("220 ")
+	c.Expect("250-")
+	c.Expect("250 ")
+	c.Expect("250 ")
+	c.Expect("354 ")
+	c.Write(testMessage + "QUIT\r\n")
+	c.Expect("250 ")
+	c.Expect("221 ")
+
+	e := c.received()
+	if got := e.ClientIP.String(); got != "192.0.2.9" {
+		t.Errorf("ClientIP = %s", got)
+	}
+	// The XCLIENT line inside the message is data, not a command.
+	raw, _ := io.ReadAll(e.Raw)
+	if !strings.Contains(string(raw), "\r\nXCLIENT ADDR=203.0.113.66\r\n") {
+		t.Errorf("message data was altered:\n%s", raw)
+	}
+}
+
+func TestXClientInTransaction(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("MAIL FROM:<bob@example.org>", "250 ")
+	c.Cmd("XCLIENT ADDR=192.0.2.7 LOGIN=alice", "503 5.5.1 ")
+	c.Cmd("RCPT TO:<alice@example.com>", "250 ")
+	c.Cmd("RSET", "250 ")
+
+	c.Cmd("XCLIENT ADDR=192.0.2.7", "220 ")
+	c.Cmd("EHLO relay.example.com", "250-")
+	if e := c.send(); e.ClientIP.String() != "192.0.2.7" {
+		t.Errorf("ClientIP = %s", e.ClientIP)
+	}
+
+	// The transaction ended with the message, so XCLIENT is allowed again.
+	c.Cmd("XCLIENT ADDR=192.0.2.8", "220 ")
+}
+
+func TestXForward(t *testing.T) {
+	c := dialXClient(t, "127.0.0.0/8")
+	c.Cmd("EHLO relay.example.com", "250-")
+	c.Cmd("XFORWARD ADDR=192.0.2.20 NAME=one.example.org", "250 ")
+	c.Cmd("XFORWARD HELO=one.example.org", "250 ")
+	if e := c.send(); e.ClientIP.String() != "192.0.2.20" || e.Connection.Helo != "one.example.org" {
+		t.Errorf("ClientIP = %s, Helo = %q", e.ClientIP, e.Connection.Helo)
+	}
+
+	// XFORWARD only lasts for one transaction.
+	if e := c.send(); e.ClientIP.String() != "127.0.0.1" {
+		t.Errorf("ClientIP of the next message = %s", e.ClientIP)
+	}
+	c.Cmd("XFORWARD LOGIN=alice", "501 5.5.4 ")
+}
+
+func TestParseXAttributes(t *testing.T) {
+	tests := []struct {
+		arg     string
+		xclient bool
+		want    email.ClientAttributes
+		err     bool
+	}{
+		{arg: "ADDR=192.0.2.1 PORT=25", xclient: true, want: email.ClientAttributes{Addr: net.ParseIP("192.0.2.1"), Port: 25}},
+		{arg: "addr=IPV6:2001:db8::1", xclient: true, want: email.ClientAttributes{Addr: net.ParseIP("2001:db8::1")}},
+		{arg: "NAME=[UNAVAILABLE] HELO=[TEMPUNAVAIL]", xclient: true},
+		{arg: "LOGIN=bob+40example.org", xclient: true, want: email.ClientAttributes{Login: "bob@example.org"}},
+		{arg: "PROTO=ESMTP DESTADDR=198.51.100.1 DESTPORT=25", xclient: true, want: email.ClientAttributes{Proto: "ESMTP"}},
+		{arg: "IDENT=abc SOURCE=REMOTE NAME=x.example", want: email.ClientAttributes{Name: "x.example"}},
+		{arg: "", xclient: true, err: true},
+		{arg: "ADDR", xclient: true, err: true},
+		{arg: "ADDR=not-an-ip", xclient: true, err: true},
+		{arg: "PORT=70000", xclient: true, err: true},
+		{arg: "NAME=bad+2", xclient: true, err: true},
+		{arg: "NAME=bad+ZZ", xclient: true, err: true},
+		{arg: "COLOR=blue", xclient: true, err: true},
+		{arg: "LOGIN=alice", err: true},
+		{arg: "IDENT=abc", xclient: true, err: true},
+		{arg: "HELO=[192.0.2.1] NAME=mail-1.example.org.", xclient: true, want: email.ClientAttributes{Helo: "[192.0.2.1]", Name: "mail-1.example.org."}},
+		{arg: "HELO=[IPv6:2001:db8::1]", xclient: true, want: email.ClientAttributes{Helo: "[IPv6:2001:db8::1]"}},
+		{arg: "PROTO=smtp", want: email.ClientAttributes{Proto: "smtp"}},
+		// Control characters would let the relay inject header lines.
+		{arg: "HELO=x.example+0D+0AX-Injected:+20yes", xclient: true, err: true},
+		{arg: "NAME=x.example+0A", xclient: true, err: true},
+		{arg: "LOGIN=bob+00", xclient: true, err: true},
+		{arg: "PROTO=ESMTP+0D+0AX:", xclient: true, err: true},
+		{arg: "NAME=bad_host!.example", xclient: true, err: true},
+		{arg: "NAME=-x.example", xclient: true, err: true},
+		{arg: "HELO=x..example", xclient: true, err: true},
+		{arg: "HELO=[192.0.2.300]", xclient: true, err: true},
+		{arg: "HELO=[IPv6:192.0.2.1]", xclient: true, err: true},
+		{arg: "PROTO=LMTP", xclient: true, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseXAttributes(tt.arg, email.ClientAttributes{}, tt.xclient)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseXAttributes(%q) succeeded", tt.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseXAttributes(%q): %v", tt.arg, err)
+			continue
+		}
+		if !got.Addr.Equal(tt.want.Addr) || got.Port != tt.want.Port || got.Name != tt.want.Name ||
+			got.Helo != tt.want.Helo || got.Proto != tt.want.Proto || got.Login != tt.want.Login {
+			t.Errorf("parseXAttributes(%q) = %+v, want %+v", tt.arg, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":             "plain",
+		"a+2Bb":             "a+b",
+		"+3Dx+20y":          "=x y",
+		"bob+40example.org": "bob@example.org",
+	} {
+		if got, err := decodeXtext(in); err != nil || got != want {
+			t.Errorf("decodeXtext(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"a+", "a+4", "a+GG"} {
+		if _, err := decodeXtext(in); err == nil {
+			t.Errorf("decodeXtext(%q) succeeded", in)
+		}
+	}
+}
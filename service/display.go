@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"html"
 	"io"
 	"log"
@@ -9,10 +11,15 @@ import (
 )
 
 // logEmailMetadata logs high-level metadata of the email.
-func logEmailMetadata(e *email.Email) {
+func logEmailMetadata(ctx context.Context, e *email.Email) {
 	log.Printf(
-		"\n[RECEIVED EMAIL]\nIP: %s\nFrom: %s\nTo: %v\nSubject: %s\nText Body: %v\nHTML Body: %v\nAttachments: %d",
+		"\n[RECEIVED EMAIL]\nListener: %s\nIP: %s (%s, helo %s)\nTLS: %s\nAuth: %s\nFrom: %s\nTo: %v\nSubject: %s\nText Body: %v\nHTML Body: %v\nAttachments: %d",
+		e.Connection.Listener,
 		e.ClientIP,
+		e.Connection.ClientName,
+		e.Connection.Helo,
+		tlsSummary(e.Connection.TLS),
+		e.AuthUser,
 		e.From.Email,
 		e.RcptTo,
 		e.Subject,
@@ -21,13 +28,29 @@ func logEmailMetadata(e *email.Email) {
 		len(e.Attachments),
 	)
 
-	if spf, err := e.VerifySPF(); err != nil {
+	if e.DNSBL != nil && len(e.DNSBL.Matches) > 0 {
+		log.Printf("[INFO] DNSBL: score %d, listed %v, %d list(s) matched", e.DNSBL.Score, e.DNSBL.Listed, len(e.DNSBL.Matches))
+	}
+
+	if spf, err := e.VerifySPFContext(ctx); err != nil {
 		log.Printf("[WARNING] SPF verification failed: %v", err)
 	} else {
 		log.Printf("[INFO] SPF verified: %v", spf)
 	}
 }
 
+// tlsSummary describes the TLS state of a connection in one line.
+func tlsSummary(t *email.TLSState) string {
+	if t == nil {
+		return "none"
+	}
+	summary := fmt.Sprintf("%s %s, sni %q", t.Version, t.CipherSuite, t.ServerName)
+	if t.ClientCert != "" {
+		summary += fmt.Sprintf(", client cert %q", t.ClientCert)
+	}
+	return summary
+}
+
 // logEmailHeaders logs detailed headers of the email.
 func logEmailHeaders(e *email.Email) {
 	h := e.Headers
@@ -40,6 +63,7 @@ func logEmailHeaders(e *email.Email) {
 	log.Printf("To: %+v", h.To)
 	log.Printf("Cc: %+v", h.Cc)
 	log.Printf("RcptTo: %+v", e.RcptTo)
+	log.Printf("Envelope: %+v", e.Envelope)
 	log.Printf("Content-Type: %s/%s; Params: %v", h.ContentType.MediaType, h.ContentType.SubType, h.ContentType.Params)
 	log.Printf("Content-Transfer-Encoding: %s", h.ContentTransferEncoding)
 }
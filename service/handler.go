@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"io"
 	"log"
 
@@ -10,9 +11,15 @@ import (
 type Service struct{}
 
 func (m *Service) OnEmail(email *email.Email) {
-	logEmailMetadata(email)
-	logEmailHeaders(email)
-	logEmailBodies(email)
+	m.HandleEmail(context.Background(), email)
+}
+
+// HandleEmail implements email.Handler; the log handler accepts every email.
+func (m *Service) HandleEmail(ctx context.Context, e *email.Email) error {
+	logEmailMetadata(ctx, e)
+	logEmailHeaders(e)
+	logEmailBodies(e)
+	return nil
 }
 
 func (m *Service) OnEmailFailed(from email.EmailUser, to []email.EmailUser, raw io.Reader, err error) {
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/emersion/go-smtp"
+)
+
+// Folder layouts of a Maildir.
+const (
+	MaildirPerRecipient = "recipient" // <root>/<domain>/<local part>, one folder per mailbox
+	MaildirPerDomain    = "domain"    // <root>/<domain>, one folder per domain
+)
+
+// errBadMailbox rejects recipients that can't be turned into a folder name.
+var errBadMailbox = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+	Message:      "Bad destination mailbox address",
+}
+
+// Maildir is an email.Handler that delivers every email into Maildir
+// folders under Root, once for each folder its recipients map to.
+// Subaddress tags are dropped, so user+tag@example.com is delivered to
+// user@example.com. The message is written to tmp/, synced and renamed into
+// new/, where mail readers and IMAP servers pick it up. What is stored is
+// Email.Raw, the received message below the trace headers getmail added,
+// with its line endings converted to LF as Maildir readers expect.
+//
+// If a folder fails, the client is asked to retry and the folders that
+// already got the message get it again; LMTP delivers each recipient on its
+// own and avoids that.
+type Maildir struct {
+	Root   string
+	Layout string // MaildirPerRecipient (default) or MaildirPerDomain
+}
+
+// maildirSeq numbers the deliveries of this process for unique file names.
+var maildirSeq atomic.Uint64
+
+// HandleEmail implements email.Handler.
+func (m *Maildir) HandleEmail(ctx context.Context, e *email.Email) error {
+	raw, err := e.RawBytes()
+	if err != nil {
+		return fmt.Errorf("maildir: %w", err)
+	}
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+
+	seen := make(map[string]bool)
+	for _, rcpt := range e.RcptTo {
+		dir, err := m.folder(rcpt)
+		if err != nil {
+			return err
+		}
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := deliverMaildir(dir, raw); err != nil {
+			return fmt.Errorf("maildir: delivery of email %s for %s: %w", e.ID, rcpt.Email, err)
+		}
+	}
+	return nil
+}
+
+// folder returns the Maildir folder of a recipient.
+func (m *Maildir) folder(rcpt email.EmailUser) (string, error) {
+	local, domain, ok := strings.Cut(strings.ToLower(rcpt.Mailbox()), "@")
+	if !ok || !safeFolderName(local) || !safeFolderName(domain) {
+		return "", errBadMailbox
+	}
+	if m.Layout == MaildirPerDomain {
+		return filepath.Join(m.Root, domain), nil
+	}
+	return filepath.Join(m.Root, domain, local), nil
+}
+
+// safeFolderName reports whether name can be used as a single path element.
+func safeFolderName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// deliverMaildir writes raw as a new message of the Maildir at dir,
+// creating the folder if needed.
+func deliverMaildir(dir string, raw []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+
+	name := maildirName()
+	tmpPath := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	newDir := filepath.Join(dir, "new")
+	if err := os.Rename(tmpPath, filepath.Join(newDir, name)); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Sync new/ so the rename survives a crash before the client gets 250.
+	d, err := os.Open(newDir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// maildirName returns a unique file name in the usual
+// <seconds>.M<microseconds>P<pid>Q<sequence>.<host> form.
+func maildirName() string {
+	now := time.Now()
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), maildirSeq.Add(1), host)
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maildirFiles returns the messages under root by folder. Files outside
+// new/ are reported.
+func maildirFiles(t *testing.T, root string) map[string][]string {
+	t.Helper()
+	files := make(map[string][]string)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		dir, sub := filepath.Split(filepath.Dir(path))
+		if sub != "new" {
+			t.Errorf("file outside new/: %s", path)
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		folder, _ := filepath.Rel(root, dir)
+		folder = filepath.ToSlash(folder)
+		files[folder] = append(files[folder], string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestMaildirLayouts(t *testing.T) {
+	rcpts := []string{"Alice+news@Example.com", "alice@example.com", "bob@example.com", "carol@other.example"}
+	perRecipient := []string{"example.com/alice", "example.com/bob", "other.example/carol"}
+	tests := []struct {
+		layout string
+		want   []string
+	}{
+		{"", perRecipient},
+		{MaildirPerRecipient, perRecipient},
+		{MaildirPerDomain, []string{"example.com", "other.example"}},
+	}
+	for _, tt := range tests {
+		root := t.TempDir()
+		m := &Maildir{Root: root, Layout: tt.layout}
+		if err := m.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail, rcpts...)); err != nil {
+			t.Fatalf("layout %q: %v", tt.layout, err)
+		}
+
+		// One message per folder, however many recipients map to it.
+		files := maildirFiles(t, root)
+		if got := slices.Sorted(maps.Keys(files)); !slices.Equal(got, tt.want) {
+			t.Errorf("layout %q: folders %v, want %v", tt.layout, got, tt.want)
+		}
+		for _, folder := range tt.want {
+			if len(files[folder]) != 1 {
+				t.Errorf("layout %q: %d messages in %s, want 1", tt.layout, len(files[folder]), folder)
+			}
+			for _, sub := range []string{"tmp", "cur"} {
+				entries, err := os.ReadDir(filepath.Join(root, folder, sub))
+				if err != nil || len(entries) != 0 {
+					t.Errorf("layout %q: %s/%s has %d entries, %v", tt.layout, folder, sub, len(entries), err)
+				}
+			}
+		}
+	}
+}
+
+// Maildir readers expect LF line endings; a lone CR is left alone.
+func TestMaildirLineEndings(t *testing.T) {
+	raw := "Received: from client.example.org\r\n" +
+		"From: bob@example.org\r\n" +
+		"Subject: Hello\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Line one\r\n" +
+		"Line\rtwo\r\n"
+	want := "Received: from client.example.org\n" +
+		"From: bob@example.org\n" +
+		"Subject: Hello\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Line one\n" +
+		"Line\rtwo\n"
+	root := t.TempDir()
+	m := &Maildir{Root: root}
+	if err := m.HandleEmail(context.Background(), testEmail(t, raw, "alice@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	files := maildirFiles(t, root)["example.com/alice"]
+	if len(files) != 1 || files[0] != want {
+		t.Errorf("stored %q, want %q", files, want)
+	}
+}
+
+func TestMaildirUniqueNames(t *testing.T) {
+	root := t.TempDir()
+	m := &Maildir{Root: root}
+	for range 3 {
+		if err := m.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail, "alice@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "example.com", "alice", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("%d messages, want 3", len(entries))
+	}
+
+	pattern := regexp.MustCompile(`^\d+\.M\d+P\d+Q\d+\.[^/:]+$`)
+	for _, e := range entries {
+		if !pattern.MatchString(e.Name()) {
+			t.Errorf("file name %q", e.Name())
+		}
+	}
+}
+
+func TestMaildirBadMailbox(t *testing.T) {
+	for _, rcpt := range []string{"../etc@example.com", ".hidden@example.com", "alice@..", "alice@a/b", "no-domain"} {
+		root := t.TempDir()
+		m := &Maildir{Root: root}
+		err := m.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail, rcpt))
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 3}) {
+			t.Errorf("%s: error = %v, want 550 5.1.3", rcpt, err)
+		}
+		if entries, _ := os.ReadDir(root); len(entries) != 0 {
+			t.Errorf("%s: wrote %d entries under root", rcpt, len(entries))
+		}
+	}
+}
+
+func TestMaildirCanceled(t *testing.T) {
+	root := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := &Maildir{Root: root}
+	if err := m.HandleEmail(ctx, testEmail(t, testAttachmentEmail, "alice@example.com")); !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if files := maildirFiles(t, root); len(files) != 0 {
+		t.Errorf("delivered after cancellation: %v", files)
+	}
+}
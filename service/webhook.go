@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/emersion/go-smtp"
+)
+
+// Retry delays of a Webhook whose Backoff or MaxBackoff is unset.
+const (
+	defaultWebhookBackoff    = time.Second
+	defaultWebhookMaxBackoff = 30 * time.Second
+)
+
+// Attachment modes of a Webhook.
+const (
+	WebhookInline    = "inline"    // base64 encoded in the JSON document
+	WebhookMultipart = "multipart" // parts "attachment-<index>" of a multipart/form-data body
+)
+
+// Webhook is an email.Handler that POSTs every email in its JSON form (see
+// email.JSONSchema) to each of URLs. The email is accepted once every URL
+// answered with a 2xx status.
+//
+// A 5xx or 429 status, a timeout or a connection error is retried Retries
+// times, after Backoff and then twice as long for every further attempt, up
+// to MaxBackoff; when the retries run out the client is asked to try again
+// later. Any other status is final and the email is rejected with 554 5.6.0.
+// Requests carry the email ID in X-Getmail-Id, so a receiver can drop
+// duplicates after a partial failure, and are signed when Secret is set:
+//
+//	X-Getmail-Timestamp: <unix seconds>
+//	X-Getmail-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+type Webhook struct {
+	URLs        []string
+	Secret      string        // HMAC key, requests are not signed when empty
+	Attachments string        // WebhookInline (default) or WebhookMultipart
+	Client      *http.Client  // http.DefaultClient when nil
+	Timeout     time.Duration // Bound of one request, none when zero
+	Retries     int           // Retries per URL
+	Backoff     time.Duration // Delay before the first retry, 1s when zero
+	MaxBackoff  time.Duration // Longest delay between retries, 30s when zero
+}
+
+// HandleEmail implements email.Handler.
+func (w *Webhook) HandleEmail(ctx context.Context, e *email.Email) error {
+	body, contentType, err := w.encode(e)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	for _, url := range w.URLs {
+		if err := w.deliver(ctx, url, e.ID, body, contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver POSTs body to url, retrying temporary failures.
+func (w *Webhook) deliver(ctx context.Context, url, id string, body []byte, contentType string) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, url, id, body, contentType)
+		if err == nil || !retry {
+			return err
+		}
+		if attempt >= w.Retries {
+			return fmt.Errorf("webhook %s: giving up after %d attempts: %w", url, attempt+1, err)
+		}
+		delay := w.backoff(attempt + 1)
+		email.LogWarning("Webhook", fmt.Sprintf("POST %s for email %s failed, retrying in %s: %v", url, id, delay, err))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("webhook %s: %w", url, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// MaxDuration returns the longest HandleEmail can take when every request
+// times out: Timeout for each attempt at each URL plus the delays between
+// them. It reports false when requests have no Timeout and are unbounded.
+func (w *Webhook) MaxDuration() (time.Duration, bool) {
+	if w.Timeout <= 0 {
+		return 0, false
+	}
+	perURL := time.Duration(w.Retries+1) * w.Timeout
+	for attempt := 1; attempt <= w.Retries; attempt++ {
+		perURL += w.backoff(attempt)
+	}
+	return time.Duration(len(w.URLs)) * perURL, true
+}
+
+// backoff returns the delay before retry number attempts.
+func (w *Webhook) backoff(attempts int) time.Duration {
+	d, limit := w.Backoff, w.MaxBackoff
+	if d <= 0 {
+		d = defaultWebhookBackoff
+	}
+	if limit <= 0 {
+		limit = defaultWebhookMaxBackoff
+	}
+	for i := 1; i < attempts && d < limit; i++ {
+		d *= 2
+	}
+	return min(d, limit)
+}
+
+// post sends one request and reports whether a failure may be retried.
+func (w *Webhook) post(ctx context.Context, url, id string, body []byte, contentType string) (bool, error) {
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "getmail")
+	req.Header.Set("X-Getmail-Id", id)
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Getmail-Timestamp", timestamp)
+		req.Header.Set("X-Getmail-Signature", "sha256="+Sign(w.Secret, timestamp, body))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// Timeouts and connection errors are retried.
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("%s", resp.Status)
+	default:
+		return false, &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message rejected by webhook: " + resp.Status,
+		}
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" under secret, the
+// value of the X-Getmail-Signature header without its "sha256=" prefix.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encode returns the request body for e and its content type.
+func (w *Webhook) encode(e *email.Email) ([]byte, string, error) {
+	multipartMode := w.Attachments == WebhookMultipart
+	doc, err := e.MarshalJSONWith(email.JSONOptions{
+		AttachmentContent: !multipartMode,
+		AttachmentPart:    attachmentPart,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if !multipartMode {
+		return doc, "application/json", nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="email"`},
+		"Content-Type":        {"application/json"},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(doc)
+
+	for i, a := range e.Attachments {
+		data, err := a.Bytes()
+		if err != nil {
+			return nil, "", err
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {fmt.Sprintf(`form-data; name="%s"; filename="%s"`, attachmentPart(i), quoteEscaper.Replace(a.Filename()))},
+			"Content-Type":        {a.ContentType()},
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		part.Write(data)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mw.FormDataContentType(), nil
+}
+
+// attachmentPart names the form part of the attachment at index in
+// multipart mode; the JSON document refers to it in the attachment's "part".
+func attachmentPart(index int) string {
+	return fmt.Sprintf("attachment-%d", index)
+}
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
@@ -0,0 +1,359 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TrueFix/getmail/email"
+	"github.com/emersion/go-smtp"
+)
+
+const testAttachmentEmail = "From: Bob <bob@example.org>\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--b1--\r\n"
+
+// testEmail parses raw. rcpts, when given, replace the recipients taken
+// from its To header, as the envelope of a session would.
+func testEmail(t *testing.T, raw string, rcpts ...string) *email.Email {
+	t.Helper()
+	e, err := email.ParseEmail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rcpts) > 0 {
+		e.RcptTo = nil
+		for _, r := range rcpts {
+			e.RcptTo = append(e.RcptTo, email.EmailUser{Email: r})
+		}
+	}
+	return e
+}
+
+// webhookServer records the requests it gets and answers each one with the
+// next of statuses, then 200.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	delays   []time.Duration
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	ws := &webhookServer{statuses: statuses}
+	ws.Server = httptest.NewServer(http.HandlerFunc(ws.serve))
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+func (ws *webhookServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	ws.mu.Lock()
+	n := len(ws.requests)
+	ws.requests = append(ws.requests, r)
+	ws.bodies = append(ws.bodies, body)
+	status, delay := http.StatusOK, time.Duration(0)
+	if n < len(ws.statuses) {
+		status = ws.statuses[n]
+	}
+	if n < len(ws.delays) {
+		delay = ws.delays[n]
+	}
+	ws.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.WriteHeader(status)
+}
+
+func (ws *webhookServer) attempts() int {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.requests)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	ws := newWebhookServer(t)
+	e := testEmail(t, testAttachmentEmail)
+	w := &Webhook{URLs: []string{ws.URL}, Secret: "s3cret"}
+
+	if err := w.HandleEmail(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if ws.attempts() != 1 {
+		t.Fatalf("%d requests, want 1", ws.attempts())
+	}
+
+	r, body := ws.requests[0], ws.bodies[0]
+	if got := r.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	if got := r.Header.Get("X-Getmail-Id"); got != e.ID {
+		t.Errorf("X-Getmail-Id = %q, want %q", got, e.ID)
+	}
+	timestamp := r.Header.Get("X-Getmail-Timestamp")
+	if timestamp == "" {
+		t.Fatal("X-Getmail-Timestamp missing")
+	}
+	if got, want := r.Header.Get("X-Getmail-Signature"), "sha256="+Sign("s3cret", timestamp, body); got != want {
+		t.Errorf("X-Getmail-Signature = %q, want %q", got, want)
+	}
+	if Sign("other", timestamp, body) == Sign("s3cret", timestamp, body) {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var got email.Email
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("body is not an email document: %v", err)
+	}
+	if got.ID != e.ID || len(got.Attachments) != 1 {
+		t.Errorf("decoded ID %q with %d attachments", got.ID, len(got.Attachments))
+	}
+	if data, _ := got.Attachments[0].Bytes(); string(data) != "%PDF-1.4\n" {
+		t.Errorf("inline attachment = %q", data)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	ws := newWebhookServer(t)
+	w := &Webhook{URLs: []string{ws.URL}}
+	if err := w.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail)); err != nil {
+		t.Fatal(err)
+	}
+	r := ws.requests[0]
+	if r.Header.Get("X-Getmail-Signature") != "" || r.Header.Get("X-Getmail-Timestamp") != "" {
+		t.Error("request signed without a secret")
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			ws := newWebhookServer(t, status, status)
+			e := testEmail(t, testAttachmentEmail)
+			w := &Webhook{URLs: []string{ws.URL}, Retries: 2, Backoff: time.Millisecond}
+
+			if err := w.HandleEmail(context.Background(), e); err != nil {
+				t.Fatal(err)
+			}
+			if ws.attempts() != 3 {
+				t.Errorf("%d attempts, want 3", ws.attempts())
+			}
+			for i, r := range ws.requests {
+				if got := r.Header.Get("X-Getmail-Id"); got != e.ID {
+					t.Errorf("attempt %d: X-Getmail-Id = %q", i+1, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	ws := newWebhookServer(t, 503, 503, 503, 503)
+	w := &Webhook{URLs: []string{ws.URL}, Retries: 2, Backoff: time.Millisecond}
+
+	err := w.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail))
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts") {
+		t.Fatalf("error = %v", err)
+	}
+	// Not an SMTPError, so the client is asked to retry later.
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		t.Errorf("error is final: %v", smtpErr)
+	}
+	if ws.attempts() != 3 {
+		t.Errorf("%d attempts, want 3", ws.attempts())
+	}
+}
+
+func TestWebhookRejected(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusUnprocessableEntity} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			ws := newWebhookServer(t, status)
+			w := &Webhook{URLs: []string{ws.URL}, Retries: 2, Backoff: time.Millisecond}
+
+			err := w.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail))
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 554 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 6, 0}) {
+				t.Fatalf("error = %v, want 554 5.6.0", err)
+			}
+			if ws.attempts() != 1 {
+				t.Errorf("%d attempts, want 1", ws.attempts())
+			}
+		})
+	}
+}
+
+func TestWebhookTimeoutRetried(t *testing.T) {
+	ws := newWebhookServer(t)
+	ws.delays = []time.Duration{time.Minute}
+	e := testEmail(t, testAttachmentEmail)
+	w := &Webhook{URLs: []string{ws.URL}, Timeout: 50 * time.Millisecond, Retries: 1, Backoff: time.Millisecond}
+
+	if err := w.HandleEmail(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if ws.attempts() != 2 {
+		t.Errorf("%d attempts, want 2", ws.attempts())
+	}
+	for i, r := range ws.requests {
+		if got := r.Header.Get("X-Getmail-Id"); got != e.ID {
+			t.Errorf("attempt %d: X-Getmail-Id = %q", i+1, got)
+		}
+	}
+}
+
+func TestWebhookCanceled(t *testing.T) {
+	ws := newWebhookServer(t, 503)
+	w := &Webhook{URLs: []string{ws.URL}, Retries: 1, Backoff: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := w.HandleEmail(ctx, testEmail(t, testAttachmentEmail))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want the context's error", err)
+	}
+}
+
+func TestWebhookEveryURL(t *testing.T) {
+	first, second := newWebhookServer(t), newWebhookServer(t, 400)
+	w := &Webhook{URLs: []string{first.URL, second.URL}}
+	if err := w.HandleEmail(context.Background(), testEmail(t, testAttachmentEmail)); err == nil {
+		t.Error("email accepted although the second URL rejected it")
+	}
+	if first.attempts() != 1 || second.attempts() != 1 {
+		t.Errorf("attempts = %d and %d", first.attempts(), second.attempts())
+	}
+}
+
+func TestWebhookMultipart(t *testing.T) {
+	ws := newWebhookServer(t)
+	e := testEmail(t, testAttachmentEmail)
+	w := &Webhook{URLs: []string{ws.URL}, Secret: "s3cret", Attachments: WebhookMultipart}
+
+	if err := w.HandleEmail(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	r, body := ws.requests[0], ws.bodies[0]
+	if got, want := r.Header.Get("X-Getmail-Signature"), "sha256="+Sign("s3cret", r.Header.Get("X-Getmail-Timestamp"), body); got != want {
+		t.Errorf("signature does not cover the multipart body")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("Content-Type = %q", r.Header.Get("Content-Type"))
+	}
+	form, err := multipart.NewReader(strings.NewReader(string(body)), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := form.Value["email"]
+	if len(docs) != 1 {
+		t.Fatalf("email part missing: %v", form.Value)
+	}
+	var doc struct {
+		ID          string `json:"id"`
+		Attachments []struct {
+			Filename string  `json:"filename"`
+			Part     string  `json:"part"`
+			Content  *string `json:"content"`
+		} `json:"attachments"`
+	}
+	if err := json.Unmarshal([]byte(docs[0]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.ID != e.ID || len(doc.Attachments) != 1 || doc.Attachments[0].Filename != "report.pdf" {
+		t.Errorf("email part = %s", docs[0])
+	}
+	if doc.Attachments[0].Content != nil {
+		t.Error("email part carries the attachment content")
+	}
+	if doc.Attachments[0].Part != "attachment-0" {
+		t.Errorf("attachment part = %q, want attachment-0", doc.Attachments[0].Part)
+	}
+
+	files := form.File[doc.Attachments[0].Part]
+	if len(files) != 1 {
+		t.Fatalf("attachment-0 part missing: %v", form.File)
+	}
+	if files[0].Filename != "report.pdf" || files[0].Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("attachment-0: filename %q, type %q", files[0].Filename, files[0].Header.Get("Content-Type"))
+	}
+	f, _ := files[0].Open()
+	defer f.Close()
+	if data, _ := io.ReadAll(f); string(data) != "%PDF-1.4\n" {
+		t.Errorf("attachment-0 content = %q", data)
+	}
+}
+
+func TestWebhookMaxDuration(t *testing.T) {
+	tests := []struct {
+		w       Webhook
+		want    time.Duration
+		bounded bool
+	}{
+		{Webhook{URLs: []string{"a"}, Timeout: 10 * time.Second}, 10 * time.Second, true},
+		// 3 attempts of 10s, then 1s and 2s between them, for each URL.
+		{Webhook{URLs: []string{"a", "b"}, Timeout: 10 * time.Second, Retries: 2}, 66 * time.Second, true},
+		{Webhook{URLs: []string{"a"}, Timeout: time.Second, Retries: 3, Backoff: time.Minute, MaxBackoff: time.Minute}, 3*time.Minute + 4*time.Second, true},
+		{Webhook{URLs: []string{"a"}, Retries: 2}, 0, false},
+	}
+	for _, tt := range tests {
+		got, bounded := tt.w.MaxDuration()
+		if got != tt.want || bounded != tt.bounded {
+			t.Errorf("%d URL(s), Timeout %s, Retries %d: MaxDuration = %s, %v, want %s, %v",
+				len(tt.w.URLs), tt.w.Timeout, tt.w.Retries, got, bounded, tt.want, tt.bounded)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		w    Webhook
+		want []time.Duration
+	}{
+		{Webhook{}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}},
+		{Webhook{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}},
+		{Webhook{Backoff: time.Minute}, []time.Duration{30 * time.Second}},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := tt.w.backoff(i + 1); got != want {
+				t.Errorf("Backoff %s, MaxBackoff %s: retry %d after %s, want %s", tt.w.Backoff, tt.w.MaxBackoff, i+1, got, want)
+			}
+		}
+	}
+}